@@ -0,0 +1,37 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// initAdminDB adds the is_admin flag to users. Admins are promoted directly in
+// the database; there is no API for granting the flag.
+func initAdminDB() error {
+	adminColumn := `ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;`
+	if _, err := db.Exec(adminColumn); err != nil {
+		return fmt.Errorf("error adding users is_admin column: %v", err)
+	}
+	return nil
+}
+
+// requireAdmin parses the userId header and checks that the user is an
+// admin. It writes the error response and returns false otherwise.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return 0, false
+	}
+	var isAdmin bool
+	err := db.QueryRowContext(r.Context(), "SELECT is_admin FROM users WHERE id = $1", userID).Scan(&isAdmin)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	if !isAdmin {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return 0, false
+	}
+	return userID, true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// BlockRequest identifies the user to block. With Mute, the user is only
+// muted: their listings are kept out of the feed, but they can still
+// contact the muting user.
+type BlockRequest struct {
+	UserID int  `json:"userId"`
+	Mute   bool `json:"mute"`
+}
+
+// BlockedUser is an entry in a user's block list.
+type BlockedUser struct {
+	UserID    int       `json:"userId"`
+	Name      string    `json:"name"`
+	Muted     bool      `json:"muted"`
+	BlockedAt time.Time `json:"blockedAt"`
+}
+
+// initBlocksDB creates the table of users blocked or muted by other users.
+func initBlocksDB() error {
+	blocksTable := `
+	CREATE TABLE IF NOT EXISTS user_blocks (
+		blocker_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		blocked_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (blocker_id, blocked_id),
+		CHECK (blocker_id <> blocked_id)
+	);
+	CREATE INDEX IF NOT EXISTS user_blocks_blocked_id_idx ON user_blocks(blocked_id);
+	ALTER TABLE user_blocks ADD COLUMN IF NOT EXISTS muted BOOLEAN NOT NULL DEFAULT FALSE;`
+	if _, err := db.Exec(blocksTable); err != nil {
+		return fmt.Errorf("error creating user_blocks table: %v", err)
+	}
+	return nil
+}
+
+// blockedFeedFilter keeps a listing out of the feed of the viewer, given as
+// parameter $%d, when either has blocked the other or the viewer has muted
+// its seller.
+const blockedFeedFilter = "NOT EXISTS(SELECT 1 FROM user_blocks b WHERE " +
+	"(b.blocker_id = $%[1]d AND b.blocked_id = l.user_id) OR (b.blocker_id = l.user_id AND b.blocked_id = $%[1]d AND NOT b.muted))"
+
+// userBlocksViewer is true when the user in column u.id has blocked the
+// viewer, given as parameter $2. Blocked users cannot see the blocker's
+// profile or reviews.
+const userBlocksViewer = "EXISTS(SELECT 1 FROM user_blocks b WHERE b.blocker_id = u.id AND b.blocked_id = $2 AND NOT b.muted)"
+
+// favoriterNotBlocked leaves out favorites, aliased f, whose user and the
+// listing's seller have blocked one another, so blocked users are not told
+// about the listing's status or price changes.
+const favoriterNotBlocked = "NOT EXISTS(SELECT 1 FROM listings fl JOIN user_blocks b ON NOT b.muted AND " +
+	"((b.blocker_id = fl.user_id AND b.blocked_id = f.user_id) OR (b.blocker_id = f.user_id AND b.blocked_id = fl.user_id)) " +
+	"WHERE fl.id = f.listing_id)"
+
+// isBlocked reports whether either user has blocked the other. Muting does
+// not count.
+func isBlocked(ctx context.Context, exec sqlExecutor, userID, otherID int) (bool, error) {
+	var blocked bool
+	err := exec.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM user_blocks WHERE NOT muted AND ((blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)))",
+		userID, otherID,
+	).Scan(&blocked)
+	return blocked, err
+}
+
+// blocksHandler routes GET (list blocked and muted users), POST (block or
+// mute a user) and DELETE (unblock or unmute a user) requests. Blocking and
+// unblocking are idempotent; blocking a muted user, or muting a blocked one,
+// replaces the entry.
+func blocksHandler(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listBlocks(w, r, currentUserID)
+	case http.MethodPost:
+		addBlock(w, r, currentUserID)
+	case http.MethodDelete:
+		removeBlock(w, r, currentUserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listBlocks writes the users blocked or muted by userID, most recent first.
+func listBlocks(w http.ResponseWriter, r *http.Request, userID int) {
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT b.blocked_id, u.name, b.muted, b.created_at FROM user_blocks b JOIN users u ON u.id = b.blocked_id WHERE b.blocker_id = $1 ORDER BY b.created_at DESC",
+		userID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	blocked := []BlockedUser{}
+	for rows.Next() {
+		var b BlockedUser
+		if err := rows.Scan(&b.UserID, &b.Name, &b.Muted, &b.BlockedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		blocked = append(blocked, b)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocked)
+}
+
+// addBlock blocks or mutes a user for userID.
+func addBlock(w http.ResponseWriter, r *http.Request, userID int) {
+	var req BlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == userID {
+		http.Error(w, "You cannot block yourself", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(),
+		"INSERT INTO user_blocks(blocker_id, blocked_id, muted) SELECT $1, id, $3 FROM users WHERE id = $2 "+
+			"ON CONFLICT (blocker_id, blocked_id) DO UPDATE SET muted = EXCLUDED.muted",
+		userID, req.UserID, req.Mute,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"userId": req.UserID, "blocked": !req.Mute, "muted": req.Mute})
+}
+
+// removeBlock unblocks or unmutes a user for userID.
+func removeBlock(w http.ResponseWriter, r *http.Request, userID int) {
+	blockedID, err := strconv.Atoi(r.URL.Query().Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid userId", http.StatusBadRequest)
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), "DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2", userID, blockedID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"userId": blockedID, "blocked": false, "muted": false})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlocksHandler_Add(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name: "Blocked",
+			body: `{"userId":2}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO user_blocks\\(blocker_id, blocked_id, muted\\) SELECT \\$1, id, \\$3 FROM users WHERE id = \\$2 "+
+					"ON CONFLICT \\(blocker_id, blocked_id\\) DO UPDATE SET muted = EXCLUDED.muted").
+					WithArgs(1, 2, false).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"blocked":true,"muted":false,"userId":2}`,
+		},
+		{
+			name: "Muted",
+			body: `{"userId":2,"mute":true}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO user_blocks").
+					WithArgs(1, 2, true).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"blocked":false,"muted":true,"userId":2}`,
+		},
+		{
+			name: "Unknown User",
+			body: `{"userId":99}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO user_blocks").
+					WithArgs(1, 99, false).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Self",
+			body:           `{"userId":1}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/blocks", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			blocksHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestFeedFilter_ExcludesBlockedUsers(t *testing.T) {
+	where, err := feedFilter(context.Background(), 1, url.Values{})
+	assert.NoError(t, err)
+	assert.Contains(t, where.clause(), "NOT EXISTS(SELECT 1 FROM user_blocks b WHERE (b.blocker_id = $3 AND b.blocked_id = l.user_id) "+
+		"OR (b.blocker_id = l.user_id AND b.blocked_id = $3 AND NOT b.muted))")
+	assert.Equal(t, []interface{}{1, StatusActive, 1}, where.args)
+}
+
+func TestListingDetailHandler_BlockedViewer(t *testing.T) {
+	mock := withMockDB(t)
+	// The seller of listing 7 has blocked user 1.
+	mock.ExpectQuery("WHERE l.id = \\$1 AND \\(l.hidden_at IS NULL OR l.user_id = \\$2\\) AND "+
+		"NOT EXISTS\\(SELECT 1 FROM user_blocks b WHERE b.blocker_id = l.user_id AND b.blocked_id = \\$2 AND NOT b.muted\\)").
+		WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows(listingColumns))
+
+	req := httptest.NewRequest(http.MethodGet, "/listing?listingId=7", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingDetailHandler(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// AttributeType is the value type of a category attribute.
+type AttributeType string
+
+const (
+	AttrString  AttributeType = "string"
+	AttrNumber  AttributeType = "number"
+	AttrInteger AttributeType = "integer"
+	AttrBoolean AttributeType = "boolean"
+	AttrEnum    AttributeType = "enum"
+)
+
+// AttributeDef describes one attribute listings in a category may carry.
+// Options lists the allowed values of an enum; Pattern optionally constrains
+// a string. Compact strings have their spaces removed before they are stored
+// or matched, so "COP 3530" and "COP3530" are the same course code.
+type AttributeDef struct {
+	Name     string        `json:"name"`
+	Label    string        `json:"label"`
+	Type     AttributeType `json:"type"`
+	Required bool          `json:"required,omitempty"`
+	Options  []string      `json:"options,omitempty"`
+	Pattern  string        `json:"pattern,omitempty"`
+	Compact  bool          `json:"compact,omitempty"`
+}
+
+// AttributeSchema is the list of attributes defined for a category. It is
+// stored as JSONB.
+type AttributeSchema []AttributeDef
+
+var attributeNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// validate checks that every attribute has a unique, well-formed name and a
+// usable type definition.
+func (s AttributeSchema) validate() error {
+	seen := map[string]bool{}
+	for _, def := range s {
+		if !attributeNamePattern.MatchString(def.Name) {
+			return fmt.Errorf("Invalid attribute name %q", def.Name)
+		}
+		if seen[def.Name] {
+			return fmt.Errorf("Duplicate attribute %q", def.Name)
+		}
+		seen[def.Name] = true
+
+		switch def.Type {
+		case AttrString:
+			if def.Pattern != "" {
+				if _, err := regexp.Compile(def.Pattern); err != nil {
+					return fmt.Errorf("Invalid pattern for attribute %q", def.Name)
+				}
+			}
+		case AttrNumber, AttrInteger, AttrBoolean:
+		case AttrEnum:
+			if len(def.Options) == 0 {
+				return fmt.Errorf("Enum attribute %q needs options", def.Name)
+			}
+		default:
+			return fmt.Errorf("Unknown type %q for attribute %q", def.Type, def.Name)
+		}
+		if def.Pattern != "" && def.Type != AttrString {
+			return fmt.Errorf("Only string attributes can have a pattern")
+		}
+		if def.Compact && def.Type != AttrString {
+			return fmt.Errorf("Only string attributes can be compact")
+		}
+	}
+	return nil
+}
+
+// Value stores the schema as JSON.
+func (s AttributeSchema) Value() (driver.Value, error) {
+	if s == nil {
+		s = AttributeSchema{}
+	}
+	return json.Marshal(s)
+}
+
+// Scan reads a schema stored as JSON.
+func (s *AttributeSchema) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*s = AttributeSchema{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into AttributeSchema", src)
+	}
+	return json.Unmarshal(data, s)
+}
+
+// Category is a node in the category tree. ListingCount is the number of
+// active listings in the category and all of its descendants.
+type Category struct {
+	ID              int             `json:"id"`
+	ParentID        *int            `json:"parentId"`
+	Name            string          `json:"name"`
+	Slug            string          `json:"slug"`
+	AttributeSchema AttributeSchema `json:"attributeSchema"`
+	ListingCount    int             `json:"listingCount"`
+	Children        []*Category     `json:"children,omitempty"`
+}
+
+// CategoryRequest creates or replaces a category. An empty Slug is derived
+// from Name.
+type CategoryRequest struct {
+	ID              int             `json:"id"`
+	ParentID        *int            `json:"parentId"`
+	Name            string          `json:"name"`
+	Slug            string          `json:"slug"`
+	AttributeSchema AttributeSchema `json:"attributeSchema"`
+}
+
+// categorySeed is a category created at startup. Aliases are lower-case
+// free-text values that existing listings are mapped from.
+type categorySeed struct {
+	slug, name, parent string
+	aliases            []string
+	schema             AttributeSchema
+}
+
+// otherCategorySlug is where listings with an unrecognised free-text category
+// end up during migration.
+const otherCategorySlug = "other"
+
+// defaultCategories seeds the taxonomy with the categories the sell form has
+// always offered. Parents must come before their children.
+var defaultCategories = []categorySeed{
+	{slug: "electronics", name: "Electronics", aliases: []string{"electronic", "tech"}, schema: AttributeSchema{
+		{Name: "brand", Label: "Brand", Type: AttrString},
+		{Name: "model", Label: "Model", Type: AttrString},
+	}},
+	{slug: "laptops", name: "Laptops", parent: "electronics", aliases: []string{"laptop", "computers"}},
+	{slug: "phones", name: "Phones", parent: "electronics", aliases: []string{"phone", "cell phones"}},
+	{slug: "books", name: "Books", aliases: []string{"book"}},
+	{slug: "textbooks", name: "Textbooks", parent: "books", aliases: []string{"textbook"}, schema: AttributeSchema{
+		{Name: "isbn", Label: "ISBN", Type: AttrString, Pattern: `^(97[89])?[0-9]{9}[0-9X]$`},
+		{Name: "courseCode", Label: "Course code", Type: AttrString, Pattern: `^[A-Za-z]{3} ?[0-9]{4}[A-Za-z]?$`, Compact: true},
+		{Name: "edition", Label: "Edition", Type: AttrInteger},
+	}},
+	{slug: "furniture", name: "Furniture", schema: AttributeSchema{
+		{Name: "widthCm", Label: "Width (cm)", Type: AttrNumber},
+		{Name: "depthCm", Label: "Depth (cm)", Type: AttrNumber},
+		{Name: "heightCm", Label: "Height (cm)", Type: AttrNumber},
+	}},
+	{slug: "clothing", name: "Clothing", aliases: []string{"clothes", "apparel"}},
+	{slug: "beauty-and-personal-care", name: "Beauty and Personal Care"},
+	{slug: "sports-and-fitness", name: "Sports and Fitness"},
+	{slug: "toys-and-games", name: "Toys and Games"},
+	{slug: "home-and-kitchen", name: "Home and Kitchen"},
+	{slug: "health-and-wellness", name: "Health and Wellness"},
+	{slug: "baby-products", name: "Baby Products"},
+	{slug: "pet-supplies", name: "Pet Supplies"},
+	{slug: "food-and-beverages", name: "Food and Beverages"},
+	{slug: "automotive", name: "Automotive"},
+	{slug: "diy-and-hardware", name: "DIY and Hardware"},
+	{slug: "arts-and-crafts", name: "Arts and Crafts"},
+	{slug: "office-supplies", name: "Office Supplies"},
+	{slug: "music-and-instruments", name: "Music and Instruments"},
+	{slug: "garden-and-outdoor", name: "Garden and Outdoor"},
+	{slug: otherCategorySlug, name: "Other"},
+}
+
+var (
+	slugPattern      = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	nonSlugCharacter = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// slugify derives a URL slug from a category name, e.g. "DIY and Hardware"
+// becomes "diy-and-hardware".
+func slugify(name string) string {
+	return strings.Trim(nonSlugCharacter.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// initCategoriesDB creates the categories table, links listings to it, seeds
+// the default categories and maps existing free-text categories onto them.
+func initCategoriesDB() error {
+	categoriesTable := `
+	CREATE TABLE IF NOT EXISTS categories (
+		id SERIAL PRIMARY KEY,
+		parent_id INTEGER REFERENCES categories(id) ON DELETE RESTRICT,
+		name TEXT NOT NULL,
+		slug TEXT NOT NULL UNIQUE,
+		attribute_schema JSONB NOT NULL DEFAULT '[]',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories(parent_id);
+	ALTER TABLE categories ADD COLUMN IF NOT EXISTS attribute_schema JSONB NOT NULL DEFAULT '[]';
+	ALTER TABLE categories ADD COLUMN IF NOT EXISTS schema_seeded BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE listings ADD COLUMN IF NOT EXISTS category_id INTEGER REFERENCES categories(id) ON DELETE RESTRICT;
+	CREATE INDEX IF NOT EXISTS listings_category_id_idx ON listings(category_id);`
+	if _, err := db.Exec(categoriesTable); err != nil {
+		return fmt.Errorf("error creating categories table: %v", err)
+	}
+
+	// A category's schema is seeded once: when it is created, or for
+	// categories created before schemas existed, the first time they are seen
+	// with none. schema_seeded records this, so edits made through the admin
+	// API, including clearing a schema, survive a restart.
+	for _, c := range defaultCategories {
+		_, err := db.Exec(
+			"INSERT INTO categories(name, slug, parent_id, attribute_schema, schema_seeded) "+
+				"VALUES($1, $2, (SELECT id FROM categories WHERE slug = $3), $4, TRUE) "+
+				"ON CONFLICT (slug) DO UPDATE SET schema_seeded = TRUE, attribute_schema = CASE "+
+				"WHEN categories.attribute_schema = '[]'::jsonb THEN EXCLUDED.attribute_schema ELSE categories.attribute_schema END "+
+				"WHERE NOT categories.schema_seeded",
+			c.name, c.slug, c.parent, c.schema,
+		)
+		if err != nil {
+			return fmt.Errorf("error seeding category %s: %v", c.slug, err)
+		}
+	}
+
+	// Map free-text categories: first through the seed aliases, then by slug
+	// or name against every category, and finally everything left to Other.
+	// Only unmapped listings are touched, so this is safe to run repeatedly.
+	for _, c := range defaultCategories {
+		if len(c.aliases) == 0 {
+			continue
+		}
+		_, err := db.Exec(
+			"UPDATE listings SET category_id = c.id, category = c.name FROM categories c "+
+				"WHERE c.slug = $1 AND listings.category_id IS NULL AND lower(trim(listings.category)) = ANY($2)",
+			c.slug, pq.Array(c.aliases),
+		)
+		if err != nil {
+			return fmt.Errorf("error mapping listings to category %s: %v", c.slug, err)
+		}
+	}
+	_, err := db.Exec(
+		"UPDATE listings SET category_id = c.id, category = c.name FROM categories c " +
+			"WHERE listings.category_id IS NULL AND (lower(trim(listings.category)) = c.slug OR lower(trim(listings.category)) = lower(c.name))",
+	)
+	if err != nil {
+		return fmt.Errorf("error mapping listings to categories: %v", err)
+	}
+	_, err = db.Exec(
+		"UPDATE listings SET category_id = c.id, category = c.name FROM categories c WHERE c.slug = $1 AND listings.category_id IS NULL",
+		otherCategorySlug,
+	)
+	if err != nil {
+		return fmt.Errorf("error mapping remaining listings to %s: %v", otherCategorySlug, err)
+	}
+	return nil
+}
+
+// categorySelect is the column list read by scanCategory.
+const categorySelect = "SELECT id, parent_id, name, slug, attribute_schema FROM categories"
+
+// scanCategory reads one row selected with categorySelect.
+func scanCategory(row interface{ Scan(...interface{}) error }, c *Category) error {
+	return row.Scan(&c.ID, &c.ParentID, &c.Name, &c.Slug, &c.AttributeSchema)
+}
+
+// resolveCategory finds the category a listing's category value refers to.
+// The value may be a slug or a name in any case; a slug match wins.
+func resolveCategory(ctx context.Context, exec sqlExecutor, value string) (Category, error) {
+	var c Category
+	key := strings.ToLower(strings.TrimSpace(value))
+	err := scanCategory(exec.QueryRowContext(ctx,
+		categorySelect+" WHERE slug = $1 OR lower(name) = $1 ORDER BY slug = $1 DESC, id LIMIT 1", key,
+	), &c)
+	if err == sql.ErrNoRows {
+		return c, badRequest("Unknown category %q", value)
+	}
+	return c, err
+}
+
+// buildCategoryTree links categories to their parents, rolls listing counts
+// up to ancestors and returns the roots. Siblings are sorted by name.
+func buildCategoryTree(categories []*Category) []*Category {
+	byID := map[int]*Category{}
+	for _, c := range categories {
+		byID[c.ID] = c
+	}
+	roots := []*Category{}
+	for _, c := range categories {
+		if c.ParentID != nil && byID[*c.ParentID] != nil {
+			parent := byID[*c.ParentID]
+			parent.Children = append(parent.Children, c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+
+	var total func(c *Category) int
+	total = func(c *Category) int {
+		sort.Slice(c.Children, func(i, j int) bool { return c.Children[i].Name < c.Children[j].Name })
+		for _, child := range c.Children {
+			c.ListingCount += total(child)
+		}
+		return c.ListingCount
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Name < roots[j].Name })
+	for _, root := range roots {
+		total(root)
+	}
+	return roots
+}
+
+// categoriesHandler handles GET requests for the category tree with the
+// number of active listings under each category.
+func categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT c.id, c.parent_id, c.name, c.slug, c.attribute_schema, COUNT(l.id) FROM categories c "+
+			"LEFT JOIN listings l ON l.category_id = c.id AND l.status = $1 AND l.hidden_at IS NULL GROUP BY c.id",
+		StatusActive,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var categories []*Category
+	for rows.Next() {
+		c := &Category{}
+		if err := rows.Scan(&c.ID, &c.ParentID, &c.Name, &c.Slug, &c.AttributeSchema, &c.ListingCount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		categories = append(categories, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildCategoryTree(categories))
+}
+
+// adminCategoriesHandler routes admin requests to create (POST), replace
+// (PUT) and delete (DELETE) categories.
+func adminCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		saveCategory(w, r)
+	case http.MethodDelete:
+		deleteCategory(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validateCategoryRequest normalises the request and checks the fields that
+// do not need the database.
+func validateCategoryRequest(req *CategoryRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return badRequest("Category name is required")
+	}
+	if req.Slug == "" {
+		req.Slug = slugify(req.Name)
+	}
+	if !slugPattern.MatchString(req.Slug) {
+		return badRequest("Invalid slug %q: use lower-case letters, digits and hyphens", req.Slug)
+	}
+	if err := req.AttributeSchema.validate(); err != nil {
+		return badRequest("%s", err.Error())
+	}
+	return nil
+}
+
+// checkCategoryParent makes sure parentID exists and, when moving an existing
+// category, that it is not the category itself or one of its descendants.
+func checkCategoryParent(ctx context.Context, tx *sql.Tx, parentID *int, categoryID int) error {
+	if parentID == nil {
+		return nil
+	}
+	var exists, cycle bool
+	err := tx.QueryRowContext(ctx, `
+		WITH RECURSIVE ancestors(id, parent_id) AS (
+			SELECT id, parent_id FROM categories WHERE id = $1
+			UNION ALL
+			SELECT c.id, c.parent_id FROM categories c JOIN ancestors a ON c.id = a.parent_id
+		)
+		SELECT EXISTS(SELECT 1 FROM ancestors), EXISTS(SELECT 1 FROM ancestors WHERE id = $2)`,
+		*parentID, categoryID,
+	).Scan(&exists, &cycle)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return badRequest("Parent category not found")
+	}
+	if cycle {
+		return badRequest("A category cannot be moved under itself")
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint
+// violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// saveCategory creates a category on POST and replaces one on PUT.
+func saveCategory(w http.ResponseWriter, r *http.Request) {
+	var req CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateCategoryRequest(&req); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	creating := r.Method == http.MethodPost
+	var category Category
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := checkCategoryParent(r.Context(), tx, req.ParentID, req.ID); err != nil {
+			return err
+		}
+
+		var row *sql.Row
+		if creating {
+			row = tx.QueryRowContext(r.Context(),
+				"INSERT INTO categories(parent_id, name, slug, attribute_schema) VALUES($1, $2, $3, $4) RETURNING id, parent_id, name, slug, attribute_schema",
+				req.ParentID, req.Name, req.Slug, req.AttributeSchema,
+			)
+		} else {
+			row = tx.QueryRowContext(r.Context(),
+				"UPDATE categories SET parent_id = $1, name = $2, slug = $3, attribute_schema = $4, updated_at = CURRENT_TIMESTAMP WHERE id = $5 RETURNING id, parent_id, name, slug, attribute_schema",
+				req.ParentID, req.Name, req.Slug, req.AttributeSchema, req.ID,
+			)
+		}
+		err := scanCategory(row, &category)
+		if err == sql.ErrNoRows {
+			return &requestError{status: http.StatusNotFound, message: "Category not found"}
+		}
+		if isUniqueViolation(err) {
+			return &requestError{status: http.StatusConflict, message: fmt.Sprintf("Category slug %q already exists", req.Slug)}
+		}
+		if err != nil || creating {
+			return err
+		}
+
+		// Listings keep a copy of the category name for display.
+		_, err = tx.ExecContext(r.Context(), "UPDATE listings SET category = $1 WHERE category_id = $2", category.Name, category.ID)
+		return err
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if creating {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(category)
+}
+
+// deleteCategory removes a category that has no subcategories and no
+// listings.
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	err = withTx(r.Context(), func(tx *sql.Tx) error {
+		var children, listings int
+		err := tx.QueryRowContext(r.Context(),
+			"SELECT (SELECT COUNT(*) FROM categories WHERE parent_id = $1), (SELECT COUNT(*) FROM listings WHERE category_id = $1)",
+			categoryID,
+		).Scan(&children, &listings)
+		if err != nil {
+			return err
+		}
+		if children > 0 || listings > 0 {
+			return &requestError{status: http.StatusConflict, message: "Category still has subcategories or listings"}
+		}
+
+		result, err := tx.ExecContext(r.Context(), "DELETE FROM categories WHERE id = $1", categoryID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return &requestError{status: http.StatusNotFound, message: "Category not found"}
+		}
+		return nil
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Category deleted successfully"})
+}
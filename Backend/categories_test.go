@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+var categoryColumns = []string{"id", "parent_id", "name", "slug", "attribute_schema"}
+
+// expectCategoryLookup queues the queries that resolve key to a category
+// and load its attribute schema, given as JSON for each level from the root
+// down.
+func expectCategoryLookup(mock sqlmock.Sqlmock, key string, id int, name string, schemas ...string) {
+	mock.ExpectQuery("SELECT id, parent_id, name, slug, attribute_schema FROM categories WHERE slug = \\$1 OR lower\\(name\\) = \\$1").
+		WithArgs(key).
+		WillReturnRows(sqlmock.NewRows(categoryColumns).AddRow(id, nil, name, slugify(name), []byte("[]")))
+	levels := sqlmock.NewRows([]string{"attribute_schema"})
+	for _, schema := range schemas {
+		levels.AddRow([]byte(schema))
+	}
+	mock.ExpectQuery("WITH RECURSIVE chain").
+		WithArgs(id).
+		WillReturnRows(levels)
+}
+
+// expectAdmin queues the admin check for user 1.
+func expectAdmin(mock sqlmock.Sqlmock, isAdmin bool) {
+	mock.ExpectQuery("SELECT is_admin FROM users WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"is_admin"}).AddRow(isAdmin))
+}
+
+func TestSlugify(t *testing.T) {
+	assert.Equal(t, "diy-and-hardware", slugify("DIY and Hardware"))
+	assert.Equal(t, "laptops", slugify("  Laptops! "))
+	assert.Equal(t, "pc-parts-gpus", slugify("PC Parts / GPUs"))
+}
+
+func TestAttributeSchema_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema AttributeSchema
+		valid  bool
+	}{
+		{"Empty", AttributeSchema{}, true},
+		{"Typed Fields", AttributeSchema{
+			{Name: "isbn", Type: AttrString, Pattern: `^\d{10}(\d{3})?$`},
+			{Name: "edition", Type: AttrInteger},
+			{Name: "condition", Type: AttrEnum, Options: []string{"new", "used"}},
+		}, true},
+		{"Duplicate Name", AttributeSchema{{Name: "brand", Type: AttrString}, {Name: "brand", Type: AttrString}}, false},
+		{"Bad Name", AttributeSchema{{Name: "course code", Type: AttrString}}, false},
+		{"Unknown Type", AttributeSchema{{Name: "size", Type: "date"}}, false},
+		{"Enum Without Options", AttributeSchema{{Name: "condition", Type: AttrEnum}}, false},
+		{"Bad Pattern", AttributeSchema{{Name: "isbn", Type: AttrString, Pattern: "("}}, false},
+		{"Pattern On Number", AttributeSchema{{Name: "width", Type: AttrNumber, Pattern: "1"}}, false},
+	}
+	for _, tt := range tests {
+		err := tt.schema.validate()
+		assert.Equal(t, tt.valid, err == nil, "%s: %v", tt.name, err)
+	}
+}
+
+func TestCategoriesHandler_RollsUpCounts(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT c.id, c.parent_id, c.name, c.slug, c.attribute_schema, COUNT\\(l.id\\) FROM categories c").
+		WithArgs(StatusActive).
+		WillReturnRows(sqlmock.NewRows(append(categoryColumns, "count")).
+			AddRow(2, 1, "Laptops", "laptops", []byte("[]"), 3).
+			AddRow(1, nil, "Electronics", "electronics", []byte("[]"), 1).
+			AddRow(3, 1, "Phones", "phones", []byte(`[{"name":"brand","label":"Brand","type":"string"}]`), 2).
+			AddRow(4, nil, "Books", "books", []byte("[]"), 0))
+
+	req := httptest.NewRequest(http.MethodGet, "/categories", nil)
+	w := httptest.NewRecorder()
+
+	categoriesHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var tree []Category
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tree))
+	assert.Len(t, tree, 2)
+	assert.Equal(t, "Books", tree[0].Name)
+	electronics := tree[1]
+	assert.Equal(t, 6, electronics.ListingCount)
+	assert.Len(t, electronics.Children, 2)
+	assert.Equal(t, "Laptops", electronics.Children[0].Name)
+	assert.Equal(t, "brand", electronics.Children[1].AttributeSchema[0].Name)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdminCategoriesHandler_Create(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Subcategory With Derived Slug",
+			body: `{"name":"Gaming Consoles","parentId":1}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+				mock.ExpectBegin()
+				mock.ExpectQuery("WITH RECURSIVE ancestors").
+					WithArgs(1, 0).
+					WillReturnRows(sqlmock.NewRows([]string{"exists", "cycle"}).AddRow(true, false))
+				mock.ExpectQuery("INSERT INTO categories").
+					WithArgs(1, "Gaming Consoles", "gaming-consoles", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows(categoryColumns).AddRow(9, 1, "Gaming Consoles", "gaming-consoles", []byte("[]")))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Duplicate Slug",
+			body: `{"name":"Books"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO categories").
+					WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Invalid Schema",
+			body: `{"name":"Bikes","attributeSchema":[{"name":"size","type":"date"}]}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Not Admin",
+			body: `{"name":"Bikes"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, false)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/categories", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			adminCategoriesHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAdminCategoriesHandler_MoveUnderDescendant(t *testing.T) {
+	mock := withMockDB(t)
+	expectAdmin(mock, true)
+	mock.ExpectBegin()
+	mock.ExpectQuery("WITH RECURSIVE ancestors").
+		WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists", "cycle"}).AddRow(true, true))
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest(http.MethodPut, "/admin/categories", bytes.NewBufferString(`{"id":1,"name":"Electronics","parentId":2}`))
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	adminCategoriesHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateListing_UnknownCategory(t *testing.T) {
+	mock := withMockDB(t)
+	expectNewListingChecks(mock)
+	mock.ExpectQuery("FROM categories WHERE slug = \\$1 OR lower\\(name\\) = \\$1").
+		WithArgs("spaceships").
+		WillReturnRows(sqlmock.NewRows(categoryColumns))
+	mock.ExpectRollback()
+
+	req := multipartListingRequest(t, http.MethodPost, "/listings", map[string]string{
+		"productName": "Rocket",
+		"price":       "100",
+		"category":    "Spaceships",
+	}, 1)
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `Unknown category "Spaceships"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
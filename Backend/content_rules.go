@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// What happens to a listing matching a content rule. Rejected listings are
+// not saved; listings held for review are saved hidden and queued for the
+// moderators.
+const (
+	contentReject = "reject"
+	contentReview = "review"
+)
+
+const (
+	// defaultBannedImageDistance is the largest Hamming distance between
+	// perceptual hashes still counted as the same image.
+	defaultBannedImageDistance = 8
+	// bannedImageRule names banned image matches in the results.
+	bannedImageRule = "banned image"
+	// auditHeldForReview records a listing held for review by an automatic
+	// check.
+	auditHeldForReview = "held_for_review"
+)
+
+// ContentRule denies listings whose name or description contains any of
+// Keywords, as whole words and ignoring case, or matches any of Patterns.
+type ContentRule struct {
+	Name     string   `json:"name"`
+	Keywords []string `json:"keywords"`
+	Patterns []string `json:"patterns"`
+	Action   string   `json:"action"`
+
+	matchers []*regexp.Regexp
+}
+
+// BannedImages lists images that may not appear in listings. Every image in
+// Dir, except dotfiles, is hashed when the rules are loaded.
+type BannedImages struct {
+	Dir         string `json:"dir"`
+	MaxDistance int    `json:"maxDistance"`
+	Action      string `json:"action"`
+
+	hashes []uint64
+}
+
+// ContentRules is the prohibited content policy, read from the file named by
+// "contentRulesFile" in the "moderation" section of config.json.
+type ContentRules struct {
+	Rules        []ContentRule `json:"rules"`
+	BannedImages BannedImages  `json:"bannedImages"`
+}
+
+// ContentMatch is a rule a listing broke.
+type ContentMatch struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+}
+
+// contentMatches are the rules a listing broke.
+type contentMatches []ContentMatch
+
+// contentRules is the active policy. Without a rules file nothing is
+// filtered.
+var contentRules = &ContentRules{}
+
+// loadContentRules reads and compiles the rules file at path.
+func loadContentRules(path string) (*ContentRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := &ContentRules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("invalid content rules: %v", err)
+	}
+
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if rule.Action != contentReject && rule.Action != contentReview {
+			return nil, fmt.Errorf("content rule %q: action must be reject or review", rule.Name)
+		}
+		if len(rule.Keywords) > 0 {
+			words := make([]string, len(rule.Keywords))
+			for j, k := range rule.Keywords {
+				words[j] = regexp.QuoteMeta(strings.TrimSpace(k))
+			}
+			rule.matchers = append(rule.matchers, regexp.MustCompile(`(?i)\b(`+strings.Join(words, "|")+`)\b`))
+		}
+		for _, p := range rule.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("content rule %q: %v", rule.Name, err)
+			}
+			rule.matchers = append(rule.matchers, re)
+		}
+	}
+
+	banned := &rules.BannedImages
+	if banned.Dir == "" {
+		return rules, nil
+	}
+	if banned.Action == "" {
+		banned.Action = contentReject
+	}
+	if banned.Action != contentReject && banned.Action != contentReview {
+		return nil, fmt.Errorf("banned images: action must be reject or review")
+	}
+	if banned.MaxDistance <= 0 {
+		banned.MaxDistance = defaultBannedImageDistance
+	}
+	entries, err := os.ReadDir(banned.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		img, err := imaging.Open(filepath.Join(banned.Dir, e.Name()), imaging.AutoOrientation(true))
+		if err != nil {
+			return nil, fmt.Errorf("banned image %s: %v", e.Name(), err)
+		}
+		banned.hashes = append(banned.hashes, perceptualHash(img))
+	}
+	return rules, nil
+}
+
+// screen checks a listing's text and uploaded images against the rules.
+func (c *ContentRules) screen(uploads []uploadedImage, texts ...string) contentMatches {
+	var matches contentMatches
+	text := strings.Join(texts, "\n")
+	for _, rule := range c.Rules {
+		for _, re := range rule.matchers {
+			if re.MatchString(text) {
+				matches = append(matches, ContentMatch{Rule: rule.Name, Action: rule.Action})
+				break
+			}
+		}
+	}
+	for _, u := range uploads {
+		if c.BannedImages.matches(u.renditions.PHash) {
+			matches = append(matches, ContentMatch{Rule: bannedImageRule, Action: c.BannedImages.Action})
+			break
+		}
+	}
+	return matches
+}
+
+// matches reports whether hash is close to one of the banned images.
+func (b *BannedImages) matches(hash uint64) bool {
+	for _, banned := range b.hashes {
+		if hashDistance(hash, banned) <= b.MaxDistance {
+			return true
+		}
+	}
+	return false
+}
+
+// action is the strictest action of the matched rules, or an empty string
+// if no rule matched.
+func (m contentMatches) action() string {
+	action := ""
+	for _, match := range m {
+		if match.Action == contentReject {
+			return contentReject
+		}
+		action = contentReview
+	}
+	return action
+}
+
+// String lists the names of the matched rules.
+func (m contentMatches) String() string {
+	names := make([]string, len(m))
+	for i, match := range m {
+		names[i] = match.Rule
+	}
+	return strings.Join(names, ", ")
+}
+
+// rejection is the error returned for a listing breaking a reject rule.
+func (m contentMatches) rejection() error {
+	return badRequest("Listing violates the prohibited items policy: %s", m)
+}
+
+// holdListingForReview hides a listing and queues it for the moderators as
+// a report without a reporter. Callers tell stream subscribers about
+// listings that were already public. A listing that already has such a
+// report pending is not queued twice.
+func holdListingForReview(ctx context.Context, tx *sql.Tx, listingID, sellerID int, reason ReportReason, details string) error {
+	if err := markListingHidden(ctx, tx, listingID, nil); err != nil {
+		return err
+	}
+	var reportID int
+	err := tx.QueryRowContext(ctx,
+		"INSERT INTO reports(listing_id, reported_user_id, reason, details) SELECT $1, $2, $3, $4 "+
+			"WHERE NOT EXISTS(SELECT 1 FROM reports WHERE listing_id = $1 AND reporter_id IS NULL AND status <> $5) RETURNING id",
+		listingID, sellerID, reason, details, ReportResolved,
+	).Scan(&reportID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return recordModeration(ctx, tx, ModerationAuditEntry{
+		ReportID:  &reportID,
+		Action:    auditHeldForReview,
+		ListingID: &listingID,
+		UserID:    &sellerID,
+		Note:      details,
+	})
+}
+
+// holdForContentReview holds a listing that broke review rules.
+func holdForContentReview(ctx context.Context, tx *sql.Tx, listingID, sellerID int, matches contentMatches) error {
+	return holdListingForReview(ctx, tx, listingID, sellerID, ReasonProhibitedItem, "Matched content rules: "+matches.String())
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPattern draws a w x h image whose structure depends on seed, so that
+// different seeds give perceptually different images.
+func testPattern(w, h, seed int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(((x*(seed+1)/w)+(y*(seed+2)/h))%2) * 200
+			img.Set(x, y, color.NRGBA{v, v / 2, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+// writeContentRules writes a rules file banning the image of seed 1 and
+// returns its path.
+func writeContentRules(t *testing.T) string {
+	dir := t.TempDir()
+	bannedDir := filepath.Join(dir, "banned")
+	assert.NoError(t, os.Mkdir(bannedDir, 0o755))
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, testPattern(200, 200, 1)))
+	assert.NoError(t, os.WriteFile(filepath.Join(bannedDir, "banned.png"), buf.Bytes(), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(bannedDir, ".gitkeep"), nil, 0o644))
+
+	rules := `{
+		"rules": [
+			{"name": "weapons", "keywords": ["pistol", "brass knuckles"], "action": "reject"},
+			{"name": "alcohol", "keywords": ["beer"], "action": "review"},
+			{"name": "tickets above face value", "patterns": ["(?i)\\btickets?\\b.*\\bover\\s+face\\s+value\\b"], "action": "review"}
+		],
+		"bannedImages": {"dir": "` + bannedDir + `"}
+	}`
+	path := filepath.Join(dir, "rules.json")
+	assert.NoError(t, os.WriteFile(path, []byte(rules), 0o644))
+	return path
+}
+
+func TestPerceptualHash(t *testing.T) {
+	original := perceptualHash(testPattern(400, 300, 1))
+	resized := perceptualHash(imaging.Resize(testPattern(400, 300, 1), 160, 120, imaging.Lanczos))
+	different := perceptualHash(testPattern(400, 300, 5))
+
+	assert.LessOrEqual(t, hashDistance(original, resized), defaultBannedImageDistance)
+	assert.Greater(t, hashDistance(original, different), defaultBannedImageDistance)
+}
+
+func TestContentRules_Screen(t *testing.T) {
+	rules, err := loadContentRules(writeContentRules(t))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultBannedImageDistance, rules.BannedImages.MaxDistance)
+	assert.Len(t, rules.BannedImages.hashes, 1)
+
+	banned := uploadedImage{renditions: &ImageRenditions{PHash: perceptualHash(testPattern(640, 640, 1))}}
+	harmless := uploadedImage{renditions: &ImageRenditions{PHash: perceptualHash(testPattern(640, 640, 6))}}
+
+	tests := []struct {
+		name    string
+		uploads []uploadedImage
+		text    string
+		action  string
+		matched string
+	}{
+		{"Keyword Rejects", nil, "Airsoft PISTOL, barely used", contentReject, "weapons"},
+		{"Keyword Is A Whole Word", nil, "Beerus action figure", "", ""},
+		{"Keyword Sends To Review", nil, "Mini fridge, fits a case of beer", contentReview, "alcohol"},
+		{"Pattern Sends To Review", nil, "Two tickets, selling over face value", contentReview, "tickets above face value"},
+		{"Reject Wins Over Review", nil, "Beer and brass knuckles", contentReject, "weapons, alcohol"},
+		{"Banned Image", []uploadedImage{harmless, banned}, "Poster", contentReject, bannedImageRule},
+		{"Clean Listing", []uploadedImage{harmless}, "Desk lamp", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches := rules.screen(tt.uploads, tt.text)
+			assert.Equal(t, tt.action, matches.action())
+			assert.Equal(t, tt.matched, matches.String())
+		})
+	}
+}
+
+func TestLoadContentRules_InvalidAction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"rules":[{"name":"x","keywords":["y"],"action":"ban"}]}`), 0o644))
+
+	_, err := loadContentRules(path)
+	assert.Error(t, err)
+}
+
+func TestHoldForContentReview(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE listings SET hidden_at = COALESCE\\(hidden_at, \\$1\\), hidden_by = COALESCE\\(\\$2, hidden_by\\) WHERE id = \\$3").
+		WithArgs(sqlmock.AnyArg(), nil, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO reports\\(listing_id, reported_user_id, reason, details\\) SELECT .* WHERE NOT EXISTS").
+		WithArgs(7, 2, ReasonProhibitedItem, "Matched content rules: alcohol", ReportResolved).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	expectAudit(mock, nil, auditHeldForReview)
+	// Editing the listing again while it is queued does not queue it twice.
+	mock.ExpectExec("UPDATE listings SET hidden_at").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO reports").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectCommit()
+
+	matches := contentMatches{{Rule: "alcohol", Action: contentReview}}
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, holdForContentReview(context.Background(), tx, 7, 2, matches))
+	assert.NoError(t, holdForContentReview(context.Background(), tx, 7, 2, matches))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListingsHandler_CreateRejectsProhibitedItem(t *testing.T) {
+	mock := withMockDB(t)
+	rules, err := loadContentRules(writeContentRules(t))
+	assert.NoError(t, err)
+	originalRules := contentRules
+	contentRules = rules
+	t.Cleanup(func() { contentRules = originalRules })
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("productName", "Pistol")
+	form.WriteField("productDescription", "Never fired")
+	form.WriteField("price", "100")
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/listings", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "prohibited items policy: weapons")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
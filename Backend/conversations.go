@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMessageLength is the longest message body accepted, in characters.
+const maxMessageLength = 2000
+
+// errMessagingBlocked is returned when either participant has blocked the
+// other.
+var errMessagingBlocked = &requestError{status: http.StatusForbidden, message: "You cannot message this user"}
+
+// errConversationNotFound is returned for conversations that do not exist or
+// that the user is not part of.
+var errConversationNotFound = &requestError{status: http.StatusNotFound, message: "Conversation not found"}
+
+// Message is one message in a conversation. ReadAt is set once the
+// recipient has read it.
+type Message struct {
+	ID             int        `json:"id"`
+	ConversationID int        `json:"conversationId"`
+	SenderID       int        `json:"senderId"`
+	Body           string     `json:"body"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	ReadAt         *time.Time `json:"readAt"`
+}
+
+// Conversation is a thread between a buyer and the seller of a listing, as
+// seen from one of them.
+type Conversation struct {
+	ID            int       `json:"id"`
+	ListingID     int       `json:"listingId"`
+	ListingName   string    `json:"listingName"`
+	BuyerID       int       `json:"buyerId"`
+	SellerID      int       `json:"sellerId"`
+	OtherUserID   int       `json:"otherUserId"`
+	OtherUserName string    `json:"otherUserName"`
+	LastMessage   Message   `json:"lastMessage"`
+	UnreadCount   int       `json:"unreadCount"`
+	LastMessageAt time.Time `json:"lastMessageAt"`
+}
+
+// StartConversationRequest opens a conversation about a listing with a first
+// message to its seller.
+type StartConversationRequest struct {
+	ListingID int    `json:"listingId"`
+	Body      string `json:"body"`
+}
+
+// SendMessageRequest adds a message to a conversation.
+type SendMessageRequest struct {
+	ConversationID int    `json:"conversationId"`
+	Body           string `json:"body"`
+}
+
+// initConversationsDB creates the conversations and messages tables.
+func initConversationsDB() error {
+	conversationsTable := `
+	CREATE TABLE IF NOT EXISTS conversations (
+		id SERIAL PRIMARY KEY,
+		listing_id INTEGER NOT NULL REFERENCES listings(id) ON DELETE CASCADE,
+		buyer_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		seller_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_message_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (listing_id, buyer_id)
+	);
+	CREATE INDEX IF NOT EXISTS conversations_buyer_id_idx ON conversations(buyer_id, last_message_at DESC);
+	CREATE INDEX IF NOT EXISTS conversations_seller_id_idx ON conversations(seller_id, last_message_at DESC);`
+	if _, err := db.Exec(conversationsTable); err != nil {
+		return fmt.Errorf("error creating conversations table: %v", err)
+	}
+
+	messagesTable := `
+	CREATE TABLE IF NOT EXISTS messages (
+		id SERIAL PRIMARY KEY,
+		conversation_id INTEGER NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+		sender_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		read_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS messages_conversation_id_idx ON messages(conversation_id, created_at);
+	CREATE INDEX IF NOT EXISTS messages_unread_idx ON messages(conversation_id) WHERE read_at IS NULL;`
+	if _, err := db.Exec(messagesTable); err != nil {
+		return fmt.Errorf("error creating messages table: %v", err)
+	}
+	return nil
+}
+
+// messageBody trims a message and checks its length.
+func messageBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", badRequest("Message cannot be empty")
+	}
+	if len([]rune(body)) > maxMessageLength {
+		return "", badRequest("Message is too long: at most %d characters", maxMessageLength)
+	}
+	return body, nil
+}
+
+// addMessage stores a message from senderID to recipientID, bumps the
+// conversation to the top of both inboxes and pushes the message to both
+// users' connected devices.
+func addMessage(ctx context.Context, tx *sql.Tx, conversationID, senderID, recipientID int, body string) (Message, error) {
+	m := Message{ConversationID: conversationID, SenderID: senderID, Body: body, CreatedAt: time.Now()}
+	err := tx.QueryRowContext(ctx,
+		"INSERT INTO messages(conversation_id, sender_id, body, created_at) VALUES($1, $2, $3, $4) RETURNING id",
+		conversationID, senderID, body, m.CreatedAt,
+	).Scan(&m.ID)
+	if err != nil {
+		return m, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE conversations SET last_message_at = $1 WHERE id = $2", m.CreatedAt, conversationID)
+	if err != nil {
+		return m, err
+	}
+	return m, publishEvent(ctx, tx, []int{recipientID, senderID}, eventMessage, m)
+}
+
+// conversationsHandler routes GET (the user's inbox) and POST (message the
+// seller of a listing) requests.
+func conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listConversations(w, r, currentUserID)
+	case http.MethodPost:
+		startConversation(w, r, currentUserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listConversations writes userID's inbox: every conversation they take part
+// in with its latest message and the number of messages they have not read,
+// most recently active first.
+func listConversations(w http.ResponseWriter, r *http.Request, userID int) {
+	rows, err := db.QueryContext(r.Context(), `
+	SELECT c.id, c.listing_id, l.product_name, c.buyer_id, c.seller_id,
+		CASE WHEN c.buyer_id = $1 THEN s.name ELSE b.name END,
+		m.id, m.sender_id, m.body, m.created_at, m.read_at, c.last_message_at,
+		(SELECT COUNT(*) FROM messages u WHERE u.conversation_id = c.id AND u.sender_id <> $1 AND u.read_at IS NULL)
+	FROM conversations c
+	JOIN listings l ON l.id = c.listing_id
+	JOIN users b ON b.id = c.buyer_id
+	JOIN users s ON s.id = c.seller_id
+	JOIN LATERAL (SELECT id, sender_id, body, created_at, read_at FROM messages
+		WHERE conversation_id = c.id ORDER BY created_at DESC, id DESC LIMIT 1) m ON TRUE
+	WHERE c.buyer_id = $1 OR c.seller_id = $1
+	ORDER BY c.last_message_at DESC, c.id DESC`, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		var c Conversation
+		m := &c.LastMessage
+		err := rows.Scan(&c.ID, &c.ListingID, &c.ListingName, &c.BuyerID, &c.SellerID, &c.OtherUserName,
+			&m.ID, &m.SenderID, &m.Body, &m.CreatedAt, &m.ReadAt, &c.LastMessageAt, &c.UnreadCount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.ConversationID = c.ID
+		c.OtherUserID = c.SellerID
+		if c.SellerID == userID {
+			c.OtherUserID = c.BuyerID
+		}
+		conversations = append(conversations, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversations)
+}
+
+// startConversation sends a message from userID to the seller of a listing.
+// A buyer has one conversation per listing, so messaging the same seller
+// about the same listing again continues it.
+func startConversation(w http.ResponseWriter, r *http.Request, userID int) {
+	var req StartConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var m Message
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		body, err := messageBody(req.Body)
+		if err != nil {
+			return err
+		}
+		var sellerID int
+		var status ListingStatus
+		var hidden bool
+		err = tx.QueryRowContext(r.Context(),
+			"SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = $1", req.ListingID,
+		).Scan(&sellerID, &status, &hidden)
+		// Listings taken down by moderation are only visible to their owner.
+		if err == sql.ErrNoRows || (err == nil && (status == StatusDraft || (hidden && sellerID != userID))) {
+			return errListingNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if sellerID == userID {
+			return badRequest("You cannot message yourself about your own listing")
+		}
+		blocked, err := isBlocked(r.Context(), tx, userID, sellerID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return errMessagingBlocked
+		}
+
+		var conversationID int
+		err = tx.QueryRowContext(r.Context(),
+			"INSERT INTO conversations(listing_id, buyer_id, seller_id) VALUES($1, $2, $3) "+
+				"ON CONFLICT (listing_id, buyer_id) DO UPDATE SET seller_id = EXCLUDED.seller_id RETURNING id",
+			req.ListingID, userID, sellerID,
+		).Scan(&conversationID)
+		if err != nil {
+			return err
+		}
+		m, err = addMessage(r.Context(), tx, conversationID, userID, sellerID, body)
+		return err
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+// conversationMessagesHandler routes GET (read a conversation) and POST
+// (reply in a conversation) requests.
+func conversationMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		readConversation(w, r, currentUserID)
+	case http.MethodPost:
+		replyToConversation(w, r, currentUserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// conversationPeer returns the other participant of a conversation userID
+// takes part in.
+func conversationPeer(ctx context.Context, exec sqlExecutor, conversationID, userID int) (int, error) {
+	var buyerID, sellerID int
+	err := exec.QueryRowContext(ctx, "SELECT buyer_id, seller_id FROM conversations WHERE id = $1", conversationID).Scan(&buyerID, &sellerID)
+	if err == sql.ErrNoRows {
+		return 0, errConversationNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch userID {
+	case buyerID:
+		return sellerID, nil
+	case sellerID:
+		return buyerID, nil
+	}
+	return 0, errConversationNotFound
+}
+
+// readConversation writes the messages of a conversation, oldest first, and
+// marks those sent to userID as read.
+func readConversation(w http.ResponseWriter, r *http.Request, userID int) {
+	conversationID, err := strconv.Atoi(r.URL.Query().Get("conversationId"))
+	if err != nil {
+		http.Error(w, "Invalid conversationId", http.StatusBadRequest)
+		return
+	}
+
+	var messages []Message
+	err = withTx(r.Context(), func(tx *sql.Tx) error {
+		if _, err := conversationPeer(r.Context(), tx, conversationID, userID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(r.Context(),
+			"UPDATE messages SET read_at = $1 WHERE conversation_id = $2 AND sender_id <> $3 AND read_at IS NULL",
+			time.Now(), conversationID, userID,
+		)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(r.Context(),
+			"SELECT id, sender_id, body, created_at, read_at FROM messages WHERE conversation_id = $1 ORDER BY created_at, id",
+			conversationID,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		messages = []Message{}
+		for rows.Next() {
+			m := Message{ConversationID: conversationID}
+			if err := rows.Scan(&m.ID, &m.SenderID, &m.Body, &m.CreatedAt, &m.ReadAt); err != nil {
+				return err
+			}
+			messages = append(messages, m)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// replyToConversation sends a message from userID in a conversation they take
+// part in.
+func replyToConversation(w http.ResponseWriter, r *http.Request, userID int) {
+	var req SendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var m Message
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		body, err := messageBody(req.Body)
+		if err != nil {
+			return err
+		}
+		peerID, err := conversationPeer(r.Context(), tx, req.ConversationID, userID)
+		if err != nil {
+			return err
+		}
+		blocked, err := isBlocked(r.Context(), tx, userID, peerID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return errMessagingBlocked
+		}
+		m, err = addMessage(r.Context(), tx, req.ConversationID, userID, peerID, body)
+		return err
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectBlockCheck queues the block lookup between two users.
+func expectBlockCheck(mock sqlmock.Sqlmock, userID, otherID int, blocked bool) {
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM user_blocks WHERE").
+		WithArgs(userID, otherID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(blocked))
+}
+
+func TestConversationsHandler_Start(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Started",
+			body: `{"listingId":3,"body":"  Is this still available?  "}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(2, "active", false))
+				expectBlockCheck(mock, 1, 2, false)
+				mock.ExpectQuery("INSERT INTO conversations\\(listing_id, buyer_id, seller_id\\) VALUES\\(\\$1, \\$2, \\$3\\) ON CONFLICT").
+					WithArgs(3, 1, 2).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+				mock.ExpectQuery("INSERT INTO messages\\(conversation_id, sender_id, body, created_at\\)").
+					WithArgs(9, 1, "Is this still available?", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(30))
+				mock.ExpectExec("UPDATE conversations SET last_message_at = \\$1 WHERE id = \\$2").
+					WithArgs(sqlmock.AnyArg(), 9).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectRealtimeEvent(mock, eventMessage)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Blocked",
+			body: `{"listingId":3,"body":"Hello"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(2, "active", false))
+				expectBlockCheck(mock, 1, 2, true)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Own Listing",
+			body: `{"listingId":3,"body":"Hello"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(1, "active", false))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Draft Listing",
+			body: `{"listingId":3,"body":"Hello"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(2, "draft", false))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Hidden Listing",
+			body: `{"listingId":3,"body":"Hello"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(2, "active", true))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Empty Message",
+			body: `{"listingId":3,"body":"   "}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Message Too Long",
+			body: `{"listingId":3,"body":"` + strings.Repeat("a", maxMessageLength+1) + `"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/conversations", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			conversationsHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestConversationsHandler_Inbox(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	mock.ExpectQuery("FROM conversations c .* WHERE c.buyer_id = \\$1 OR c.seller_id = \\$1").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "listing_id", "product_name", "buyer_id", "seller_id", "name",
+			"m_id", "sender_id", "body", "created_at", "read_at", "last_message_at", "count"}).
+			AddRow(9, 3, "Desk Lamp", 1, 2, "User1", 30, 1, "Is this still available?", now, nil, now, 1))
+
+	req := httptest.NewRequest(http.MethodGet, "/conversations", nil)
+	req.Header.Set("userId", "2")
+	w := httptest.NewRecorder()
+
+	conversationsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var inbox []Conversation
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &inbox))
+	if assert.Len(t, inbox, 1) {
+		assert.Equal(t, 1, inbox[0].OtherUserID)
+		assert.Equal(t, 1, inbox[0].UnreadCount)
+		assert.Equal(t, 9, inbox[0].LastMessage.ConversationID)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestConversationMessagesHandler_Read(t *testing.T) {
+	tests := []struct {
+		name           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Marks Incoming Read",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT buyer_id, seller_id FROM conversations WHERE id = \\$1").
+					WithArgs(9).
+					WillReturnRows(sqlmock.NewRows([]string{"buyer_id", "seller_id"}).AddRow(1, 2))
+				mock.ExpectExec("UPDATE messages SET read_at = \\$1 WHERE conversation_id = \\$2 AND sender_id <> \\$3 AND read_at IS NULL").
+					WithArgs(sqlmock.AnyArg(), 9, 2).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT id, sender_id, body, created_at, read_at FROM messages WHERE conversation_id = \\$1").
+					WithArgs(9).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "sender_id", "body", "created_at", "read_at"}).
+						AddRow(30, 1, "Is this still available?", time.Now(), time.Now()))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Not A Participant",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT buyer_id, seller_id FROM conversations WHERE id = \\$1").
+					WithArgs(9).
+					WillReturnRows(sqlmock.NewRows([]string{"buyer_id", "seller_id"}).AddRow(1, 3))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodGet, "/conversations/messages?conversationId=9", nil)
+			req.Header.Set("userId", "2")
+			w := httptest.NewRecorder()
+
+			conversationMessagesHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestConversationMessagesHandler_ReplyBlocked(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT buyer_id, seller_id FROM conversations WHERE id = \\$1").
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"buyer_id", "seller_id"}).AddRow(1, 2))
+	expectBlockCheck(mock, 2, 1, true)
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest(http.MethodPost, "/conversations/messages", bytes.NewBufferString(`{"conversationId":9,"body":"Still there?"}`))
+	req.Header.Set("userId", "2")
+	w := httptest.NewRecorder()
+
+	conversationMessagesHandler(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "You cannot message this user")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListingsHandler_OmitsSellerEmail(t *testing.T) {
+	mock := withMockDB(t)
+	expectListingFeed(mock, 1, 0)
+
+	req := httptest.NewRequest(http.MethodGet, "/listings", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "userEmail")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
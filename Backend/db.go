@@ -128,7 +128,6 @@ func initListingsDB() error {
 		user_id INTEGER NOT NULL,
 		product_name TEXT NOT NULL,
 		product_description TEXT,
-		price NUMERIC NOT NULL,
 		category TEXT,
 		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
@@ -149,6 +148,17 @@ func initListingsDB() error {
 	if _, err := db.Exec(imagesTable); err != nil {
 		return fmt.Errorf("error creating listing_images table: %v", err)
 	}
+
+	// Resized renditions; image_data holds the full-size rendition. position
+	// orders images for display, and the lowest position is the cover image.
+	listingImageColumns := `
+	ALTER TABLE listing_images
+		ADD COLUMN IF NOT EXISTS medium_data BYTEA,
+		ADD COLUMN IF NOT EXISTS thumbnail_data BYTEA,
+		ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0;`
+	if _, err := db.Exec(listingImageColumns); err != nil {
+		return fmt.Errorf("error adding listing_images columns: %v", err)
+	}
 	return nil
 }
 
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// What happens when a seller posts a listing that repeats one of their own.
+// block refuses it; merge refuses it but lets the seller confirm it is a
+// different item; flag creates it hidden and queues it for the moderators.
+const (
+	duplicateBlock = "block"
+	duplicateMerge = "merge"
+	duplicateFlag  = "flag"
+)
+
+// Defaults for spam protection, overridable through the "moderation" section
+// of config.json.
+const (
+	defaultListingsPerHour          = 10
+	defaultListingsPerDay           = 30
+	defaultDuplicateTitleSimilarity = 0.85
+	// duplicateImageDistance is the largest Hamming distance between
+	// perceptual hashes of photos counted as the same photo.
+	duplicateImageDistance = 6
+)
+
+// postingLimit caps the listings a user may create within a sliding window.
+type postingLimit struct {
+	window time.Duration
+	max    int
+}
+
+var (
+	// postingLimits are checked on every new listing. A max of 0 disables
+	// a limit.
+	postingLimits = []postingLimit{
+		{time.Hour, defaultListingsPerHour},
+		{24 * time.Hour, defaultListingsPerDay},
+	}
+	duplicateAction          = duplicateMerge
+	duplicateTitleSimilarity = defaultDuplicateTitleSimilarity
+)
+
+// DuplicateListing is an earlier listing by the same seller that a new one
+// appears to repeat.
+type DuplicateListing struct {
+	ListingID    int           `json:"listingId"`
+	ProductName  string        `json:"productName"`
+	Status       ListingStatus `json:"status"`
+	SimilarTitle bool          `json:"similarTitle"`
+	SameImage    bool          `json:"sameImage"`
+}
+
+// initDuplicatesDB stores a perceptual hash with each listing image so new
+// uploads can be compared with a seller's earlier photos. Images stored
+// before the column existed have no hash and are not compared. It also
+// creates listing_posts, the append-only record the posting limits count,
+// so deleting a listing does not give the seller room to post again. The
+// log is seeded from the past day's listings when it is first created.
+func initDuplicatesDB() error {
+	duplicateColumns := `
+	ALTER TABLE listing_images ADD COLUMN IF NOT EXISTS phash BIGINT;
+	CREATE INDEX IF NOT EXISTS listings_user_created_at_idx ON listings(user_id, created_at);`
+	if _, err := db.Exec(duplicateColumns); err != nil {
+		return fmt.Errorf("error adding duplicate detection columns: %v", err)
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('listing_posts') IS NOT NULL").Scan(&exists); err != nil {
+		return fmt.Errorf("error checking listing_posts table: %v", err)
+	}
+	postsTable := `
+	CREATE TABLE IF NOT EXISTS listing_posts (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS listing_posts_user_created_at_idx ON listing_posts(user_id, created_at);`
+	if _, err := db.Exec(postsTable); err != nil {
+		return fmt.Errorf("error creating listing_posts table: %v", err)
+	}
+	if !exists {
+		if _, err := db.Exec(`INSERT INTO listing_posts (user_id, created_at)
+			SELECT user_id, created_at FROM listings WHERE created_at > NOW() - INTERVAL '1 day'`); err != nil {
+			return fmt.Errorf("error seeding listing_posts: %v", err)
+		}
+	}
+	return nil
+}
+
+// postingLimitedError is returned by recordListingPost when a user has reached
+// a posting limit; wait is how long until they may post again.
+type postingLimitedError struct {
+	wait time.Duration
+}
+
+func (e *postingLimitedError) Error() string { return "posting limit reached" }
+
+// recordListingPost checks userID's posting limits and logs a new post
+// within tx, which must also create the listing. The user row is locked so
+// concurrent posts by the same user are counted one after another.
+func recordListingPost(ctx context.Context, tx *sql.Tx, userID int) error {
+	var id int
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&id); err != nil {
+		return err
+	}
+	now := time.Now()
+	var wait time.Duration
+	for _, limit := range postingLimits {
+		if limit.max <= 0 {
+			continue
+		}
+		var count int
+		var oldest sql.NullTime
+		err := tx.QueryRowContext(ctx,
+			"SELECT COUNT(*), MIN(created_at) FROM listing_posts WHERE user_id = $1 AND created_at > $2",
+			userID, now.Add(-limit.window),
+		).Scan(&count, &oldest)
+		if err != nil {
+			return err
+		}
+		if count >= limit.max && oldest.Valid {
+			// Room frees up once the oldest post in the window ages out.
+			if d := oldest.Time.Add(limit.window).Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		return &postingLimitedError{wait: wait}
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO listing_posts (user_id, created_at) VALUES ($1, $2)", userID, now)
+	return err
+}
+
+// writePostingLimited writes the response for a user over a posting limit.
+func writePostingLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "You are posting listings too quickly; try again later", http.StatusTooManyRequests)
+}
+
+// normalizeTitle lowercases a title and keeps only its letters and digits,
+// so that punctuation, spacing and case do not hide a repost.
+func normalizeTitle(title string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// titleSimilarity is the Sørensen–Dice coefficient of the character bigrams
+// of two normalized titles: 1 for identical titles, 0 for titles sharing no
+// bigram.
+func titleSimilarity(a, b string) float64 {
+	a, b = normalizeTitle(a), normalizeTitle(b)
+	if a == b {
+		return 1
+	}
+	bigrams := func(s string) map[string]int {
+		runes := []rune(s)
+		counts := map[string]int{}
+		for i := 0; i+1 < len(runes); i++ {
+			counts[string(runes[i:i+2])]++
+		}
+		return counts
+	}
+	ba, bb := bigrams(a), bigrams(b)
+	total := 0
+	for _, n := range ba {
+		total += n
+	}
+	for _, n := range bb {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	shared := 0
+	for g, n := range ba {
+		if m := bb[g]; m < n {
+			shared += m
+		} else {
+			shared += n
+		}
+	}
+	return 2 * float64(shared) / float64(total)
+}
+
+// findDuplicateListings returns userID's listings still for sale, or not
+// yet published, whose title is similar to title or which have a photo
+// matching one of uploads.
+func findDuplicateListings(ctx context.Context, userID int, title string, uploads []uploadedImage) ([]DuplicateListing, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT id, product_name, status FROM listings WHERE user_id = $1 AND status NOT IN ($2, $3)",
+		userID, StatusSold, StatusArchived,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []DuplicateListing
+	for rows.Next() {
+		var d DuplicateListing
+		if err := rows.Scan(&d.ListingID, &d.ProductName, &d.Status); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.SimilarTitle = titleSimilarity(title, d.ProductName) >= duplicateTitleSimilarity
+		candidates = append(candidates, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(candidates) > 0 && len(uploads) > 0 {
+		ids := make([]int, len(candidates))
+		byID := map[int]*DuplicateListing{}
+		for i := range candidates {
+			ids[i] = candidates[i].ListingID
+			byID[ids[i]] = &candidates[i]
+		}
+		rows, err := db.QueryContext(ctx,
+			"SELECT listing_id, phash FROM listing_images WHERE listing_id = ANY($1) AND phash IS NOT NULL", pq.Array(ids),
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var listingID int
+			var hash int64
+			if err := rows.Scan(&listingID, &hash); err != nil {
+				return nil, err
+			}
+			for _, u := range uploads {
+				if hashDistance(uint64(hash), u.renditions.PHash) <= duplicateImageDistance {
+					byID[listingID].SameImage = true
+				}
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	duplicates := []DuplicateListing{}
+	for _, d := range candidates {
+		if d.SimilarTitle || d.SameImage {
+			duplicates = append(duplicates, d)
+		}
+	}
+	return duplicates, nil
+}
+
+// writeDuplicateConflict writes the response refusing a repost.
+func writeDuplicateConflict(w http.ResponseWriter, duplicates []DuplicateListing) {
+	message := "This listing repeats one you already posted"
+	if duplicateAction == duplicateMerge {
+		message += "; update the existing listing, or resubmit with confirmNotDuplicate=true if this is a different item"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      message,
+		"action":     duplicateAction,
+		"duplicates": duplicates,
+	})
+}
+
+// holdForDuplicateReview holds a listing that repeats earlier ones.
+func holdForDuplicateReview(ctx context.Context, tx *sql.Tx, listingID, sellerID int, duplicates []DuplicateListing) error {
+	ids := make([]string, len(duplicates))
+	for i, d := range duplicates {
+		ids[i] = strconv.Itoa(d.ListingID)
+	}
+	return holdListingForReview(ctx, tx, listingID, sellerID, ReasonSpam, "Possible duplicate of listings "+strings.Join(ids, ", "))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectPostingLimits queues the posting limit checks for user 1 inside the
+// creation transaction, with the given number of posts logged in each
+// window. Missing counts are 0. The new post is logged when no limit is
+// reached.
+func expectPostingLimits(mock sqlmock.Sqlmock, counts ...int) {
+	mock.ExpectQuery("SELECT id FROM users WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	limited := false
+	for i := range postingLimits {
+		count, oldest := 0, interface{}(nil)
+		if i < len(counts) {
+			count = counts[i]
+		}
+		if count > 0 {
+			oldest = time.Now().Add(-postingLimits[i].window / 2)
+		}
+		limited = limited || count >= postingLimits[i].max
+		mock.ExpectQuery("SELECT COUNT\\(\\*\\), MIN\\(created_at\\) FROM listing_posts WHERE user_id = \\$1 AND created_at > \\$2").
+			WithArgs(1, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"count", "min"}).AddRow(count, oldest))
+	}
+	if !limited {
+		mock.ExpectExec("INSERT INTO listing_posts").
+			WithArgs(1, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+}
+
+// expectNewListingChecks queues a duplicate lookup finding no earlier
+// listings, then the start of the creation transaction with posting limits
+// that have not been reached.
+func expectNewListingChecks(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT id, product_name, status FROM listings WHERE user_id = \\$1 AND status NOT IN \\(\\$2, \\$3\\)").
+		WithArgs(1, StatusSold, StatusArchived).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_name", "status"}))
+	mock.ExpectBegin()
+	expectPostingLimits(mock)
+}
+
+func TestTitleSimilarity(t *testing.T) {
+	assert.Equal(t, 1.0, titleSimilarity("iPhone 12 Pro - 128GB!!", "iphone 12 pro 128 gb"))
+	assert.GreaterOrEqual(t, titleSimilarity("IKEA Malm desk, white", "IKEA Malm desk (white)!"), defaultDuplicateTitleSimilarity)
+	assert.GreaterOrEqual(t, titleSimilarity("TI-84 Plus calculator", "TI-84 Plus calculators"), defaultDuplicateTitleSimilarity)
+	assert.Less(t, titleSimilarity("TI-84 Plus calculator", "Desk lamp"), 0.2)
+	assert.Less(t, titleSimilarity("Calculus textbook 8th edition", "Physics textbook 8th edition"), defaultDuplicateTitleSimilarity)
+}
+
+func TestFindDuplicateListings(t *testing.T) {
+	mock := withMockDB(t)
+	photo := perceptualHash(testPattern(300, 300, 2))
+	mock.ExpectQuery("SELECT id, product_name, status FROM listings WHERE user_id = \\$1 AND status NOT IN \\(\\$2, \\$3\\)").
+		WithArgs(1, StatusSold, StatusArchived).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_name", "status"}).
+			AddRow(3, "Mini fridge - great condition", "active").
+			AddRow(4, "Dorm rug", "draft").
+			AddRow(5, "Desk lamp", "expired"))
+	mock.ExpectQuery("SELECT listing_id, phash FROM listing_images WHERE listing_id = ANY\\(\\$1\\) AND phash IS NOT NULL").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"listing_id", "phash"}).
+			AddRow(4, int64(photo)).
+			AddRow(5, int64(perceptualHash(testPattern(300, 300, 7)))))
+
+	upload := uploadedImage{renditions: &ImageRenditions{PHash: perceptualHash(testPattern(900, 900, 2))}}
+	duplicates, err := findDuplicateListings(context.Background(), 1, "MINI FRIDGE, great condition!", []uploadedImage{upload})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []DuplicateListing{
+		{ListingID: 3, ProductName: "Mini fridge - great condition", Status: StatusActive, SimilarTitle: true},
+		{ListingID: 4, ProductName: "Dorm rug", Status: StatusDraft, SameImage: true},
+	}, duplicates)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListingsHandler_CreateDuplicate(t *testing.T) {
+	originalAction := duplicateAction
+	t.Cleanup(func() { duplicateAction = originalAction })
+
+	tests := []struct {
+		name           string
+		action         string
+		confirm        bool
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{name: "Block", action: duplicateBlock, confirm: true, expectedStatus: http.StatusConflict},
+		{name: "Merge Prompt", action: duplicateMerge, expectedStatus: http.StatusConflict},
+		{
+			name:    "Merge Confirmed Different Item",
+			action:  duplicateMerge,
+			confirm: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectPostingLimits(mock)
+				expectCategoryLookup(mock, "furniture", 6, "Furniture")
+				mock.ExpectQuery("INSERT INTO listings").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+				expectListingEvent(mock, 42, StatusActive, listingCreated)
+				mock.ExpectCommit()
+				mock.ExpectQuery("FROM listings l JOIN users u ON u.id = l.user_id WHERE l.user_id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(listingColumns))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Flag For Moderation",
+			action: duplicateFlag,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectPostingLimits(mock)
+				expectCategoryLookup(mock, "furniture", 6, "Furniture")
+				mock.ExpectQuery("INSERT INTO listings").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+				mock.ExpectExec("UPDATE listings SET hidden_at").
+					WithArgs(sqlmock.AnyArg(), nil, 42).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("INSERT INTO reports").
+					WithArgs(42, 1, ReasonSpam, "Possible duplicate of listings 3", ReportResolved).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+				expectAudit(mock, nil, auditHeldForReview)
+				// Hidden listings are not streamed.
+				mock.ExpectQuery("SELECT product_name, price_cents, currency, category, category_id, status, hidden_at IS NOT NULL FROM listings").
+					WithArgs(42).
+					WillReturnRows(sqlmock.NewRows(listingSummaryColumns).AddRow("Futon", 5000, "USD", "Furniture", 6, "active", true))
+				mock.ExpectCommit()
+				mock.ExpectQuery("FROM listings l JOIN users u ON u.id = l.user_id WHERE l.user_id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(listingColumns))
+			},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			duplicateAction = tt.action
+			mock.ExpectQuery("SELECT id, product_name, status FROM listings WHERE user_id = \\$1").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "product_name", "status"}).AddRow(3, "Futon!", "active"))
+			if tt.mockSetup != nil {
+				tt.mockSetup(mock)
+			}
+
+			fields := map[string]string{"productName": "futon", "price": "50", "category": "Furniture"}
+			if tt.confirm {
+				fields["confirmNotDuplicate"] = "true"
+			}
+			w := httptest.NewRecorder()
+
+			listingsHandler(w, multipartListingRequest(t, http.MethodPost, "/listings", fields, 0))
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.expectedStatus == http.StatusConflict {
+				var resp struct {
+					Action     string             `json:"action"`
+					Duplicates []DuplicateListing `json:"duplicates"`
+				}
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, tt.action, resp.Action)
+				assert.Len(t, resp.Duplicates, 1)
+			}
+			if tt.action == duplicateFlag {
+				assert.Contains(t, w.Body.String(), `"pendingReview":true`)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestListingsHandler_CreateOverPostingLimit(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT id, product_name, status FROM listings WHERE user_id = \\$1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_name", "status"}))
+	mock.ExpectBegin()
+	expectPostingLimits(mock, postingLimits[0].max)
+	mock.ExpectRollback()
+
+	w := httptest.NewRecorder()
+	listingsHandler(w, multipartListingRequest(t, http.MethodPost, "/listings", map[string]string{
+		"productName": "Futon",
+		"price":       "50",
+		"category":    "Furniture",
+	}, 0))
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	// The oldest listing in the hour window was created half an hour ago.
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.InDelta(t, 30*60, retryAfter, 5)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventCommitLag is the longest a transaction is expected to stay open after
+// publishing an event. Event ids are taken when the row is inserted, not when
+// the transaction commits, so an event can become visible after others with
+// higher ids; cursors look this far behind their position for such events.
+const eventCommitLag = time.Minute
+
+// eventCursor is how far a client has read an event table, in commit order.
+// It covers every event up to after, except the ones created less than
+// eventCommitLag before event after that are not in seen: those may still
+// commit and are replayed or delivered live when they do.
+type eventCursor struct {
+	after int64
+	// afterAt is when event after was created; zero when that is unknown,
+	// in which case nothing below after is looked for.
+	afterAt time.Time
+	seen    map[int64]time.Time
+}
+
+// parseEventCursor parses a token written by eventCursor.String: the cursor
+// position, optionally followed by a colon and the comma-separated ids seen
+// behind it. The cursor must be anchored before use.
+func parseEventCursor(token string) (*eventCursor, error) {
+	afterText, seenText, hasSeen := strings.Cut(token, ":")
+	after, err := strconv.ParseInt(afterText, 10, 64)
+	if err != nil || after < 0 || (hasSeen && seenText == "") {
+		return nil, fmt.Errorf("invalid event cursor %q", token)
+	}
+	c := &eventCursor{after: after, seen: map[int64]time.Time{}}
+	if hasSeen {
+		for _, idText := range strings.Split(seenText, ",") {
+			id, err := strconv.ParseInt(idText, 10, 64)
+			if err != nil || id <= 0 || id >= after {
+				return nil, fmt.Errorf("invalid event cursor %q", token)
+			}
+			c.seen[id] = time.Time{}
+		}
+	}
+	return c, nil
+}
+
+// String returns the token that resumes from c.
+func (c *eventCursor) String() string {
+	token := strconv.FormatInt(c.after, 10)
+	ids := c.seenIDs()
+	if len(ids) == 0 {
+		return token
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return token + ":" + strings.Join(parts, ",")
+}
+
+// anchor loads when event after was created from table. Seen ids parsed
+// from a token are treated as created at the same time, which keeps them
+// at least as long as they matter.
+func (c *eventCursor) anchor(ctx context.Context, table string) error {
+	if c.after == 0 {
+		return nil
+	}
+	err := db.QueryRowContext(ctx, "SELECT created_at FROM "+table+" WHERE id = $1", c.after).Scan(&c.afterAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	for id, at := range c.seen {
+		if at.IsZero() {
+			c.seen[id] = c.afterAt
+		}
+	}
+	return nil
+}
+
+// windowStart returns the creation time from which events below after may
+// still be missing, or nil when none are looked for.
+func (c *eventCursor) windowStart() interface{} {
+	if c.afterAt.IsZero() {
+		return nil
+	}
+	return c.afterAt.Add(-eventCommitLag)
+}
+
+// covers reports whether the client already has event id, created at at.
+func (c *eventCursor) covers(id int64, at time.Time) bool {
+	if _, ok := c.seen[id]; ok || id == c.after {
+		return true
+	}
+	return id < c.after && (c.afterAt.IsZero() || at.Before(c.afterAt.Add(-eventCommitLag)))
+}
+
+// add records that the client has event id, created at at.
+func (c *eventCursor) add(id int64, at time.Time) {
+	if id > c.after {
+		if c.after > 0 {
+			c.seen[c.after] = c.afterAt
+		}
+		c.after, c.afterAt = id, at
+	} else {
+		c.seen[id] = at
+	}
+	if c.afterAt.IsZero() {
+		return
+	}
+	cutoff := c.afterAt.Add(-eventCommitLag)
+	for id, at := range c.seen {
+		if at.Before(cutoff) {
+			delete(c.seen, id)
+		}
+	}
+}
+
+// seenIDs returns the ids behind the cursor the client already has.
+func (c *eventCursor) seenIDs() []int64 {
+	ids := make([]int64, 0, len(c.seen))
+	for id := range c.seen {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// latestEventCursor returns a cursor at the newest event of table.
+func latestEventCursor(ctx context.Context, table string) (*eventCursor, error) {
+	c := &eventCursor{seen: map[int64]time.Time{}}
+	err := db.QueryRowContext(ctx, "SELECT id, created_at FROM "+table+" ORDER BY id DESC LIMIT 1").Scan(&c.after, &c.afterAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return c, nil
+}
+
+// oldestEventID returns the id of the oldest event still in table, or nil
+// if it is empty.
+func oldestEventID(ctx context.Context, table string) (*int64, error) {
+	var oldest *int64
+	err := db.QueryRowContext(ctx, "SELECT MIN(id) FROM "+table).Scan(&oldest)
+	return oldest, err
+}
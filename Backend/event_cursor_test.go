@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEventCursor(t *testing.T) {
+	c, err := parseEventCursor("12:7,9")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), c.after)
+	assert.ElementsMatch(t, []int64{7, 9}, c.seenIDs())
+	assert.Equal(t, "12:7,9", c.String())
+
+	c, err = parseEventCursor("12")
+	assert.NoError(t, err)
+	assert.Equal(t, "12", c.String())
+
+	for _, token := range []string{"", "abc", "-1", "12:", "12:x", "12:12", "12:15"} {
+		_, err := parseEventCursor(token)
+		assert.Error(t, err, token)
+	}
+}
+
+func TestEventCursor_CoversOutOfOrderCommits(t *testing.T) {
+	now := time.Now()
+	c := &eventCursor{after: 10, afterAt: now, seen: map[int64]time.Time{}}
+
+	// Events older than the commit lag are covered; recent ones below the
+	// cursor may still be committing and are not.
+	assert.True(t, c.covers(10, now))
+	assert.True(t, c.covers(5, now.Add(-2*eventCommitLag)))
+	assert.False(t, c.covers(9, now))
+	assert.False(t, c.covers(11, now))
+
+	c.add(11, now)
+	c.add(9, now)
+	assert.True(t, c.covers(9, now))
+	assert.True(t, c.covers(10, now))
+	assert.Equal(t, "11:9,10", c.String())
+
+	// Seen ids drop out once the cursor has moved past the commit lag.
+	c.add(12, now.Add(2*eventCommitLag))
+	assert.Equal(t, "12", c.String())
+	assert.True(t, c.covers(9, now))
+}
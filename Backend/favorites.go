@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// FavoriteRequest identifies the listing to favorite.
+type FavoriteRequest struct {
+	ListingID int `json:"listingId"`
+}
+
+// initFavoritesDB creates the table of listings users have favorited.
+func initFavoritesDB() error {
+	favoritesTable := `
+	CREATE TABLE IF NOT EXISTS favorites (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		listing_id INTEGER NOT NULL REFERENCES listings(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, listing_id)
+	);
+	CREATE INDEX IF NOT EXISTS favorites_listing_id_idx ON favorites(listing_id);`
+	if _, err := db.Exec(favoritesTable); err != nil {
+		return fmt.Errorf("error creating favorites table: %v", err)
+	}
+	return nil
+}
+
+// attachFavorites fills in FavoriteCount and IsFavorited for a page of
+// listings using one query over all of their ids. viewerID is the user the
+// response is for; 0 means nobody is signed in.
+func attachFavorites(ctx context.Context, exec sqlExecutor, listings []Listing, viewerID int) error {
+	if len(listings) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(listings))
+	index := make(map[int]int, len(listings))
+	for i, l := range listings {
+		ids[i] = int64(l.ID)
+		index[l.ID] = i
+	}
+
+	rows, err := exec.QueryContext(ctx,
+		"SELECT listing_id, COUNT(*), BOOL_OR(user_id = $2) FROM favorites WHERE listing_id = ANY($1) GROUP BY listing_id",
+		pq.Array(ids), viewerID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var listingID, count int
+		var favorited bool
+		if err := rows.Scan(&listingID, &count, &favorited); err != nil {
+			return err
+		}
+		if i, ok := index[listingID]; ok {
+			listings[i].FavoriteCount = count
+			listings[i].IsFavorited = favorited
+		}
+	}
+	return rows.Err()
+}
+
+// favoritesHandler routes GET (list the user's favorites, most recent first),
+// POST (favorite a listing) and DELETE (unfavorite a listing) requests. Adding
+// and removing are idempotent.
+func favoritesHandler(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listFavorites(w, r, currentUserID)
+	case http.MethodPost:
+		addFavorite(w, r, currentUserID)
+	case http.MethodDelete:
+		removeFavorite(w, r, currentUserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listFavorites writes the listings userID has favorited. Like the feed, it
+// leaves out hidden listings and those of blocked or muted sellers.
+func listFavorites(w http.ResponseWriter, r *http.Request, userID int) {
+	where := &whereBuilder{}
+	where.add("f.user_id = $%d", userID)
+	addViewerFilters(where, userID)
+	listings, err := queryListings(r.Context(), db, imageSizeThumbnail,
+		"JOIN favorites f ON f.listing_id = l.id "+where.clause()+" ORDER BY f.created_at DESC", where.args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := attachFavorites(r.Context(), db, listings, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if listings == nil {
+		listings = []Listing{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listings)
+}
+
+// addFavorite favorites a listing for userID. Favoriting a listing twice is
+// not an error. Sellers cannot favorite their own listings, and drafts,
+// listings hidden by moderation and listings of users who have blocked, or
+// been blocked by, userID cannot be favorited.
+func addFavorite(w http.ResponseWriter, r *http.Request, userID int) {
+	var req FavoriteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var ownerID int
+	var status ListingStatus
+	var hidden bool
+	err := db.QueryRowContext(r.Context(),
+		"SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = $1", req.ListingID,
+	).Scan(&ownerID, &status, &hidden)
+	if err == sql.ErrNoRows || (err == nil && (status == StatusDraft || hidden)) {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ownerID == userID {
+		http.Error(w, "You cannot favorite your own listing", http.StatusBadRequest)
+		return
+	}
+	if blocked, err := isBlocked(r.Context(), db, userID, ownerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if blocked {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = db.ExecContext(r.Context(),
+		"INSERT INTO favorites(user_id, listing_id) VALUES($1, $2) ON CONFLICT DO NOTHING",
+		userID, req.ListingID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeFavoriteState(w, r, req.ListingID, true)
+}
+
+// removeFavorite unfavorites a listing for userID. Removing a favorite that
+// does not exist is not an error.
+func removeFavorite(w http.ResponseWriter, r *http.Request, userID int) {
+	listingID, err := strconv.Atoi(r.URL.Query().Get("listingId"))
+	if err != nil {
+		http.Error(w, "Invalid listingId", http.StatusBadRequest)
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), "DELETE FROM favorites WHERE user_id = $1 AND listing_id = $2", userID, listingID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeFavoriteState(w, r, listingID, false)
+}
+
+// writeFavoriteState responds with the listing's favorite flag and count
+// after a change.
+func writeFavoriteState(w http.ResponseWriter, r *http.Request, listingID int, favorited bool) {
+	var count int
+	if err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM favorites WHERE listing_id = $1", listingID).Scan(&count); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"listingId":     listingID,
+		"isFavorited":   favorited,
+		"favoriteCount": count,
+	})
+}
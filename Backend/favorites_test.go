@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectFavorites queues the favorites query for viewerID. Each favorite is
+// a listing id, a count and whether the viewer favorited it.
+func expectFavorites(mock sqlmock.Sqlmock, viewerID int, favorites ...[]driver.Value) {
+	rows := sqlmock.NewRows([]string{"listing_id", "count", "bool_or"})
+	for _, f := range favorites {
+		rows.AddRow(f...)
+	}
+	mock.ExpectQuery("SELECT listing_id, COUNT\\(\\*\\), BOOL_OR\\(user_id = \\$2\\) FROM favorites WHERE listing_id = ANY\\(\\$1\\)").
+		WithArgs(sqlmock.AnyArg(), viewerID).
+		WillReturnRows(rows)
+}
+
+func TestListingsHandler_IncludesFavorites(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	rows := sqlmock.NewRows(listingColumns)
+	for i := 1; i <= 2; i++ {
+		rows.AddRow(i, 2, "User2", nil, 0, "Product", "Desc", 1000, "USD", nil, false, false, "Books", 4, []byte("{}"), "active", now, now, now.Add(listingExpiry), nil)
+	}
+	mock.ExpectQuery("FROM listings l JOIN users u ON u.id = l.user_id WHERE l.user_id <> \\$1").
+		WithArgs(1, StatusActive, 1).
+		WillReturnRows(rows)
+	mock.ExpectQuery("FROM listing_images WHERE listing_id = ANY\\(\\$1\\)").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "listing_id", "data", "content_type"}))
+	expectFavorites(mock, 1, []driver.Value{2, 5, true})
+
+	req := httptest.NewRequest(http.MethodGet, "/listings", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var listings []Listing
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listings))
+	assert.False(t, listings[0].IsFavorited)
+	assert.Equal(t, 0, listings[0].FavoriteCount)
+	assert.True(t, listings[1].IsFavorited)
+	assert.Equal(t, 5, listings[1].FavoriteCount)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestFavoritesHandler_Add(t *testing.T) {
+	tests := []struct {
+		name           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name: "Added",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(2, "active", false))
+				expectBlockCheck(mock, 1, 2, false)
+				mock.ExpectExec("INSERT INTO favorites\\(user_id, listing_id\\) VALUES\\(\\$1, \\$2\\) ON CONFLICT DO NOTHING").
+					WithArgs(1, 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM favorites WHERE listing_id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"favoriteCount":4,"isFavorited":true,"listingId":3}`,
+		},
+		{
+			name: "Already Favorited",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(2, "active", false))
+				expectBlockCheck(mock, 1, 2, false)
+				mock.ExpectExec("INSERT INTO favorites").
+					WithArgs(1, 3).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM favorites WHERE listing_id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"favoriteCount":4,"isFavorited":true,"listingId":3}`,
+		},
+		{
+			name: "Own Listing",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(1, "active", false))
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Blocked By Seller",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(2, "active", false))
+				expectBlockCheck(mock, 1, 2, true)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Draft",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(2, "draft", false))
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Hidden By Moderation",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "hidden"}).AddRow(2, "active", true))
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Missing Listing",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/favorites", bytes.NewBufferString(`{"listingId":3}`))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			favoritesHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestFavoritesHandler_Remove(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectExec("DELETE FROM favorites WHERE user_id = \\$1 AND listing_id = \\$2").
+		WithArgs(1, 3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM favorites WHERE listing_id = \\$1").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	req := httptest.NewRequest(http.MethodDelete, "/favorites?listingId=3", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	favoritesHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"favoriteCount":0,"isFavorited":false,"listingId":3}`, w.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestFavoritesHandler_List(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("FROM listings l JOIN users u ON u.id = l.user_id JOIN favorites f ON f.listing_id = l.id WHERE f.user_id = \\$1 AND l.hidden_at IS NULL "+
+		"AND NOT EXISTS\\(SELECT 1 FROM user_blocks b WHERE \\(b.blocker_id = \\$2 AND b.blocked_id = l.user_id\\).* ORDER BY f.created_at DESC").
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows(listingColumns))
+
+	req := httptest.NewRequest(http.MethodGet, "/favorites", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	favoritesHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]\n", w.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
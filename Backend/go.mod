@@ -3,17 +3,22 @@ module UFMarketPlace
 go 1.23.6
 
 require (
+	github.com/disintegration/imaging v1.6.2
 	github.com/lib/pq v1.10.9
 	github.com/rs/cors v1.11.1
 	golang.org/x/crypto v0.33.0
 )
 
+require golang.org/x/image v0.25.0
+
+require github.com/gorilla/websocket v1.5.3
+
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
+	github.com/stretchr/testify v1.10.0
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
-	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df // indirect
+	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
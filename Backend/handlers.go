@@ -37,6 +37,34 @@ type VerifyCodeRequest struct {
     Code      string `json:"code"`
 }
 
+// requireUserID parses the userId header. It writes a 400 response and
+// returns false when the header is missing or malformed.
+func requireUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userIDStr := r.Header.Get("userId")
+	if userIDStr == "" {
+		http.Error(w, "Missing userId header", http.StatusBadRequest)
+		return 0, false
+	}
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		http.Error(w, "Invalid userId header", http.StatusBadRequest)
+		return 0, false
+	}
+	return userID, true
+}
+
+// sessionUserID returns the user of the valid session on r, or 0 for an
+// anonymous request. Routes open to anonymous viewers use it in place of
+// requireUserID, since ValidateSessionMiddleware does not guard them.
+func sessionUserID(r *http.Request) int {
+	userID := r.Header.Get("userId")
+	if valid, err := ValidateSession(r.Header.Get("X-Session-ID"), userID); err != nil || !valid {
+		return 0
+	}
+	id, _ := strconv.Atoi(userID)
+	return id
+}
+
 func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	userIdStr := r.Header.Get("userId")
 	if userIdStr == "" {
@@ -157,6 +185,16 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	suspended, err := IsUserSuspended(userID)
+	if err != nil {
+		http.Error(w, "Error getting user details", http.StatusInternalServerError)
+		return
+	}
+	if suspended {
+		http.Error(w, "Account is suspended", http.StatusForbidden)
+		return
+	}
+
 
 	sessionID, err := CreateSession(userID)
 	if err != nil {
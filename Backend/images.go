@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"math/bits"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp" // WebP decoder
+)
+
+// Upload limits for listing images.
+const (
+	maxImageBytes       = 5 << 20
+	maxImageDimension   = 8000
+	maxImagePixels      = 40_000_000
+	maxImagesPerListing = 10
+)
+
+// allowedImageFormats maps the decoder names of accepted formats to the
+// content type a browser should send for them.
+var allowedImageFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+var (
+	errImageTooLarge      = fmt.Errorf("image exceeds %d MB", maxImageBytes>>20)
+	errImageUnsupported   = errors.New("unsupported image format")
+	errImageDimensions    = fmt.Errorf("image dimensions exceed %dx%d", maxImageDimension, maxImageDimension)
+	errImageTooManyPixels = fmt.Errorf("image exceeds %d megapixels", maxImagePixels/1_000_000)
+)
+
+// Rendition sizes, expressed as the longest edge in pixels.
+const (
+	thumbnailMaxEdge = 320
+	mediumMaxEdge    = 1024
+	fullMaxEdge      = 2048
+)
+
+// Image sizes accepted by imageHandler and stored per listing image.
+const (
+	imageSizeThumbnail = "thumbnail"
+	imageSizeMedium    = "medium"
+	imageSizeFull      = "full"
+)
+
+// ImageRenditions holds the re-encoded versions of a single uploaded image
+// and the perceptual hash of its pixels.
+type ImageRenditions struct {
+	Thumbnail   []byte
+	Medium      []byte
+	Full        []byte
+	ContentType string
+	PHash       uint64
+}
+
+// ImageUploadResult reports what happened to a single uploaded file.
+type ImageUploadResult struct {
+	FileName string `json:"fileName"`
+	Status   string `json:"status"` // "stored" or "rejected"
+	ImageID  int    `json:"imageId,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// uploadedImage is a validated, processed upload waiting to be stored.
+// result indexes the matching entry in the upload results.
+type uploadedImage struct {
+	renditions *ImageRenditions
+	result     int
+}
+
+// validateImage checks that data is an allowed image format within the
+// dimension limits and returns its content type. Only the header is decoded
+// here, so decompression bombs are rejected before any pixels are allocated;
+// processImage performs the full decode.
+func validateImage(data []byte) (string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", errImageUnsupported
+	}
+	contentType, ok := allowedImageFormats[format]
+	if !ok || http.DetectContentType(data) != contentType {
+		return "", errImageUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxImageDimension || cfg.Height > maxImageDimension {
+		return "", errImageDimensions
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return "", errImageTooManyPixels
+	}
+	return contentType, nil
+}
+
+// processUploadedImages reads, validates and processes each uploaded file.
+// It returns the images ready to store along with one result per file;
+// rejected files are already marked in the results.
+func processUploadedImages(files []*multipart.FileHeader) ([]uploadedImage, []ImageUploadResult) {
+	var uploads []uploadedImage
+	results := make([]ImageUploadResult, len(files))
+	for i, fileHeader := range files {
+		results[i].FileName = fileHeader.Filename
+
+		imageData, _, err := readImageData(fileHeader)
+		if err != nil {
+			results[i].Status, results[i].Error = "rejected", err.Error()
+			continue
+		}
+
+		renditions, err := processImage(imageData)
+		if err != nil {
+			results[i].Status, results[i].Error = "rejected", err.Error()
+			continue
+		}
+		uploads = append(uploads, uploadedImage{renditions: renditions, result: i})
+	}
+	return uploads, results
+}
+
+// storeUploadedImages inserts processed uploads for a listing, numbering their
+// positions from firstPosition, and marks each one stored in results. It
+// stops at the first failed insert, since the surrounding transaction is
+// aborted at that point anyway.
+func storeUploadedImages(ctx context.Context, exec sqlExecutor, listingID, firstPosition int, uploads []uploadedImage, results []ImageUploadResult) error {
+	for i, u := range uploads {
+		imageID, err := insertListingImage(ctx, exec, listingID, firstPosition+i, u.renditions)
+		if err != nil {
+			return fmt.Errorf("error saving image record: %w", err)
+		}
+		results[u.result].Status, results[u.result].ImageID = "stored", imageID
+	}
+	return nil
+}
+
+// processImage decodes an uploaded image, applies its EXIF orientation and
+// re-encodes it at thumbnail, medium and full size. Re-encoding writes only
+// pixel data, so EXIF metadata such as GPS coordinates is dropped.
+func processImage(data []byte) (*ImageRenditions, error) {
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+
+	// PNG and GIF sources may carry transparency, so keep them lossless.
+	// Everything else, including WebP, is re-encoded as JPEG.
+	outFormat, contentType := imaging.JPEG, "image/jpeg"
+	if format == "png" || format == "gif" {
+		outFormat, contentType = imaging.PNG, "image/png"
+	}
+
+	renditions := &ImageRenditions{ContentType: contentType, PHash: perceptualHash(img)}
+	for _, r := range []struct {
+		maxEdge int
+		dst     *[]byte
+	}{
+		{thumbnailMaxEdge, &renditions.Thumbnail},
+		{mediumMaxEdge, &renditions.Medium},
+		{fullMaxEdge, &renditions.Full},
+	} {
+		resized := imaging.Fit(img, r.maxEdge, r.maxEdge, imaging.Lanczos)
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, resized, outFormat, imaging.JPEGQuality(85)); err != nil {
+			return nil, fmt.Errorf("error encoding image: %w", err)
+		}
+		*r.dst = buf.Bytes()
+	}
+	return renditions, nil
+}
+
+// perceptualHash computes a 64-bit DCT hash of img. Resized, re-encoded or
+// slightly edited copies of an image hash to values a small Hamming distance
+// apart.
+func perceptualHash(img image.Image) uint64 {
+	const size, hashSize = 32, 8
+	small := imaging.Grayscale(imaging.Resize(img, size, size, imaging.Lanczos))
+
+	// Keep the lowest frequencies of the 2D DCT-II of the pixels.
+	var cosines [hashSize][size]float64
+	for u := 0; u < hashSize; u++ {
+		for x := 0; x < size; x++ {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * size))
+		}
+	}
+	coefficients := make([]float64, 0, hashSize*hashSize)
+	for v := 0; v < hashSize; v++ {
+		for u := 0; u < hashSize; u++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += float64(small.Pix[y*small.Stride+x*4]) * cosines[u][x] * cosines[v][y]
+				}
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+
+	sorted := append([]float64(nil), coefficients...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	var hash uint64
+	for i, c := range coefficients {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// hashDistance is the number of bits in which two perceptual hashes differ.
+func hashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// insertListingImage stores all renditions of an image for the given listing
+// at the given display position and returns the new image id.
+func insertListingImage(ctx context.Context, exec sqlExecutor, listingID, position int, r *ImageRenditions) (int, error) {
+	var imageID int
+	err := exec.QueryRowContext(ctx,
+		"INSERT INTO listing_images(listing_id, image_data, medium_data, thumbnail_data, content_type, position, phash) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		listingID, r.Full, r.Medium, r.Thumbnail, r.ContentType, position, int64(r.PHash),
+	).Scan(&imageID)
+	return imageID, err
+}
+
+// legacyImageBatch is the number of legacy images reprocessed per query.
+const legacyImageBatch = 50
+
+// reprocessLegacyImages runs processImage over images stored before
+// renditions existed. Those rows still hold the original upload, EXIF
+// metadata included; afterwards they hold stripped renditions like any new
+// image. Images that cannot be processed are logged and left as they are.
+// It returns the number of images reprocessed.
+func reprocessLegacyImages(ctx context.Context) (int, error) {
+	processed, lastID := 0, 0
+	for {
+		rows, err := db.QueryContext(ctx,
+			"SELECT id, image_data FROM listing_images WHERE thumbnail_data IS NULL AND id > $1 ORDER BY id LIMIT $2",
+			lastID, legacyImageBatch,
+		)
+		if err != nil {
+			return processed, err
+		}
+		type legacyImage struct {
+			id   int
+			data []byte
+		}
+		var batch []legacyImage
+		for rows.Next() {
+			var img legacyImage
+			if err := rows.Scan(&img.id, &img.data); err != nil {
+				rows.Close()
+				return processed, err
+			}
+			batch = append(batch, img)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return processed, err
+		}
+
+		for _, img := range batch {
+			lastID = img.id
+			r, err := processImage(img.data)
+			if err != nil {
+				log.Printf("Skipping legacy image %d: %v", img.id, err)
+				continue
+			}
+			_, err = db.ExecContext(ctx,
+				"UPDATE listing_images SET image_data = $1, medium_data = $2, thumbnail_data = $3, content_type = $4, phash = $5 WHERE id = $6",
+				r.Full, r.Medium, r.Thumbnail, r.ContentType, int64(r.PHash), img.id,
+			)
+			if err != nil {
+				return processed, err
+			}
+			processed++
+		}
+		if len(batch) < legacyImageBatch {
+			return processed, nil
+		}
+	}
+}
+
+// imageColumn returns the listing_images column holding the requested size.
+// Rows stored before renditions existed only have image_data, so the smaller
+// sizes fall back to it.
+func imageColumn(size string) (string, bool) {
+	switch size {
+	case imageSizeThumbnail:
+		return "COALESCE(thumbnail_data, image_data)", true
+	case imageSizeMedium:
+		return "COALESCE(medium_data, image_data)", true
+	case imageSizeFull, "":
+		return "image_data", true
+	}
+	return "", false
+}
+
+// imageURL returns the path at which imageHandler serves an image rendition.
+func imageURL(imageID int, size string) string {
+	return fmt.Sprintf("/image?id=%d&size=%s", imageID, size)
+}
+
+// imageResponse builds the JSON representation of a listing image, embedding
+// data and linking to every rendition.
+func imageResponse(imageID int, data []byte, contentType string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           imageID,
+		"contentType":  contentType,
+		"data":         base64.StdEncoding.EncodeToString(data),
+		"thumbnailUrl": imageURL(imageID, imageSizeThumbnail),
+		"mediumUrl":    imageURL(imageID, imageSizeMedium),
+		"fullUrl":      imageURL(imageID, imageSizeFull),
+	}
+}
+
+// imageHandler serves a single listing image at the requested size
+// (thumbnail, medium or full). Images follow the visibility of their listing
+// in the detail view: images of drafts and of listings hidden by moderation
+// are only served to the owner, and none are served to users the seller has
+// blocked. Image URLs are loaded without custom headers, so the viewer is
+// anonymous unless the request carries a valid session. Blocking does not
+// keep images from signed-out viewers.
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	imageID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid image id", http.StatusBadRequest)
+		return
+	}
+	column, ok := imageColumn(r.URL.Query().Get("size"))
+	if !ok {
+		http.Error(w, "Invalid image size", http.StatusBadRequest)
+		return
+	}
+
+	var data []byte
+	var contentType string
+	err = db.QueryRowContext(r.Context(),
+		"SELECT "+column+", i.content_type FROM listing_images i JOIN listings l ON l.id = i.listing_id "+
+			"WHERE i.id = $1 AND (l.user_id = $2 OR (l.status <> $3 AND l.hidden_at IS NULL AND "+
+			"NOT EXISTS(SELECT 1 FROM user_blocks b WHERE b.blocker_id = l.user_id AND b.blocked_id = $2 AND NOT b.muted)))",
+		imageID, sessionUserID(r), StatusDraft,
+	).Scan(&data, &contentType)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	// Whether an image is served depends on the viewer, so shared caches
+	// must not keep it.
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(data)
+}
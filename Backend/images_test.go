@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/bmp"
+)
+
+// testJPEG encodes a solid w x h JPEG and, when orientation is non-zero,
+// inserts an EXIF APP1 segment carrying that orientation tag.
+func testJPEG(t *testing.T, w, h int, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{200, 30, 30, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+	if orientation == 0 {
+		return buf.Bytes()
+	}
+
+	// TIFF header (big endian), one IFD entry for Orientation (0x0112).
+	var tiff bytes.Buffer
+	tiff.WriteString("MM")
+	binary.Write(&tiff, binary.BigEndian, uint16(42))
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(1))
+	binary.Write(&tiff, binary.BigEndian, uint16(0x0112))
+	binary.Write(&tiff, binary.BigEndian, uint16(3))
+	binary.Write(&tiff, binary.BigEndian, uint32(1))
+	binary.Write(&tiff, binary.BigEndian, orientation)
+	binary.Write(&tiff, binary.BigEndian, uint16(0))
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(buf.Bytes()[:2]) // SOI
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+	out.Write(buf.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestProcessImage_StripsExifAndRotates(t *testing.T) {
+	// Orientation 6 means the camera was rotated 90°, so a 400x200 image
+	// should come out portrait.
+	data := testJPEG(t, 400, 200, 6)
+	assert.True(t, bytes.Contains(data, []byte("Exif")))
+
+	renditions, err := processImage(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", renditions.ContentType)
+
+	for _, out := range [][]byte{renditions.Thumbnail, renditions.Medium, renditions.Full} {
+		assert.False(t, bytes.Contains(out, []byte("Exif")))
+	}
+
+	full, _, err := image.DecodeConfig(bytes.NewReader(renditions.Full))
+	assert.NoError(t, err)
+	assert.Equal(t, 200, full.Width)
+	assert.Equal(t, 400, full.Height)
+}
+
+func TestProcessImage_Resizes(t *testing.T) {
+	renditions, err := processImage(testJPEG(t, 3000, 1500, 0))
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		data    []byte
+		maxEdge int
+	}{
+		{renditions.Thumbnail, thumbnailMaxEdge},
+		{renditions.Medium, mediumMaxEdge},
+		{renditions.Full, fullMaxEdge},
+	} {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(tc.data))
+		assert.NoError(t, err)
+		assert.Equal(t, tc.maxEdge, cfg.Width)
+		assert.Equal(t, tc.maxEdge/2, cfg.Height)
+	}
+}
+
+func TestProcessImage_RejectsNonImage(t *testing.T) {
+	_, err := processImage([]byte("definitely not an image"))
+	assert.Error(t, err)
+}
+
+func TestReprocessLegacyImages(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT id, image_data FROM listing_images WHERE thumbnail_data IS NULL AND id > \\$1 ORDER BY id LIMIT \\$2").
+		WithArgs(0, legacyImageBatch).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "image_data"}).
+			AddRow(3, testJPEG(t, 1200, 800, 6)).
+			AddRow(4, []byte("not an image")))
+	mock.ExpectExec("UPDATE listing_images SET image_data = \\$1, medium_data = \\$2, thumbnail_data = \\$3, content_type = \\$4, phash = \\$5 WHERE id = \\$6").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "image/jpeg", sqlmock.AnyArg(), 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := reprocessLegacyImages(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestImageHandler_ServesRequestedSize(t *testing.T) {
+	mock := withMockDB(t)
+
+	mock.ExpectQuery("SELECT COALESCE\\(thumbnail_data, image_data\\), i.content_type FROM listing_images i JOIN listings l ON l.id = i.listing_id "+
+		"WHERE i.id = \\$1 AND \\(l.user_id = \\$2 OR \\(l.status <> \\$3 AND l.hidden_at IS NULL AND NOT EXISTS").
+		WithArgs(7, 0, StatusDraft).
+		WillReturnRows(sqlmock.NewRows([]string{"data", "content_type"}).AddRow([]byte("thumb"), "image/jpeg"))
+
+	req := httptest.NewRequest(http.MethodGet, "/image?id=7&size=thumbnail", nil)
+	w := httptest.NewRecorder()
+	imageHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.Equal(t, "private, max-age=86400", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "thumb", w.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestImageHandler_HiddenListing(t *testing.T) {
+	mock := withMockDB(t)
+	// Image 7 belongs to a draft or hidden listing, so anonymous viewers
+	// cannot fetch it.
+	mock.ExpectQuery("FROM listing_images i JOIN listings l ON l.id = i.listing_id").
+		WithArgs(7, 0, StatusDraft).
+		WillReturnRows(sqlmock.NewRows([]string{"data", "content_type"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/image?id=7&size=medium", nil)
+	w := httptest.NewRecorder()
+	imageHandler(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestImageHandler_InvalidSize(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/image?id=7&size=huge", nil)
+	w := httptest.NewRecorder()
+	imageHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid image size")
+}
+
+// pngHeader returns just the signature and IHDR chunk of a PNG declaring the
+// given dimensions, which is all image.DecodeConfig reads.
+func pngHeader(w, h uint32) []byte {
+	var ihdr bytes.Buffer
+	ihdr.WriteString("IHDR")
+	binary.Write(&ihdr, binary.BigEndian, w)
+	binary.Write(&ihdr, binary.BigEndian, h)
+	ihdr.Write([]byte{8, 6, 0, 0, 0}) // 8-bit RGBA, no interlace
+
+	var out bytes.Buffer
+	out.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&out, binary.BigEndian, uint32(ihdr.Len()-4))
+	out.Write(ihdr.Bytes())
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(ihdr.Bytes()))
+	return out.Bytes()
+}
+
+func TestValidateImage(t *testing.T) {
+	var bmpBuf bytes.Buffer
+	bmp.Encode(&bmpBuf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		err         error
+	}{
+		{"Valid JPEG", testJPEG(t, 10, 10, 0), "image/jpeg", nil},
+		{"Not An Image", []byte("<html>hello</html>"), "", errImageUnsupported},
+		{"Format Not Allowed", bmpBuf.Bytes(), "", errImageUnsupported},
+		{"Too Wide", pngHeader(maxImageDimension+1, 10), "", errImageDimensions},
+		{"Decompression Bomb", pngHeader(7000, 7000), "", errImageTooManyPixels},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, err := validateImage(tt.data)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.contentType, contentType)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// runPeriodicJob calls job immediately and then every interval until ctx is
+// done. job returns how many items it processed, which is logged when
+// non-zero.
+func runPeriodicJob(ctx context.Context, name string, interval time.Duration, job func(context.Context) (int, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := job(ctx); err != nil {
+			log.Printf("%s job failed: %v", name, err)
+		} else if n > 0 {
+			log.Printf("%s job processed %d items", name, n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// attributeFilterPrefix marks feed query parameters that filter on a listing
+// attribute, e.g. ?category=textbooks&attr.courseCode=COP3530.
+const attributeFilterPrefix = "attr."
+
+// ListingAttributes holds the category-specific attributes of a listing. It
+// is stored as JSONB.
+type ListingAttributes map[string]interface{}
+
+// Value stores the attributes as JSON.
+func (a ListingAttributes) Value() (driver.Value, error) {
+	if a == nil {
+		a = ListingAttributes{}
+	}
+	return json.Marshal(a)
+}
+
+// Scan reads attributes stored as JSON.
+func (a *ListingAttributes) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*a = ListingAttributes{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into ListingAttributes", src)
+	}
+	return json.Unmarshal(data, a)
+}
+
+// initListingAttributesDB adds the attributes column to listings.
+func initListingAttributesDB() error {
+	attributesColumn := `
+	ALTER TABLE listings ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
+	CREATE INDEX IF NOT EXISTS listings_attributes_idx ON listings USING GIN (attributes);`
+	if _, err := db.Exec(attributesColumn); err != nil {
+		return fmt.Errorf("error adding listings attributes column: %v", err)
+	}
+	return nil
+}
+
+// parseAttributes decodes the JSON object sent in a listing's attributes form
+// field. An empty value returns nil.
+func parseAttributes(value string) (ListingAttributes, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var attrs ListingAttributes
+	if err := json.Unmarshal([]byte(value), &attrs); err != nil || attrs == nil {
+		return nil, fmt.Errorf("Invalid attributes: expected a JSON object")
+	}
+	return attrs, nil
+}
+
+// categoryAttributeSchema returns the attributes listings in a category may
+// carry: those of the category and all of its ancestors. A subcategory
+// redefining an inherited attribute overrides it. A nil categoryID has no
+// attributes.
+func categoryAttributeSchema(ctx context.Context, exec sqlExecutor, categoryID *int) (AttributeSchema, error) {
+	if categoryID == nil {
+		return AttributeSchema{}, nil
+	}
+	rows, err := exec.QueryContext(ctx, `
+		WITH RECURSIVE chain(id, parent_id, attribute_schema, depth) AS (
+			SELECT id, parent_id, attribute_schema, 0 FROM categories WHERE id = $1
+			UNION ALL
+			SELECT c.id, c.parent_id, c.attribute_schema, chain.depth + 1 FROM categories c JOIN chain ON c.id = chain.parent_id
+		)
+		SELECT attribute_schema FROM chain ORDER BY depth DESC`,
+		*categoryID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schema := AttributeSchema{}
+	index := map[string]int{}
+	for rows.Next() {
+		var level AttributeSchema
+		if err := rows.Scan(&level); err != nil {
+			return nil, err
+		}
+		for _, def := range level {
+			if i, ok := index[def.Name]; ok {
+				schema[i] = def
+				continue
+			}
+			index[def.Name] = len(schema)
+			schema = append(schema, def)
+		}
+	}
+	return schema, rows.Err()
+}
+
+// find returns the definition of the named attribute.
+func (s AttributeSchema) find(name string) (AttributeDef, bool) {
+	for _, def := range s {
+		if def.Name == name {
+			return def, true
+		}
+	}
+	return AttributeDef{}, false
+}
+
+// label is the name shown in validation errors.
+func (def AttributeDef) label() string {
+	if def.Label != "" {
+		return def.Label
+	}
+	return def.Name
+}
+
+// normalize checks attrs against the schema and returns a cleaned copy:
+// strings are trimmed, integers are stored as whole numbers and empty values
+// are dropped. Unknown attributes and missing required ones are errors.
+func (s AttributeSchema) normalize(attrs ListingAttributes) (ListingAttributes, error) {
+	for name := range attrs {
+		if _, ok := s.find(name); !ok {
+			return nil, fmt.Errorf("Unknown attribute %q for this category", name)
+		}
+	}
+
+	clean := ListingAttributes{}
+	for _, def := range s {
+		value, present := attrs[def.Name]
+		if str, ok := value.(string); ok && strings.TrimSpace(str) == "" {
+			present = false
+		}
+		if !present || value == nil {
+			if def.Required {
+				return nil, fmt.Errorf("%s is required", def.label())
+			}
+			continue
+		}
+
+		v, err := def.coerce(value)
+		if err != nil {
+			return nil, err
+		}
+		clean[def.Name] = v
+	}
+	return clean, nil
+}
+
+// only returns the attributes the schema defines, dropping the rest. It is
+// used when a listing moves to a category that does not know some of its
+// attributes.
+func (s AttributeSchema) only(attrs ListingAttributes) ListingAttributes {
+	kept := ListingAttributes{}
+	for name, value := range attrs {
+		if _, ok := s.find(name); ok {
+			kept[name] = value
+		}
+	}
+	return kept
+}
+
+// coerce checks a decoded JSON value against the attribute's type.
+func (def AttributeDef) coerce(value interface{}) (interface{}, error) {
+	switch def.Type {
+	case AttrString, AttrEnum:
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be text", def.label())
+		}
+		str = strings.TrimSpace(str)
+		if def.Compact {
+			str = compactAttribute(str)
+		}
+		if def.Type == AttrEnum && !contains(def.Options, str) {
+			return nil, fmt.Errorf("%s must be one of %s", def.label(), strings.Join(def.Options, ", "))
+		}
+		if def.Pattern != "" && !regexp.MustCompile(def.Pattern).MatchString(str) {
+			return nil, fmt.Errorf("%s is not in the expected format", def.label())
+		}
+		return str, nil
+	case AttrNumber, AttrInteger:
+		n, ok := value.(float64)
+		if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("%s must be a number", def.label())
+		}
+		if def.Type == AttrInteger {
+			if n != math.Trunc(n) {
+				return nil, fmt.Errorf("%s must be a whole number", def.label())
+			}
+			if n < math.MinInt64 || n >= math.MaxInt64 {
+				return nil, fmt.Errorf("%s is out of range", def.label())
+			}
+			return int64(n), nil
+		}
+		return n, nil
+	case AttrBoolean:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s must be true or false", def.label())
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("%s has an unknown type", def.label())
+}
+
+// compactAttribute removes the spaces from the value of a compact attribute.
+func compactAttribute(value string) string {
+	return strings.Join(strings.Fields(value), "")
+}
+
+// contains reports whether values includes v.
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// addAttributeFilters adds a condition to where for every attr.<name> query
+// parameter. Text and enum attributes match case-insensitively, and compact
+// ones also ignore spaces, including in values stored before the attribute
+// was compact; numbers and booleans match exactly.
+func addAttributeFilters(where *whereBuilder, schema AttributeSchema, query url.Values) error {
+	var keys []string
+	for key := range query {
+		if strings.HasPrefix(key, attributeFilterPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, attributeFilterPrefix)
+		def, ok := schema.find(name)
+		if !ok {
+			return fmt.Errorf("Unknown attribute %q for this category", name)
+		}
+
+		raw := query.Get(key)
+		var value interface{}
+		var err error
+		switch def.Type {
+		case AttrString, AttrEnum:
+			if def.Compact {
+				where.add("lower(replace(l.attributes->>$%d, ' ', '')) = lower($%d)", name, compactAttribute(raw))
+			} else {
+				where.add("lower(l.attributes->>$%d) = lower($%d)", name, strings.TrimSpace(raw))
+			}
+			continue
+		case AttrNumber:
+			var f float64
+			f, err = strconv.ParseFloat(raw, 64)
+			if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				err = errors.New("not a finite number")
+			}
+			value = f
+		case AttrInteger:
+			value, err = strconv.ParseInt(raw, 10, 64)
+		case AttrBoolean:
+			value, err = strconv.ParseBool(raw)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid value for attribute %q", name)
+		}
+		filter, err := json.Marshal(map[string]interface{}{name: value})
+		if err != nil {
+			return err
+		}
+		where.add("l.attributes @> $%d::jsonb", string(filter))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var textbookSchema = AttributeSchema{
+	{Name: "isbn", Label: "ISBN", Type: AttrString, Pattern: `^(97[89])?[0-9]{9}[0-9X]$`},
+	{Name: "courseCode", Label: "Course code", Type: AttrString, Required: true, Compact: true},
+	{Name: "edition", Label: "Edition", Type: AttrInteger},
+	{Name: "condition", Label: "Condition", Type: AttrEnum, Options: []string{"new", "good"}},
+	{Name: "annotated", Label: "Annotated", Type: AttrBoolean},
+}
+
+func TestAttributeSchema_Normalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		attrs    ListingAttributes
+		expected ListingAttributes
+		err      string
+	}{
+		{
+			name:     "Valid",
+			attrs:    ListingAttributes{"isbn": "9780262033848", "courseCode": " COP3530 ", "edition": 3.0, "condition": "good", "annotated": false},
+			expected: ListingAttributes{"isbn": "9780262033848", "courseCode": "COP3530", "edition": int64(3), "condition": "good", "annotated": false},
+		},
+		{
+			name:     "Empty Optional Dropped",
+			attrs:    ListingAttributes{"courseCode": "COP3530", "isbn": ""},
+			expected: ListingAttributes{"courseCode": "COP3530"},
+		},
+		{
+			name:     "Compact Spaces Removed",
+			attrs:    ListingAttributes{"courseCode": "COP 3530"},
+			expected: ListingAttributes{"courseCode": "COP3530"},
+		},
+		{name: "Missing Required", attrs: ListingAttributes{"edition": 2.0}, err: "Course code is required"},
+		{name: "Unknown Attribute", attrs: ListingAttributes{"courseCode": "COP3530", "color": "red"}, err: `Unknown attribute "color"`},
+		{name: "Bad Pattern", attrs: ListingAttributes{"courseCode": "COP3530", "isbn": "12345"}, err: "ISBN is not in the expected format"},
+		{name: "Fractional Integer", attrs: ListingAttributes{"courseCode": "COP3530", "edition": 2.5}, err: "Edition must be a whole number"},
+		{name: "Integer Out Of Range", attrs: ListingAttributes{"courseCode": "COP3530", "edition": 1e19}, err: "Edition is out of range"},
+		{name: "Wrong Type", attrs: ListingAttributes{"courseCode": "COP3530", "edition": "third"}, err: "Edition must be a number"},
+		{name: "Enum Option", attrs: ListingAttributes{"courseCode": "COP3530", "condition": "broken"}, err: "Condition must be one of new, good"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clean, err := textbookSchema.normalize(tt.attrs)
+			if tt.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, clean)
+		})
+	}
+}
+
+func TestCategoryAttributeSchema_InheritsAndOverrides(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("WITH RECURSIVE chain").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"attribute_schema"}).
+			AddRow([]byte(`[{"name":"brand","label":"Brand","type":"string"},{"name":"model","type":"string"}]`)).
+			AddRow([]byte(`[{"name":"brand","label":"Make","type":"enum","options":["Apple","Dell"]},{"name":"ramGb","type":"integer"}]`)))
+
+	id := 5
+	schema, err := categoryAttributeSchema(context.Background(), db, &id)
+
+	assert.NoError(t, err)
+	assert.Len(t, schema, 3)
+	assert.Equal(t, "Make", schema[0].Label)
+	assert.Equal(t, "model", schema[1].Name)
+	assert.Equal(t, "ramGb", schema[2].Name)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListingsHandler_FiltersByAttributes(t *testing.T) {
+	mock := withMockDB(t)
+	expectCategoryLookup(mock, "textbooks", 5, "Textbooks", `[]`,
+		`[{"name":"courseCode","type":"string"},{"name":"edition","type":"integer"}]`)
+	now := time.Now()
+	mock.ExpectQuery("WHERE l.user_id <> \\$1 AND l.status = \\$2 AND l.category_id IN \\(WITH RECURSIVE sub.* "+
+		"AND lower\\(l.attributes->>\\$4\\) = lower\\(\\$5\\) AND l.attributes @> \\$6::jsonb").
+		WithArgs(1, StatusActive, 5, "courseCode", "COP3530", `{"edition":3}`, 1).
+		WillReturnRows(sqlmock.NewRows(listingColumns).
+			AddRow(8, 2, "User2", nil, 0, "CLRS", "Desc", 4000, "USD", "like-new", false, false, "Textbooks", 5, []byte(`{"courseCode":"COP3530","edition":3}`), "active", now, now, now.Add(listingExpiry), nil))
+	mock.ExpectQuery("FROM listing_images WHERE listing_id = ANY\\(\\$1\\)").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "listing_id", "data", "content_type"}))
+	expectFavorites(mock, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/listings?category=Textbooks&attr.courseCode=COP3530&attr.edition=3", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"attributes":{"courseCode":"COP3530","edition":3}`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddAttributeFilters_RejectsNonFiniteNumbers(t *testing.T) {
+	schema := AttributeSchema{{Name: "widthCm", Type: AttrNumber}}
+	for _, raw := range []string{"NaN", "Inf", "-inf", "1e999"} {
+		where := &whereBuilder{}
+		err := addAttributeFilters(where, schema, url.Values{"attr.widthCm": {raw}})
+		assert.EqualError(t, err, `Invalid value for attribute "widthCm"`, raw)
+		assert.Empty(t, where.conditions, raw)
+	}
+
+	where := &whereBuilder{}
+	assert.NoError(t, addAttributeFilters(where, schema, url.Values{"attr.widthCm": {"40.5"}}))
+	assert.Equal(t, []interface{}{`{"widthCm":40.5}`}, where.args)
+}
+
+func TestAddAttributeFilters_CompactIgnoresSpaces(t *testing.T) {
+	schema := AttributeSchema{{Name: "courseCode", Type: AttrString, Compact: true}}
+	where := &whereBuilder{}
+
+	assert.NoError(t, addAttributeFilters(where, schema, url.Values{"attr.courseCode": {"cop 3530"}}))
+	assert.Equal(t, []string{"lower(replace(l.attributes->>$1, ' ', '')) = lower($2)"}, where.conditions)
+	assert.Equal(t, []interface{}{"courseCode", "cop3530"}, where.args)
+}
+
+func TestListingsHandler_UnknownAttributeFilter(t *testing.T) {
+	mock := withMockDB(t)
+	expectCategoryLookup(mock, "books", 4, "Books", `[]`)
+
+	req := httptest.NewRequest(http.MethodGet, "/listings?category=books&attr.courseCode=COP3530", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `Unknown attribute "courseCode"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateListing_InvalidAttributes(t *testing.T) {
+	mock := withMockDB(t)
+	expectNewListingChecks(mock)
+	expectCategoryLookup(mock, "textbooks", 5, "Textbooks", `[{"name":"edition","label":"Edition","type":"integer"}]`)
+	mock.ExpectRollback()
+
+	req := multipartListingRequest(t, http.MethodPost, "/listings", map[string]string{
+		"productName": "CLRS",
+		"price":       "40",
+		"category":    "textbooks",
+		"attributes":  `{"edition":"third"}`,
+	}, 1)
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Edition must be a number")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// publishCheckInterval is how often scheduled drafts are checked for
+// publication.
+const publishCheckInterval = time.Minute
+
+// ScheduleListingRequest sets or clears the publish time of a draft. A nil
+// PublishAt unschedules the draft.
+type ScheduleListingRequest struct {
+	ListingID int        `json:"listingId"`
+	PublishAt *time.Time `json:"publishAt"`
+}
+
+// initListingDraftsDB adds the publish_at column used to schedule drafts.
+func initListingDraftsDB() error {
+	publishColumn := `
+	ALTER TABLE listings ADD COLUMN IF NOT EXISTS publish_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS listings_publish_at_idx ON listings(publish_at) WHERE status = 'draft';`
+	if _, err := db.Exec(publishColumn); err != nil {
+		return fmt.Errorf("error adding listings publish_at column: %v", err)
+	}
+	return nil
+}
+
+// parsePublishAt parses an RFC 3339 publish time, which must be in the future.
+// An empty string means the listing is not scheduled.
+func parsePublishAt(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	publishAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid publishAt: expected RFC 3339 time")
+	}
+	if !publishAt.After(time.Now()) {
+		return nil, fmt.Errorf("Invalid publishAt: must be in the future")
+	}
+	return &publishAt, nil
+}
+
+// publishScheduledListings makes every draft whose publish_at has passed
+// active. It returns the number of listings published.
+func publishScheduledListings(ctx context.Context) (int, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT id FROM listings WHERE status = $1 AND publish_at <= $2",
+		StatusDraft, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var due []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, id := range due {
+		err := withTx(ctx, func(tx *sql.Tx) error {
+			_, err := setListingStatus(ctx, tx, id, StatusActive, nil)
+			return err
+		})
+		if err != nil {
+			log.Printf("Skipping publication of listing %d: %v", id, err)
+			continue
+		}
+		listingPublished(id)
+		published++
+	}
+	return published, nil
+}
+
+// scheduleListingHandler handles PUT requests that set or clear when a draft
+// listing goes live. Only drafts can be scheduled; publish a draft right away
+// by moving it to active through listingStatusHandler.
+func scheduleListingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req ScheduleListingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.PublishAt != nil && !req.PublishAt.After(time.Now()) {
+		http.Error(w, "Invalid publishAt: must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, req.ListingID, currentUserID); err != nil {
+			return err
+		}
+
+		var status ListingStatus
+		if err := tx.QueryRowContext(r.Context(), "SELECT status FROM listings WHERE id = $1", req.ListingID).Scan(&status); err != nil {
+			return err
+		}
+		if status != StatusDraft {
+			return &requestError{status: http.StatusConflict, message: "Only draft listings can be scheduled"}
+		}
+
+		_, err := tx.ExecContext(r.Context(), "UPDATE listings SET publish_at = $1, updated_at = $2 WHERE id = $3", req.PublishAt, time.Now(), req.ListingID)
+		return err
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "Listing schedule updated successfully",
+		"publishAt": req.PublishAt,
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePublishAt(t *testing.T) {
+	publishAt, err := parsePublishAt("")
+	assert.NoError(t, err)
+	assert.Nil(t, publishAt)
+
+	_, err = parsePublishAt("tomorrow")
+	assert.Error(t, err)
+
+	_, err = parsePublishAt(time.Now().Add(-time.Hour).Format(time.RFC3339))
+	assert.Error(t, err)
+
+	publishAt, err = parsePublishAt(time.Now().Add(time.Hour).Format(time.RFC3339))
+	assert.NoError(t, err)
+	assert.NotNil(t, publishAt)
+}
+
+func TestPublishScheduledListings(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT id FROM listings WHERE status = \\$1 AND publish_at <= \\$2").
+		WithArgs(StatusDraft, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("draft"))
+	mock.ExpectExec("UPDATE listings SET status = \\$1, updated_at = \\$2 WHERE id = \\$3").
+		WithArgs(StatusActive, sqlmock.AnyArg(), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE listings SET expires_at = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), 5, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO listing_status_history").
+		WithArgs(5, StatusDraft, StatusActive, nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectRealtimeEvent(mock, eventListingStatus)
+	expectListingEvent(mock, 5, StatusActive, listingCreated)
+	mock.ExpectCommit()
+
+	n, err := publishScheduledListings(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestScheduleListingHandler_ActiveListing(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+	mock.ExpectRollback()
+
+	body := `{"listingId":1,"publishAt":"` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`
+	req := httptest.NewRequest(http.MethodPut, "/listing/schedule", bytes.NewBufferString(body))
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	scheduleListingHandler(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListingDetailHandler_DraftHiddenFromOthers(t *testing.T) {
+	now := time.Now()
+	publishAt := now.Add(time.Hour)
+	for _, tt := range []struct {
+		userID         string
+		expectedStatus int
+	}{
+		{"1", http.StatusNotFound},
+		{"2", http.StatusOK},
+	} {
+		mock := withMockDB(t)
+		viewerID, _ := strconv.Atoi(tt.userID)
+		mock.ExpectQuery("FROM listings l JOIN users u ON u.id = l.user_id WHERE l.id = \\$1").
+			WithArgs(7, viewerID).
+			WillReturnRows(sqlmock.NewRows(listingColumns).
+				AddRow(7, 2, "User2", nil, 0, "Lamp", "Desc", 1500, "USD", nil, true, false, "Furniture", 6, []byte(`{"widthCm":40}`), "draft", now, now, nil, publishAt))
+		mock.ExpectQuery("FROM listing_images WHERE listing_id = ANY\\(\\$1\\)").
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "listing_id", "data", "content_type"}))
+		if tt.expectedStatus == http.StatusOK {
+			expectFavorites(mock, 2)
+			expectPriceHistory(mock, 7)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/listing?listingId=7", nil)
+		req.Header.Set("userId", tt.userID)
+		w := httptest.NewRecorder()
+
+		listingDetailHandler(w, req)
+
+		assert.Equal(t, tt.expectedStatus, w.Code, "user %s", tt.userID)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"UFMarketPlace/utils"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Defaults for listing expiry, overridable through the "listings" section of
+// config.json.
+const (
+	defaultListingExpiryDays   = 30
+	defaultExpiryCheckInterval = time.Hour
+)
+
+// listingExpiry is how long a listing stays active after it is created or
+// renewed.
+var listingExpiry = defaultListingExpiryDays * 24 * time.Hour
+
+// RenewListingRequest identifies the listing to renew.
+type RenewListingRequest struct {
+	ListingID int `json:"listingId"`
+}
+
+// initListingExpiryDB adds expires_at to listings and backfills it for
+// listings created before expiry existed. Drafts are left without one, as
+// createListing leaves them, so they get a full period when published.
+func initListingExpiryDB() error {
+	expiresColumn := `
+	ALTER TABLE listings ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS listings_expires_at_idx ON listings(expires_at) WHERE status = 'active';`
+	if _, err := db.Exec(expiresColumn); err != nil {
+		return fmt.Errorf("error adding listings expires_at column: %v", err)
+	}
+
+	_, err := db.Exec(
+		"UPDATE listings SET expires_at = created_at + $1 * INTERVAL '1 second' WHERE expires_at IS NULL AND status <> 'draft'",
+		int64(listingExpiry/time.Second),
+	)
+	if err != nil {
+		return fmt.Errorf("error backfilling listings expires_at: %v", err)
+	}
+	return nil
+}
+
+// expiresInDays rounds the time left until expiresAt up to whole days, so a
+// listing expiring later today reports 1. Past expiry it reports 0.
+func expiresInDays(expiresAt, now time.Time) int {
+	left := expiresAt.Sub(now)
+	if left <= 0 {
+		return 0
+	}
+	return int(math.Ceil(left.Hours() / 24))
+}
+
+// expiringListing is an active listing past its expiry time.
+type expiringListing struct {
+	id          int
+	productName string
+	sellerEmail string
+}
+
+// expireListings moves every active listing past expires_at to expired and
+// emails its seller. Each listing is expired in its own transaction, which
+// locks it and checks it is still due: a listing renewed since it was
+// selected, or already handled by another instance, is skipped. It returns
+// the number of listings expired.
+func expireListings(ctx context.Context) (int, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT l.id, l.product_name, u.email FROM listings l JOIN users u ON u.id = l.user_id "+
+			"WHERE l.status = $1 AND l.expires_at <= $2",
+		StatusActive, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var due []expiringListing
+	for rows.Next() {
+		var l expiringListing
+		if err := rows.Scan(&l.id, &l.productName, &l.sellerEmail); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, l := range due {
+		stillDue := false
+		err := withTx(ctx, func(tx *sql.Tx) error {
+			err := tx.QueryRowContext(ctx,
+				"SELECT status = $2 AND COALESCE(expires_at <= $3, FALSE) FROM listings WHERE id = $1 FOR UPDATE",
+				l.id, StatusActive, time.Now(),
+			).Scan(&stillDue)
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			if err != nil || !stillDue {
+				return err
+			}
+			_, err = setListingStatus(ctx, tx, l.id, StatusExpired, nil)
+			return err
+		})
+		if err != nil {
+			log.Printf("Skipping expiry of listing %d: %v", l.id, err)
+			continue
+		}
+		if !stillDue {
+			continue
+		}
+		expired++
+
+		if err := utils.SendListingExpiredEmail(l.sellerEmail, l.productName, int(listingExpiry.Hours()/24)); err != nil {
+			log.Printf("Error sending expiry email for listing %d: %v", l.id, err)
+		}
+	}
+	return expired, nil
+}
+
+// renewListingHandler handles POST requests from a seller to renew an active
+// or expired listing for another expiry period. Expired listings return to
+// the feed.
+func renewListingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req RenewListingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := time.Now().Add(listingExpiry)
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, req.ListingID, currentUserID); err != nil {
+			return err
+		}
+
+		var status ListingStatus
+		if err := tx.QueryRowContext(r.Context(), "SELECT status FROM listings WHERE id = $1", req.ListingID).Scan(&status); err != nil {
+			return err
+		}
+		switch status {
+		case StatusActive:
+		case StatusExpired:
+			if _, err := setListingStatus(r.Context(), tx, req.ListingID, StatusActive, &currentUserID); err != nil {
+				return err
+			}
+		default:
+			return &requestError{status: http.StatusConflict, message: fmt.Sprintf("Cannot renew a %s listing", status)}
+		}
+
+		_, err := tx.ExecContext(r.Context(), "UPDATE listings SET expires_at = $1 WHERE id = $2", expiresAt, req.ListingID)
+		return err
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Listing renewed successfully",
+		"expiresAt":     expiresAt,
+		"expiresInDays": expiresInDays(expiresAt, time.Now()),
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"UFMarketPlace/utils"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiresInDays(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 30, expiresInDays(now.Add(30*24*time.Hour), now))
+	assert.Equal(t, 1, expiresInDays(now.Add(2*time.Hour), now))
+	assert.Equal(t, 0, expiresInDays(now.Add(-time.Hour), now))
+}
+
+// expectStillDue queues the locked recheck of a listing selected for expiry.
+func expectStillDue(mock sqlmock.Sqlmock, listingID int, due bool) {
+	mock.ExpectQuery("SELECT status = \\$2 AND COALESCE\\(expires_at <= \\$3, FALSE\\) FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(listingID, StatusActive, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"due"}).AddRow(due))
+}
+
+func TestExpireListings_ExpiresAndEmailsSeller(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT l.id, l.product_name, u.email FROM listings l JOIN users u ON u.id = l.user_id WHERE l.status = \\$1 AND l.expires_at <= \\$2").
+		WithArgs(StatusActive, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_name", "email"}).AddRow(3, "Mini Fridge", "seller@ufl.edu"))
+	mock.ExpectBegin()
+	expectStillDue(mock, 3, true)
+	mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+	mock.ExpectExec("UPDATE listings SET status = \\$1, updated_at = \\$2 WHERE id = \\$3").
+		WithArgs(StatusExpired, sqlmock.AnyArg(), 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO listing_status_history").
+		WithArgs(3, StatusActive, StatusExpired, nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectRealtimeEvent(mock, eventListingStatus)
+	mock.ExpectCommit()
+
+	var emailedTo, emailedListing string
+	originalSend := utils.SendListingExpiredEmail
+	utils.SendListingExpiredEmail = func(to, productName string, renewDays int) error {
+		emailedTo, emailedListing = to, productName
+		return nil
+	}
+	defer func() { utils.SendListingExpiredEmail = originalSend }()
+
+	n, err := expireListings(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "seller@ufl.edu", emailedTo)
+	assert.Equal(t, "Mini Fridge", emailedListing)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExpireListings_SkipsListingRenewedSinceSelected(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT l.id, l.product_name, u.email FROM listings l JOIN users u ON u.id = l.user_id").
+		WithArgs(StatusActive, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_name", "email"}).AddRow(3, "Mini Fridge", "seller@ufl.edu"))
+	mock.ExpectBegin()
+	expectStillDue(mock, 3, false)
+	mock.ExpectCommit()
+
+	emailed := false
+	originalSend := utils.SendListingExpiredEmail
+	utils.SendListingExpiredEmail = func(to, productName string, renewDays int) error {
+		emailed = true
+		return nil
+	}
+	defer func() { utils.SendListingExpiredEmail = originalSend }()
+
+	n, err := expireListings(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, emailed)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRenewListingHandler_SoldListing(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("sold"))
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest(http.MethodPost, "/listing/renew", bytes.NewBufferString(`{"listingId":1}`))
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	renewListingHandler(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "Cannot renew a sold listing")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ImageOrderRequest sets the display order of every image of a listing.
+type ImageOrderRequest struct {
+	ListingID int   `json:"listingId"`
+	ImageIDs  []int `json:"imageIds"`
+}
+
+// CoverImageRequest moves a single image to the front of a listing.
+type CoverImageRequest struct {
+	ListingID int `json:"listingId"`
+	ImageID   int `json:"imageId"`
+}
+
+// listingImageIDs returns the ids of a listing's images in display order.
+func listingImageIDs(ctx context.Context, exec sqlExecutor, listingID int) ([]int, error) {
+	rows, err := exec.QueryContext(ctx, "SELECT id FROM listing_images WHERE listing_id = $1 ORDER BY position, id", listingID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// setImageOrder rewrites the positions of a listing's images to match ids.
+func setImageOrder(ctx context.Context, exec sqlExecutor, listingID int, ids []int) error {
+	for position, id := range ids {
+		if _, err := exec.ExecContext(ctx, "UPDATE listing_images SET position = $1 WHERE id = $2 AND listing_id = $3", position, id, listingID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listingImagesHandler handles POST (append uploaded images to a listing) and
+// DELETE (remove a single image) requests.
+func listingImagesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		addListingImages(w, r)
+	case http.MethodDelete:
+		deleteListingImage(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// addListingImages appends the uploaded images after a listing's existing ones.
+func addListingImages(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "Unable to parse form data", http.StatusBadRequest)
+		return
+	}
+	listingID, err := strconv.Atoi(r.FormValue("listingId"))
+	if err != nil {
+		http.Error(w, "Invalid listingId", http.StatusBadRequest)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		http.Error(w, "No images provided", http.StatusBadRequest)
+		return
+	}
+	if len(files) > maxImagesPerListing {
+		http.Error(w, fmt.Sprintf("Too many images: a listing can have at most %d", maxImagesPerListing), http.StatusBadRequest)
+		return
+	}
+
+	// Decode and resize before taking the row lock.
+	uploads, imageResults := processUploadedImages(files)
+	matches := contentRules.screen(uploads)
+	if matches.action() == contentReject {
+		writeRepoError(w, matches.rejection())
+		return
+	}
+	pendingReview := matches.action() == contentReview
+
+	err = withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, listingID, currentUserID); err != nil {
+			return err
+		}
+		if err := appendListingImages(r.Context(), tx, listingID, uploads, imageResults); err != nil {
+			return err
+		}
+		if !pendingReview {
+			return nil
+		}
+		if err := publishListingEvent(r.Context(), tx, listingID, listingDeleted); err != nil {
+			return err
+		}
+		return holdForContentReview(r.Context(), tx, listingID, currentUserID, matches)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"images": imageResults, "pendingReview": pendingReview})
+}
+
+// deleteListingImage removes a single image. The last image of a listing
+// cannot be removed; add its replacement first.
+func deleteListingImage(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.Atoi(r.URL.Query().Get("listingId"))
+	if err != nil {
+		http.Error(w, "Invalid listingId", http.StatusBadRequest)
+		return
+	}
+	imageID, err := strconv.Atoi(r.URL.Query().Get("imageId"))
+	if err != nil {
+		http.Error(w, "Invalid imageId", http.StatusBadRequest)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	err = withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, listingID, currentUserID); err != nil {
+			return err
+		}
+
+		var count int
+		if err := tx.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM listing_images WHERE listing_id = $1", listingID).Scan(&count); err != nil {
+			return err
+		}
+		if count <= 1 {
+			return badRequest("A listing must keep at least one image")
+		}
+
+		result, err := tx.ExecContext(r.Context(), "DELETE FROM listing_images WHERE id = $1 AND listing_id = $2", imageID, listingID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return &requestError{status: http.StatusNotFound, message: "Image not found"}
+		}
+		return nil
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Image deleted successfully"})
+}
+
+// listingImageOrderHandler handles PUT requests that set the display order of
+// a listing's images. imageIds must list every image of the listing exactly once.
+func listingImageOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req ImageOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, req.ListingID, currentUserID); err != nil {
+			return err
+		}
+
+		existing, err := listingImageIDs(r.Context(), tx, req.ListingID)
+		if err != nil {
+			return err
+		}
+		if !sameImageIDs(existing, req.ImageIDs) {
+			return badRequest("imageIds must list every image of the listing exactly once")
+		}
+		return setImageOrder(r.Context(), tx, req.ListingID, req.ImageIDs)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Image order updated successfully"})
+}
+
+// listingCoverImageHandler handles PUT requests that make an image the cover
+// of its listing by moving it to the first position.
+func listingCoverImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req CoverImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, req.ListingID, currentUserID); err != nil {
+			return err
+		}
+
+		existing, err := listingImageIDs(r.Context(), tx, req.ListingID)
+		if err != nil {
+			return err
+		}
+		order := []int{req.ImageID}
+		for _, id := range existing {
+			if id != req.ImageID {
+				order = append(order, id)
+			}
+		}
+		if len(order) != len(existing) {
+			return &requestError{status: http.StatusNotFound, message: "Image not found"}
+		}
+		return setImageOrder(r.Context(), tx, req.ListingID, order)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Cover image updated successfully"})
+}
+
+// sameImageIDs reports whether got is a permutation of want.
+func sameImageIDs(want, got []int) bool {
+	if len(want) != len(got) {
+		return false
+	}
+	seen := make(map[int]bool, len(want))
+	for _, id := range want {
+		seen[id] = true
+	}
+	for _, id := range got {
+		if !seen[id] {
+			return false
+		}
+		delete(seen, id)
+	}
+	return true
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// withMockDB swaps the global db for a sqlmock connection for one test.
+func withMockDB(t *testing.T) sqlmock.Sqlmock {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock DB: %v", err)
+	}
+	originalDB := db
+	db = mockDB
+	// The saved-search matcher runs in the background and would race the
+	// test's expectations, so it is off unless a test captures it.
+	originalPublished := listingPublished
+	listingPublished = func(int) {}
+	t.Cleanup(func() {
+		db = originalDB
+		listingPublished = originalPublished
+		mockDB.Close()
+	})
+	return mock
+}
+
+func TestDeleteListingImage(t *testing.T) {
+	tests := []struct {
+		name           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name: "Successful Deletion",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM listing_images WHERE listing_id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+				mock.ExpectExec("DELETE FROM listing_images WHERE id = \\$1 AND listing_id = \\$2").
+					WithArgs(5, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"message":"Image deleted successfully"}`,
+		},
+		{
+			name: "Last Image",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM listing_images WHERE listing_id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "A listing must keep at least one image",
+		},
+		{
+			name: "Unauthorized User",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   "Unauthorized",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodDelete, "/listing/images?listingId=1&imageId=5", nil)
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			listingImagesHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedBody, strings.TrimSpace(w.Body.String()))
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestListingImageOrderHandler(t *testing.T) {
+	t.Run("Reorders Images", func(t *testing.T) {
+		mock := withMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+		mock.ExpectQuery("SELECT id FROM listing_images WHERE listing_id = \\$1 ORDER BY position, id").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10).AddRow(11))
+		mock.ExpectExec("UPDATE listing_images SET position = \\$1 WHERE id = \\$2 AND listing_id = \\$3").
+			WithArgs(0, 11, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE listing_images SET position = \\$1 WHERE id = \\$2 AND listing_id = \\$3").
+			WithArgs(1, 10, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		body := bytes.NewBufferString(`{"listingId":1,"imageIds":[11,10]}`)
+		req := httptest.NewRequest(http.MethodPut, "/listing/images/order", body)
+		req.Header.Set("userId", "1")
+		w := httptest.NewRecorder()
+
+		listingImageOrderHandler(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Rejects Partial Order", func(t *testing.T) {
+		mock := withMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+		mock.ExpectQuery("SELECT id FROM listing_images WHERE listing_id = \\$1 ORDER BY position, id").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10).AddRow(11))
+		mock.ExpectRollback()
+
+		body := bytes.NewBufferString(`{"listingId":1,"imageIds":[11]}`)
+		req := httptest.NewRequest(http.MethodPut, "/listing/images/order", body)
+		req.Header.Set("userId", "1")
+		w := httptest.NewRecorder()
+
+		listingImageOrderHandler(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestListingCoverImageHandler(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	mock.ExpectQuery("SELECT id FROM listing_images WHERE listing_id = \\$1 ORDER BY position, id").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10).AddRow(11).AddRow(12))
+	for position, id := range []int{12, 10, 11} {
+		mock.ExpectExec("UPDATE listing_images SET position = \\$1 WHERE id = \\$2 AND listing_id = \\$3").
+			WithArgs(position, id, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	body := bytes.NewBufferString(`{"listingId":1,"imageId":12}`)
+	req := httptest.NewRequest(http.MethodPut, "/listing/images/cover", body)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingCoverImageHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
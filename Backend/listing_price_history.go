@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// notificationPriceDrop is sent to users who favorited a listing when its
+// price drops.
+const notificationPriceDrop = "price_drop"
+
+// defaultPriceDropPercent is the smallest price drop, as a percentage of the
+// old price, that notifies users who favorited a listing. It is overridable
+// through "priceDropPercent" in the "listings" section of config.json.
+const defaultPriceDropPercent = 10
+
+// priceDropPercent is the price drop threshold in use.
+var priceDropPercent = defaultPriceDropPercent
+
+// PriceChange is one entry in a listing's price history.
+type PriceChange struct {
+	OldPrice  Money     `json:"oldPrice"`
+	NewPrice  Money     `json:"newPrice"`
+	Currency  string    `json:"currency"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// initListingPriceHistoryDB creates the table recording every change of a
+// listing's price.
+func initListingPriceHistoryDB() error {
+	priceHistoryTable := `
+	CREATE TABLE IF NOT EXISTS listing_price_history (
+		id SERIAL PRIMARY KEY,
+		listing_id INTEGER NOT NULL REFERENCES listings(id) ON DELETE CASCADE,
+		old_price_cents BIGINT NOT NULL,
+		new_price_cents BIGINT NOT NULL,
+		currency TEXT NOT NULL,
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS listing_price_history_listing_id_idx ON listing_price_history(listing_id, changed_at);`
+	if _, err := db.Exec(priceHistoryTable); err != nil {
+		return fmt.Errorf("error creating listing_price_history table: %v", err)
+	}
+	return nil
+}
+
+// isPriceDrop reports whether going from oldPrice to newPrice lowers the
+// price by at least priceDropPercent.
+func isPriceDrop(oldPrice, newPrice Money) bool {
+	return newPrice < oldPrice && (oldPrice-newPrice)*100 >= oldPrice*Money(priceDropPercent)
+}
+
+// trackPriceChange is called before a listing's price is set to newPrice. If
+// the price changes it is added to the listing's history, and if an active
+// listing gets cheaper by at least priceDropPercent everyone who favorited it
+// is notified, except users who have blocked the seller or been blocked by
+// them. productName is the listing's new name, or empty if it is not
+// being renamed.
+func trackPriceChange(ctx context.Context, tx *sql.Tx, listingID int, newPrice Money, currency, productName string) error {
+	var oldPrice Money
+	var oldCurrency, oldName string
+	var status ListingStatus
+	err := tx.QueryRowContext(ctx,
+		"SELECT price_cents, currency, product_name, status FROM listings WHERE id = $1", listingID,
+	).Scan(&oldPrice, &oldCurrency, &oldName, &status)
+	if err != nil {
+		return err
+	}
+	if oldPrice == newPrice {
+		return nil
+	}
+	if currency == "" {
+		currency = oldCurrency
+	}
+	if productName == "" {
+		productName = oldName
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO listing_price_history(listing_id, old_price_cents, new_price_cents, currency, changed_at) VALUES($1, $2, $3, $4, $5)",
+		listingID, oldPrice, newPrice, currency, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	if status != StatusActive || !isPriceDrop(oldPrice, newPrice) {
+		return nil
+	}
+
+	message := fmt.Sprintf("Price drop on \"%s\": now %s %s, was %s", productName, newPrice, currency, oldPrice)
+	if newPrice == 0 {
+		message = fmt.Sprintf("\"%s\" is now free", productName)
+	}
+	rows, err := tx.QueryContext(ctx,
+		"INSERT INTO notifications(user_id, type, message, listing_id, created_at) "+
+			"SELECT f.user_id, $1, $2, $3, $4 FROM favorites f WHERE f.listing_id = $3 AND "+favoriterNotBlocked+" RETURNING id, user_id, created_at",
+		notificationPriceDrop, message, listingID, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	type sent struct {
+		userID       int
+		notification Notification
+	}
+	var notified []sent
+	for rows.Next() {
+		s := sent{notification: Notification{Type: notificationPriceDrop, Message: message, ListingID: &listingID}}
+		if err := rows.Scan(&s.notification.ID, &s.userID, &s.notification.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		notified = append(notified, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, s := range notified {
+		if err := publishEvent(ctx, tx, []int{s.userID}, eventNotification, s.notification); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listingPriceHistory returns the price changes of a listing, oldest first.
+func listingPriceHistory(ctx context.Context, exec sqlExecutor, listingID int) ([]PriceChange, error) {
+	rows, err := exec.QueryContext(ctx,
+		"SELECT old_price_cents, new_price_cents, currency, changed_at FROM listing_price_history WHERE listing_id = $1 ORDER BY changed_at, id",
+		listingID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []PriceChange{}
+	for rows.Next() {
+		var c PriceChange
+		if err := rows.Scan(&c.OldPrice, &c.NewPrice, &c.Currency, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
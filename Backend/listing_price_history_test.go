@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectPriceHistory queues the price history query of a listing. Each
+// change is an old and a new price.
+func expectPriceHistory(mock sqlmock.Sqlmock, listingID int, changes ...[2]Money) {
+	rows := sqlmock.NewRows([]string{"old_price_cents", "new_price_cents", "currency", "changed_at"})
+	for _, c := range changes {
+		rows.AddRow(int64(c[0]), int64(c[1]), "USD", time.Now())
+	}
+	mock.ExpectQuery("SELECT old_price_cents, new_price_cents, currency, changed_at FROM listing_price_history WHERE listing_id = \\$1").
+		WithArgs(listingID).
+		WillReturnRows(rows)
+}
+
+func TestIsPriceDrop(t *testing.T) {
+	assert.True(t, isPriceDrop(10000, 9000))
+	assert.True(t, isPriceDrop(10000, 0))
+	assert.False(t, isPriceDrop(10000, 9001))
+	assert.False(t, isPriceDrop(9000, 10000))
+	assert.False(t, isPriceDrop(10000, 10000))
+}
+
+func TestEditListing_PriceChange(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    string
+		oldPrice  int64
+		newPrice  string
+		notifies  bool
+		unchanged bool
+	}{
+		{name: "Drop Notifies Favoriters", status: "active", oldPrice: 4000, newPrice: "30", notifies: true},
+		{name: "Small Drop", status: "active", oldPrice: 4000, newPrice: "39.50"},
+		{name: "Increase", status: "active", oldPrice: 4000, newPrice: "45"},
+		{name: "Drop On Reserved Listing", status: "reserved", oldPrice: 4000, newPrice: "30"},
+		{name: "Same Price", status: "active", oldPrice: 4000, newPrice: "40", unchanged: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			newPrice, _ := ParseMoney(tt.newPrice)
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+			mock.ExpectQuery("SELECT price_cents, currency, product_name, status FROM listings WHERE id = \\$1").
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"price_cents", "currency", "product_name", "status"}).
+					AddRow(tt.oldPrice, "USD", "Desk Lamp", tt.status))
+			if !tt.unchanged {
+				mock.ExpectExec("INSERT INTO listing_price_history").
+					WithArgs(1, Money(tt.oldPrice), newPrice, "USD", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			if tt.notifies {
+				mock.ExpectQuery("INSERT INTO notifications\\(user_id, type, message, listing_id, created_at\\) SELECT f.user_id, \\$1, \\$2, \\$3, \\$4 FROM favorites f WHERE f.listing_id = \\$3 AND NOT EXISTS\\(SELECT 1 FROM listings fl JOIN user_blocks b").
+					WithArgs(notificationPriceDrop, `Price drop on "Desk Lamp": now 30.00 USD, was 40.00`, 1, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "created_at"}).
+						AddRow(20, 2, time.Now()).
+						AddRow(21, 3, time.Now()))
+				expectRealtimeEvent(mock, eventNotification)
+				expectRealtimeEvent(mock, eventNotification)
+			}
+			mock.ExpectExec("UPDATE listings SET price_cents = \\$1, is_free = \\$2, updated_at = \\$3 WHERE id = \\$4 AND user_id = \\$5").
+				WithArgs(newPrice, false, sqlmock.AnyArg(), 1, 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectListingEvent(mock, 1, ListingStatus(tt.status), listingUpdated)
+			mock.ExpectCommit()
+
+			req := multipartListingRequest(t, http.MethodPut, "/listing/updateListing", map[string]string{
+				"listingId": "1",
+				"price":     tt.newPrice,
+			}, 0)
+			w := httptest.NewRecorder()
+
+			editListingHandler(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestListingDetailHandler_PriceHistory(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	mock.ExpectQuery("FROM listings l JOIN users u ON u.id = l.user_id WHERE l.id = \\$1").
+		WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows(listingColumns).
+			AddRow(7, 2, "User2", nil, 0, "Lamp", "Desc", 3000, "USD", nil, false, false, "Furniture", 6, []byte("{}"), "active", now, now, now.Add(listingExpiry), nil))
+	mock.ExpectQuery("FROM listing_images WHERE listing_id = ANY\\(\\$1\\)").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "listing_id", "data", "content_type"}))
+	expectFavorites(mock, 1)
+	expectPriceHistory(mock, 7, [2]Money{5000, 4000}, [2]Money{4000, 3000})
+
+	req := httptest.NewRequest(http.MethodGet, "/listing?listingId=7", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingDetailHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var l Listing
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &l))
+	if assert.Len(t, l.PriceHistory, 2) {
+		assert.Equal(t, Money(5000), l.PriceHistory[0].OldPrice)
+		assert.Equal(t, Money(3000), l.PriceHistory[1].NewPrice)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
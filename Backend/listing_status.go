@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ListingStatus is a state in the listing lifecycle.
+type ListingStatus string
+
+const (
+	StatusDraft    ListingStatus = "draft"
+	StatusActive   ListingStatus = "active"
+	StatusReserved ListingStatus = "reserved"
+	StatusSold     ListingStatus = "sold"
+	StatusExpired  ListingStatus = "expired"
+	StatusArchived ListingStatus = "archived"
+)
+
+// listingTransitions lists the states each state may move to. Archived is
+// terminal.
+var listingTransitions = map[ListingStatus][]ListingStatus{
+	StatusDraft:    {StatusActive, StatusArchived},
+	StatusActive:   {StatusReserved, StatusSold, StatusExpired, StatusArchived},
+	StatusReserved: {StatusActive, StatusSold, StatusArchived},
+	StatusSold:     {StatusArchived},
+	StatusExpired:  {StatusActive, StatusArchived},
+	StatusArchived: {},
+}
+
+// systemListingStatuses are only reached through their own flows, never set
+// directly by a seller: a listing is reserved when an offer is accepted or a
+// sale is recorded (see markSold), sold when the buyer confirms the sale and
+// expired by the expiry job.
+var systemListingStatuses = map[ListingStatus]bool{
+	StatusReserved: true,
+	StatusSold:     true,
+	StatusExpired:  true,
+}
+
+// publicListingStatuses are the states a buyer may filter the feed by.
+var publicListingStatuses = map[ListingStatus]bool{
+	StatusActive:   true,
+	StatusReserved: true,
+	StatusSold:     true,
+}
+
+// valid reports whether s is a known listing state.
+func (s ListingStatus) valid() bool {
+	_, ok := listingTransitions[s]
+	return ok
+}
+
+// canTransitionTo reports whether the state machine allows moving from s to next.
+func (s ListingStatus) canTransitionTo(next ListingStatus) bool {
+	for _, allowed := range listingTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ListingStatusChange is one recorded transition of a listing.
+type ListingStatusChange struct {
+	FromStatus ListingStatus `json:"fromStatus"`
+	ToStatus   ListingStatus `json:"toStatus"`
+	ChangedBy  *int          `json:"changedBy"`
+	ChangedAt  time.Time     `json:"changedAt"`
+}
+
+// StatusChangeRequest asks for a listing to move to a new state.
+type StatusChangeRequest struct {
+	ListingID int           `json:"listingId"`
+	Status    ListingStatus `json:"status"`
+}
+
+// initListingStatusDB adds the status column to listings and creates the
+// table recording every transition.
+func initListingStatusDB() error {
+	statusColumn := `
+	ALTER TABLE listings
+		ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active'
+		CHECK (status IN ('draft', 'active', 'reserved', 'sold', 'expired', 'archived'));
+	CREATE INDEX IF NOT EXISTS listings_status_idx ON listings(status);`
+	if _, err := db.Exec(statusColumn); err != nil {
+		return fmt.Errorf("error adding listings status column: %v", err)
+	}
+
+	historyTable := `
+	CREATE TABLE IF NOT EXISTS listing_status_history (
+		id SERIAL PRIMARY KEY,
+		listing_id INTEGER NOT NULL REFERENCES listings(id) ON DELETE CASCADE,
+		from_status TEXT NOT NULL,
+		to_status TEXT NOT NULL,
+		changed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+	if _, err := db.Exec(historyTable); err != nil {
+		return fmt.Errorf("error creating listing_status_history table: %v", err)
+	}
+	return nil
+}
+
+// setListingStatus moves a listing to a new state if the state machine allows
+// it and records the transition. changedBy is nil for system-initiated
+// changes. It returns the previous state.
+func setListingStatus(ctx context.Context, tx *sql.Tx, listingID int, to ListingStatus, changedBy *int) (ListingStatus, error) {
+	var from ListingStatus
+	err := tx.QueryRowContext(ctx, "SELECT status FROM listings WHERE id = $1 FOR UPDATE", listingID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return "", errListingNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !from.canTransitionTo(to) {
+		return from, &requestError{
+			status:  http.StatusConflict,
+			message: fmt.Sprintf("Cannot change listing status from %s to %s", from, to),
+		}
+	}
+
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, "UPDATE listings SET status = $1, updated_at = $2 WHERE id = $3", to, now, listingID); err != nil {
+		return from, err
+	}
+	// A listing returning to the feed gets a fresh expiry period if its old
+	// one has already run out, so the expiry job does not immediately take it
+	// down again.
+	if to == StatusActive {
+		_, err := tx.ExecContext(ctx,
+			"UPDATE listings SET expires_at = $1 WHERE id = $2 AND (expires_at IS NULL OR expires_at <= $3)",
+			now.Add(listingExpiry), listingID, now,
+		)
+		if err != nil {
+			return from, err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO listing_status_history(listing_id, from_status, to_status, changed_by, changed_at) VALUES($1, $2, $3, $4, $5)",
+		listingID, from, to, changedBy, now,
+	)
+	if err != nil {
+		return from, err
+	}
+	err = publishEventTo(ctx, tx, listingWatchers, []interface{}{listingID}, eventListingStatus, map[string]interface{}{
+		"listingId":  listingID,
+		"fromStatus": from,
+		"status":     to,
+	})
+	if err != nil || !publicListingStatuses[to] {
+		return from, err
+	}
+	// Publishing a draft puts a new listing in the feed.
+	kind := listingUpdated
+	if from == StatusDraft {
+		kind = listingCreated
+	} else if to == StatusSold {
+		kind = listingSold
+	}
+	return from, publishListingEvent(ctx, tx, listingID, kind)
+}
+
+// listingWatchers selects the users told about a listing's status changes:
+// its seller, users who favorited it and buyers who messaged about it.
+const listingWatchers = "SELECT user_id FROM listings WHERE id = $1 " +
+	"UNION SELECT f.user_id FROM favorites f WHERE f.listing_id = $1 AND " + favoriterNotBlocked + " " +
+	"UNION SELECT buyer_id FROM conversations WHERE listing_id = $1"
+
+// listingStatusHandler handles POST requests from a seller to move one of
+// their listings to a new state other than one of systemListingStatuses.
+// A listing with a sale awaiting the buyer's confirmation keeps its state
+// until the buyer responds.
+func listingStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req StatusChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !req.Status.valid() {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	if systemListingStatuses[req.Status] {
+		http.Error(w, fmt.Sprintf("Listing status %s cannot be set directly", req.Status), http.StatusBadRequest)
+		return
+	}
+
+	var from ListingStatus
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, req.ListingID, currentUserID); err != nil {
+			return err
+		}
+		var pending bool
+		err := tx.QueryRowContext(r.Context(),
+			"SELECT EXISTS(SELECT 1 FROM transactions WHERE listing_id = $1 AND status = $2)", req.ListingID, TransactionPending,
+		).Scan(&pending)
+		if err != nil {
+			return err
+		}
+		if pending {
+			return errSalePending
+		}
+		from, err = setListingStatus(r.Context(), tx, req.ListingID, req.Status, &currentUserID)
+		return err
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	if from == StatusDraft && req.Status == StatusActive {
+		listingPublished(req.ListingID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Listing status updated successfully",
+		"fromStatus": from,
+		"status":     req.Status,
+	})
+}
+
+// listingStatusHistoryHandler handles GET requests for the recorded state
+// transitions of a listing, oldest first. Only the owner may view them.
+func listingStatusHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	listingID, err := strconv.Atoi(r.URL.Query().Get("listingId"))
+	if err != nil {
+		http.Error(w, "Invalid listingId", http.StatusBadRequest)
+		return
+	}
+
+	var ownerID int
+	err = db.QueryRowContext(r.Context(), "SELECT user_id FROM listings WHERE id = $1", listingID).Scan(&ownerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Listing not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ownerID != currentUserID {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT from_status, to_status, changed_by, changed_at FROM listing_status_history WHERE listing_id = $1 ORDER BY changed_at, id",
+		listingID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []ListingStatusChange{}
+	for rows.Next() {
+		var c ListingStatusChange
+		var changedBy sql.NullInt64
+		if err := rows.Scan(&c.FromStatus, &c.ToStatus, &changedBy, &c.ChangedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if changedBy.Valid {
+			id := int(changedBy.Int64)
+			c.ChangedBy = &id
+		}
+		history = append(history, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListingStatus_Transitions(t *testing.T) {
+	tests := []struct {
+		from, to ListingStatus
+		allowed  bool
+	}{
+		{StatusDraft, StatusActive, true},
+		{StatusActive, StatusReserved, true},
+		{StatusReserved, StatusSold, true},
+		{StatusReserved, StatusActive, true},
+		{StatusExpired, StatusActive, true},
+		{StatusSold, StatusArchived, true},
+		{StatusDraft, StatusSold, false},
+		{StatusSold, StatusActive, false},
+		{StatusArchived, StatusActive, false},
+		{StatusActive, StatusDraft, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, tt.from.canTransitionTo(tt.to), "%s -> %s", tt.from, tt.to)
+	}
+}
+
+// expectPendingSaleCheck queues the lookup for a sale of listingID awaiting
+// the buyer's confirmation.
+func expectPendingSaleCheck(mock sqlmock.Sqlmock, listingID int, pending bool) {
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM transactions WHERE listing_id = \\$1 AND status = \\$2\\)").
+		WithArgs(listingID, TransactionPending).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(pending))
+}
+
+func TestListingStatusHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Reserved Back To Active",
+			body: `{"listingId":1,"status":"active"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				expectPendingSaleCheck(mock, 1, false)
+				mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("reserved"))
+				mock.ExpectExec("UPDATE listings SET status = \\$1, updated_at = \\$2 WHERE id = \\$3").
+					WithArgs(StatusActive, sqlmock.AnyArg(), 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE listings SET expires_at = \\$1 WHERE id = \\$2 AND \\(expires_at IS NULL OR expires_at <= \\$3\\)").
+					WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO listing_status_history").
+					WithArgs(1, StatusReserved, StatusActive, 1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectRealtimeEvent(mock, eventListingStatus)
+				expectListingEvent(mock, 1, StatusActive, listingUpdated)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		// Sales, reservations and expiry each have their own flow.
+		{name: "Sold Set Directly", body: `{"listingId":1,"status":"sold"}`, mockSetup: func(sqlmock.Sqlmock) {}, expectedStatus: http.StatusBadRequest},
+		{name: "Reserved Set Directly", body: `{"listingId":1,"status":"reserved"}`, mockSetup: func(sqlmock.Sqlmock) {}, expectedStatus: http.StatusBadRequest},
+		{name: "Expired Set Directly", body: `{"listingId":1,"status":"expired"}`, mockSetup: func(sqlmock.Sqlmock) {}, expectedStatus: http.StatusBadRequest},
+		{
+			name: "Sold To Active Rejected",
+			body: `{"listingId":1,"status":"active"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				expectPendingSaleCheck(mock, 1, false)
+				mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("sold"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Pending Sale Keeps Reservation",
+			body: `{"listingId":1,"status":"archived"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				expectPendingSaleCheck(mock, 1, true)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Unknown Status",
+			body:           `{"listingId":1,"status":"gone"}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/listing/status", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			listingStatusHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
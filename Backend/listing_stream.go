@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Listing event types sent on the listing stream.
+const (
+	listingCreated = "created"
+	listingUpdated = "updated"
+	listingSold    = "sold"
+	listingDeleted = "deleted"
+)
+
+const (
+	// listingEventsChannel is the Postgres NOTIFY channel new listing events
+	// are announced on.
+	listingEventsChannel = "listing_events"
+	// listingEventRetention is how long listing events can be replayed.
+	listingEventRetention = 24 * time.Hour
+
+	sseHeartbeatInterval = 30 * time.Second
+	sseRetry             = 5 * time.Second
+	sseSendBuffer        = 64
+)
+
+// ListingSummary is the payload of a listing event: enough to show the
+// listing in a feed. Clients fetch the detail view for more.
+type ListingSummary struct {
+	ListingID   int           `json:"listingId"`
+	ProductName string        `json:"productName"`
+	Price       Money         `json:"price"`
+	Currency    string        `json:"currency"`
+	Category    string        `json:"category"`
+	CategoryID  *int          `json:"categoryId"`
+	Status      ListingStatus `json:"status"`
+}
+
+// ListingEvent is one entry of the listing stream.
+type ListingEvent struct {
+	ID         int64
+	Type       string
+	Payload    []byte
+	CategoryID *int
+	CreatedAt  time.Time
+}
+
+// initListingEventsDB creates the table of recent listing events that
+// stream clients replay from after reconnecting.
+func initListingEventsDB() error {
+	eventsTable := `
+	CREATE TABLE IF NOT EXISTS listing_events (
+		id BIGSERIAL PRIMARY KEY,
+		listing_id INTEGER NOT NULL,
+		category_id INTEGER,
+		type TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS listing_events_created_at_idx ON listing_events(created_at);`
+	if _, err := db.Exec(eventsTable); err != nil {
+		return fmt.Errorf("error creating listing_events table: %v", err)
+	}
+	return nil
+}
+
+// publishListingEvent records an event for a listing as it currently is and
+// announces it on listingEventsChannel once tx commits. Listings that are
+// not publicly visible, such as drafts, are skipped. Deletions must be
+// published before the listing row is removed.
+func publishListingEvent(ctx context.Context, tx *sql.Tx, listingID int, kind string) error {
+	s := ListingSummary{ListingID: listingID}
+	var hidden bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT product_name, price_cents, currency, category, category_id, status, hidden_at IS NOT NULL FROM listings WHERE id = $1", listingID,
+	).Scan(&s.ProductName, &s.Price, &s.Currency, &s.Category, &s.CategoryID, &s.Status, &hidden)
+	if err == sql.ErrNoRows {
+		return errListingNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !publicListingStatuses[s.Status] || hidden {
+		return nil
+	}
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"WITH e AS (INSERT INTO listing_events(listing_id, category_id, type, payload, created_at) VALUES($1, $2, $3, $4, $5) RETURNING id) "+
+			"SELECT pg_notify('"+listingEventsChannel+"', id::text) FROM e",
+		listingID, s.CategoryID, kind, string(payload), time.Now(),
+	)
+	return err
+}
+
+// deleteOldListingEvents removes events too old to be replayed.
+func deleteOldListingEvents(ctx context.Context) (int, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM listing_events WHERE created_at < $1", time.Now().Add(-listingEventRetention))
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// listingSubscriber is one stream connection. categories is nil when the
+// stream is not filtered.
+type listingSubscriber struct {
+	categories map[int]bool
+	send       chan ListingEvent
+}
+
+// wants reports whether the subscriber's category filter lets e through.
+func (s *listingSubscriber) wants(e ListingEvent) bool {
+	return s.categories == nil || (e.CategoryID != nil && s.categories[*e.CategoryID])
+}
+
+// listingStreamHub tracks the stream connections of this instance.
+type listingStreamHub struct {
+	mu          sync.Mutex
+	subscribers map[*listingSubscriber]bool
+}
+
+var listingStream = &listingStreamHub{subscribers: map[*listingSubscriber]bool{}}
+
+func (h *listingStreamHub) subscribe(s *listingSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[s] = true
+}
+
+// unsubscribe removes a subscriber and closes its send channel, if that has
+// not happened already.
+func (h *listingStreamHub) unsubscribe(s *listingSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// remove must be called with mu held.
+func (h *listingStreamHub) remove(s *listingSubscriber) {
+	if !h.subscribers[s] {
+		return
+	}
+	delete(h.subscribers, s)
+	close(s.send)
+}
+
+func (h *listingStreamHub) empty() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers) == 0
+}
+
+// deliver queues an event for every subscriber that wants it. Subscribers
+// too slow to keep up are dropped; they reconnect with Last-Event-ID.
+func (h *listingStreamHub) deliver(e ListingEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		if !s.wants(e) {
+			continue
+		}
+		select {
+		case s.send <- e:
+		default:
+			h.remove(s)
+		}
+	}
+}
+
+// disconnectAll drops every subscriber, e.g. after notifications may have
+// been missed.
+func (h *listingStreamHub) disconnectAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		h.remove(s)
+	}
+}
+
+// dispatch loads an announced event and delivers it. payload is the event
+// id.
+func (h *listingStreamHub) dispatch(ctx context.Context, payload string) {
+	id, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil || h.empty() {
+		return
+	}
+	e := ListingEvent{ID: id}
+	err = db.QueryRowContext(ctx, "SELECT type, payload, category_id, created_at FROM listing_events WHERE id = $1", id).
+		Scan(&e.Type, &e.Payload, &e.CategoryID, &e.CreatedAt)
+	if err != nil {
+		log.Printf("Error loading listing event %d: %v", id, err)
+		return
+	}
+	h.deliver(e)
+}
+
+// streamCategories returns the ids of a category and its subcategories.
+func streamCategories(ctx context.Context, value string) (map[int]bool, error) {
+	category, err := resolveCategory(ctx, db, value)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(categorySubtree, 1), category.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// replayListingEvents returns the events s wants that c does not cover. It
+// returns false if events after c may already have been deleted.
+func replayListingEvents(ctx context.Context, s *listingSubscriber, c *eventCursor) ([]ListingEvent, bool, error) {
+	oldest, err := oldestEventID(ctx, "listing_events")
+	if err != nil {
+		return nil, false, err
+	}
+	if oldest == nil || c.after < *oldest-1 {
+		return nil, false, nil
+	}
+
+	query := "SELECT id, type, payload, category_id, created_at FROM listing_events " +
+		"WHERE (id > $1 OR (id < $1 AND created_at >= $2 AND id <> ALL($3)))"
+	args := []interface{}{c.after, c.windowStart(), pq.Array(c.seenIDs())}
+	if s.categories != nil {
+		ids := make([]int64, 0, len(s.categories))
+		for id := range s.categories {
+			ids = append(ids, int64(id))
+		}
+		query += " AND category_id = ANY($4)"
+		args = append(args, pq.Array(ids))
+	}
+	rows, err := db.QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var events []ListingEvent
+	for rows.Next() {
+		var e ListingEvent
+		if err := rows.Scan(&e.ID, &e.Type, &e.Payload, &e.CategoryID, &e.CreatedAt); err != nil {
+			return nil, false, err
+		}
+		events = append(events, e)
+	}
+	return events, true, rows.Err()
+}
+
+// listingStreamHandler handles GET /listings/stream, a Server-Sent Events
+// feed of listings being created, updated, sold or deleted, for clients that
+// cannot use WebSockets. ?category= takes a slug or name and includes
+// subcategories. A client reconnecting with Last-Event-ID (or ?lastEventId=)
+// first receives the events it missed; if those are too old to replay it
+// gets a "resync" event and should reload the feed.
+func listingStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	sub := &listingSubscriber{send: make(chan ListingEvent, sseSendBuffer)}
+	if c := r.URL.Query().Get("category"); c != "" {
+		categories, err := streamCategories(ctx, c)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		sub.categories = categories
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+
+	// As with WebSockets, the replay start is fixed before subscribing so
+	// nothing published in between is lost, and the cursor skips events the
+	// client already has even when they commit out of id order.
+	var cursor *eventCursor
+	var backlog []ListingEvent
+	resync := false
+	var err error
+	if lastEventID != "" {
+		if cursor, err = parseEventCursor(lastEventID); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		err = cursor.anchor(ctx, "listing_events")
+	} else {
+		cursor, err = latestEventCursor(ctx, "listing_events")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	listingStream.subscribe(sub)
+	defer listingStream.unsubscribe(sub)
+
+	if lastEventID != "" {
+		if backlog, ok, err = replayListingEvents(ctx, sub, cursor); err == nil && !ok {
+			resync = true
+			cursor, err = latestEventCursor(ctx, "listing_events")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	if resync {
+		fmt.Fprintf(w, "id: %s\nevent: resync\ndata: {}\n\n", cursor)
+	}
+	for _, e := range backlog {
+		cursor.add(e.ID, e.CreatedAt)
+		writeListingEvent(w, cursor, e)
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-sub.send:
+			if !ok {
+				return
+			}
+			if cursor.covers(e.ID, e.CreatedAt) {
+				continue
+			}
+			cursor.add(e.ID, e.CreatedAt)
+			writeListingEvent(w, cursor, e)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeListingEvent writes one event in Server-Sent Events format, with the
+// cursor that resumes after it as its id. The payload is compact JSON, so it
+// fits on a single data line.
+func writeListingEvent(w http.ResponseWriter, c *eventCursor, e ListingEvent) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", c, e.Type, e.Payload)
+}
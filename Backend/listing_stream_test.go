@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// listingSummaryColumns are the columns publishListingEvent reads.
+var listingSummaryColumns = []string{"product_name", "price_cents", "currency", "category", "category_id", "status", "hidden"}
+
+// expectListingEvent queues the lookup of a listing being published to the
+// listing stream and, if the listing is public, the event itself.
+func expectListingEvent(mock sqlmock.Sqlmock, listingID int, status ListingStatus, kind string) {
+	mock.ExpectQuery("SELECT product_name, price_cents, currency, category, category_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+		WithArgs(listingID).
+		WillReturnRows(sqlmock.NewRows(listingSummaryColumns).
+			AddRow("Desk Lamp", 1500, "USD", "Furniture", 6, status, false))
+	if publicListingStatuses[status] {
+		mock.ExpectExec("WITH e AS \\(INSERT INTO listing_events\\(listing_id, category_id, type, payload, created_at\\) .* SELECT pg_notify\\('listing_events'").
+			WithArgs(listingID, 6, kind, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+}
+
+func TestPublishListingEvent(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT product_name, price_cents, currency, category, category_id, status, hidden_at IS NOT NULL FROM listings WHERE id = \\$1").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(listingSummaryColumns).
+			AddRow("Desk Lamp", 1500, "USD", "Furniture", 6, "active", false))
+	mock.ExpectExec("INSERT INTO listing_events").
+		WithArgs(3, 6, listingUpdated,
+			`{"listingId":3,"productName":"Desk Lamp","price":"15.00","currency":"USD","category":"Furniture","categoryId":6,"status":"active"}`,
+			sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Drafts are not streamed.
+	expectListingEvent(mock, 4, StatusDraft, listingUpdated)
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, publishListingEvent(context.Background(), tx, 3, listingUpdated))
+	assert.NoError(t, publishListingEvent(context.Background(), tx, 4, listingUpdated))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// streamRecorder is a ResponseRecorder that is safe to read while the
+// handler is still writing.
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan string
+}
+
+func (r *streamRecorder) Flush() {
+	r.flushed <- r.Body.String()
+	r.Body.Reset()
+}
+
+func TestListingStreamHandler_ReplaysAndFilters(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT id, parent_id, name, slug, attribute_schema FROM categories WHERE slug = \\$1 OR lower\\(name\\) = \\$1").
+		WithArgs("furniture").
+		WillReturnRows(sqlmock.NewRows(categoryColumns).AddRow(6, nil, "Furniture", "furniture", []byte("[]")))
+	mock.ExpectQuery("WITH RECURSIVE sub\\(id\\)").
+		WithArgs(6).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(6).AddRow(7))
+	now := time.Now()
+	mock.ExpectQuery("SELECT created_at FROM listing_events WHERE id = \\$1").
+		WithArgs(int64(12)).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(now.Add(-10 * time.Second)))
+	mock.ExpectQuery("SELECT MIN\\(id\\) FROM listing_events").
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(10))
+	mock.ExpectQuery("SELECT id, type, payload, category_id, created_at FROM listing_events "+
+		"WHERE \\(id > \\$1 OR \\(id < \\$1 AND created_at >= \\$2 AND id <> ALL\\(\\$3\\)\\)\\) AND category_id = ANY\\(\\$4\\) ORDER BY id").
+		WithArgs(int64(12), now.Add(-10*time.Second-eventCommitLag), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "payload", "category_id", "created_at"}).
+			AddRow(13, listingCreated, []byte(`{"listingId":3}`), 7, now))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/listings/stream?category=furniture", nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", "12")
+	w := &streamRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan string, 4)}
+	done := make(chan struct{})
+	go func() {
+		listingStreamHandler(w, req)
+		close(done)
+	}()
+
+	next := func() string {
+		select {
+		case s := <-w.flushed:
+			return s
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for the stream")
+			return ""
+		}
+	}
+	backlog := next()
+	assert.Contains(t, backlog, "retry: 5000\n\n")
+	assert.Contains(t, backlog, "id: 13:12\nevent: created\ndata: {\"listingId\":3}\n\n")
+
+	// Live events outside the category, or already replayed, are skipped.
+	six := 6
+	listingStream.deliver(ListingEvent{ID: 13, Type: listingCreated, Payload: []byte(`{"listingId":3}`), CategoryID: &six, CreatedAt: now})
+	listingStream.deliver(ListingEvent{ID: 14, Type: listingSold, Payload: []byte(`{"listingId":8}`), CreatedAt: now})
+	listingStream.deliver(ListingEvent{ID: 15, Type: listingSold, Payload: []byte(`{"listingId":3}`), CategoryID: &six, CreatedAt: now})
+	assert.Equal(t, "id: 15:12,13\nevent: sold\ndata: {\"listingId\":3}\n\n", next())
+
+	// An event whose transaction committed after a later one is still sent.
+	listingStream.deliver(ListingEvent{ID: 11, Type: listingUpdated, Payload: []byte(`{"listingId":5}`), CategoryID: &six, CreatedAt: now})
+	assert.Equal(t, "id: 15:11,12,13\nevent: updated\ndata: {\"listingId\":5}\n\n", next())
+
+	cancel()
+	<-done
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListingStreamHandler_ResyncsWhenTooOld(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT created_at FROM listing_events WHERE id = \\$1").
+		WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}))
+	mock.ExpectQuery("SELECT MIN\\(id\\) FROM listing_events").
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(40))
+	mock.ExpectQuery("SELECT id, created_at FROM listing_events ORDER BY id DESC LIMIT 1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(52, time.Now()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/listings/stream?lastEventId=3", nil).WithContext(ctx)
+	w := &streamRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan string, 4)}
+	done := make(chan struct{})
+	go func() {
+		listingStreamHandler(w, req)
+		close(done)
+	}()
+
+	var body string
+	select {
+	case body = <-w.flushed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the stream")
+	}
+	cancel()
+	<-done
+	assert.True(t, strings.HasSuffix(body, "id: 52\nevent: resync\ndata: {}\n\n"), body)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListingStreamHandler_InvalidLastEventID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/listings/stream", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	w := httptest.NewRecorder()
+
+	listingStreamHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
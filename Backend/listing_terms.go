@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ItemCondition describes the state of the item being sold.
+type ItemCondition string
+
+const (
+	ConditionNew      ItemCondition = "new"
+	ConditionLikeNew  ItemCondition = "like-new"
+	ConditionGood     ItemCondition = "good"
+	ConditionFair     ItemCondition = "fair"
+	ConditionForParts ItemCondition = "for-parts"
+)
+
+// itemConditions lists the conditions from best to worst.
+var itemConditions = []ItemCondition{ConditionNew, ConditionLikeNew, ConditionGood, ConditionFair, ConditionForParts}
+
+// valid reports whether c is a known condition.
+func (c ItemCondition) valid() bool {
+	for _, known := range itemConditions {
+		if c == known {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCurrency is used when a listing does not name a currency.
+const defaultCurrency = "USD"
+
+// supportedCurrencies are the ISO 4217 codes listings may be priced in.
+var supportedCurrencies = map[string]bool{
+	"USD": true,
+}
+
+// initListingTermsDB adds condition, negotiable, free and currency columns to
+// listings and moves the NUMERIC price to integer cents, read as Money.
+func initListingTermsDB() error {
+	termsColumns := `
+	ALTER TABLE listings
+		ADD COLUMN IF NOT EXISTS condition TEXT CHECK (condition IN ('new', 'like-new', 'good', 'fair', 'for-parts')),
+		ADD COLUMN IF NOT EXISTS negotiable BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN IF NOT EXISTS is_free BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD',
+		ADD COLUMN IF NOT EXISTS price_cents BIGINT CHECK (price_cents >= 0);`
+	if _, err := db.Exec(termsColumns); err != nil {
+		return fmt.Errorf("error adding listings terms columns: %v", err)
+	}
+
+	// Databases created before prices were kept in cents still have the
+	// NUMERIC price column; convert it once and drop it.
+	priceMigration := `
+	DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'listings' AND column_name = 'price') THEN
+			UPDATE listings SET price_cents = ROUND(price * 100), is_free = (price = 0) WHERE price_cents IS NULL;
+			ALTER TABLE listings DROP COLUMN price;
+		END IF;
+	END $$;
+	UPDATE listings SET price_cents = 0 WHERE price_cents IS NULL;
+	ALTER TABLE listings ALTER COLUMN price_cents SET DEFAULT 0, ALTER COLUMN price_cents SET NOT NULL;
+	CREATE INDEX IF NOT EXISTS listings_price_cents_idx ON listings(price_cents);`
+	if _, err := db.Exec(priceMigration); err != nil {
+		return fmt.Errorf("error migrating listings price to cents: %v", err)
+	}
+	return nil
+}
+
+// parseOptionalBool parses a true/false form value. An empty value returns nil.
+func parseOptionalBool(name, value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: expected true or false", name)
+	}
+	return &b, nil
+}
+
+// readListingTerms copies the price, currency, condition, negotiable and free
+// form values of a create or edit request into f. Absent values are left
+// unset.
+func readListingTerms(r *http.Request, f *ListingFields) error {
+	if value := r.FormValue("price"); value != "" {
+		price, err := ParseMoney(value)
+		if err != nil {
+			return fmt.Errorf("Invalid price: %v", err)
+		}
+		f.Price = &price
+	}
+	f.Currency = strings.ToUpper(strings.TrimSpace(r.FormValue("currency")))
+	if value := r.FormValue("condition"); value != "" {
+		condition := ItemCondition(value)
+		f.Condition = &condition
+	}
+	var err error
+	if f.Negotiable, err = parseOptionalBool("negotiable", r.FormValue("negotiable")); err != nil {
+		return err
+	}
+	if f.Free, err = parseOptionalBool("free", r.FormValue("free")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// reconcileTerms validates the condition and currency of f and keeps price,
+// free and negotiable consistent: a free item costs nothing and is not
+// negotiable, and giving a positive price makes an item no longer free.
+func (f *ListingFields) reconcileTerms() error {
+	if f.Condition != nil && !f.Condition.valid() {
+		names := make([]string, len(itemConditions))
+		for i, c := range itemConditions {
+			names[i] = string(c)
+		}
+		return badRequest("Invalid condition: must be one of %s", strings.Join(names, ", "))
+	}
+	if f.Currency != "" && !supportedCurrencies[f.Currency] {
+		return badRequest("Unsupported currency %q", f.Currency)
+	}
+
+	switch {
+	case f.Free != nil && *f.Free:
+		if f.Price != nil && *f.Price != 0 {
+			return badRequest("A free item cannot have a price")
+		}
+		if f.Negotiable != nil && *f.Negotiable {
+			return badRequest("A free item cannot be negotiable")
+		}
+		zero, no := Money(0), false
+		f.Price, f.Negotiable = &zero, &no
+	case f.Price != nil:
+		if *f.Price == 0 {
+			return badRequest("Price must be greater than zero unless the item is free")
+		}
+		no := false
+		f.Free = &no
+	case f.Free != nil:
+		return badRequest("Price is required unless the item is free")
+	}
+	return nil
+}
+
+// addTermsFilters adds the feed filters on listing terms: ?condition= takes
+// one or more comma-separated conditions, ?negotiable= and ?free= take true or
+// false, and ?minPrice= / ?maxPrice= take decimal prices.
+func addTermsFilters(where *whereBuilder, query url.Values) error {
+	if value := query.Get("condition"); value != "" {
+		var conditions []string
+		for _, c := range strings.Split(value, ",") {
+			condition := ItemCondition(strings.TrimSpace(c))
+			if !condition.valid() {
+				return fmt.Errorf("Invalid condition %q", c)
+			}
+			conditions = append(conditions, string(condition))
+		}
+		where.add("l.condition = ANY($%d)", pq.Array(conditions))
+	}
+	for _, flag := range []struct{ param, column string }{{"negotiable", "l.negotiable"}, {"free", "l.is_free"}} {
+		b, err := parseOptionalBool(flag.param, query.Get(flag.param))
+		if err != nil {
+			return err
+		}
+		if b != nil {
+			where.add(flag.column+" = $%d", *b)
+		}
+	}
+	if value := query.Get("minPrice"); value != "" {
+		price, err := ParseMoney(value)
+		if err != nil {
+			return fmt.Errorf("Invalid minPrice: %v", err)
+		}
+		where.add("l.price_cents >= $%d", price)
+	}
+	if value := query.Get("maxPrice"); value != "" {
+		price, err := ParseMoney(value)
+		if err != nil {
+			return fmt.Errorf("Invalid maxPrice: %v", err)
+		}
+		where.add("l.price_cents <= $%d", price)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListingFields_ReconcileTerms(t *testing.T) {
+	price := func(v Money) *Money { return &v }
+	flag := func(v bool) *bool { return &v }
+	condition := func(v ItemCondition) *ItemCondition { return &v }
+
+	tests := []struct {
+		name   string
+		fields ListingFields
+		err    string
+		check  func(t *testing.T, f ListingFields)
+	}{
+		{
+			name:   "Free Clears Price And Negotiable",
+			fields: ListingFields{Free: flag(true)},
+			check: func(t *testing.T, f ListingFields) {
+				assert.Equal(t, Money(0), *f.Price)
+				assert.False(t, *f.Negotiable)
+			},
+		},
+		{
+			name:   "Price Makes Item Not Free",
+			fields: ListingFields{Price: price(2500), Condition: condition(ConditionLikeNew)},
+			check: func(t *testing.T, f ListingFields) {
+				assert.False(t, *f.Free)
+			},
+		},
+		{name: "Free With Price", fields: ListingFields{Free: flag(true), Price: price(100)}, err: "A free item cannot have a price"},
+		{name: "Free And Negotiable", fields: ListingFields{Free: flag(true), Negotiable: flag(true)}, err: "A free item cannot be negotiable"},
+		{name: "Zero Price", fields: ListingFields{Price: price(0)}, err: "Price must be greater than zero"},
+		{name: "Not Free Without Price", fields: ListingFields{Free: flag(false)}, err: "Price is required"},
+		{name: "Unknown Condition", fields: ListingFields{Condition: condition("mint")}, err: "Invalid condition"},
+		{name: "Unsupported Currency", fields: ListingFields{Currency: "EUR"}, err: `Unsupported currency "EUR"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fields.reconcileTerms()
+			if tt.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			tt.check(t, tt.fields)
+		})
+	}
+}
+
+func TestListingsHandler_FiltersByTerms(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("WHERE l.user_id <> \\$1 AND l.status = \\$2 AND l.condition = ANY\\(\\$3\\) AND l.negotiable = \\$4 AND l.price_cents <= \\$5").
+		WithArgs(1, StatusActive, sqlmock.AnyArg(), true, Money(5000), 1).
+		WillReturnRows(sqlmock.NewRows(listingColumns))
+
+	req := httptest.NewRequest(http.MethodGet, "/listings?condition=new,like-new&negotiable=true&maxPrice=50", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateListing_FreeItem(t *testing.T) {
+	mock := withMockDB(t)
+	expectNewListingChecks(mock)
+	expectCategoryLookup(mock, "furniture", 6, "Furniture")
+	mock.ExpectQuery("INSERT INTO listings").
+		WithArgs(1, "Futon", "", Money(0), defaultCurrency, ConditionFair, false, true, "Furniture", 6,
+			sqlmock.AnyArg(), StatusActive, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+	mock.ExpectQuery("INSERT INTO listing_images").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	expectListingEvent(mock, 42, StatusActive, listingCreated)
+	mock.ExpectCommit()
+	mock.ExpectQuery("FROM listings l JOIN users u ON u.id = l.user_id WHERE l.user_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(listingColumns))
+
+	req := multipartListingRequest(t, http.MethodPost, "/listings", map[string]string{
+		"productName": "Futon",
+		"category":    "Furniture",
+		"condition":   "fair",
+		"free":        "true",
+	}, 1)
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -20,15 +21,27 @@ import (
 type Listing struct {
 	ID                 int                      `json:"id"`
 	UserID             int                      `json:"userId"`
-	UserName           string                   `json:"userName"`
-	UserEmail          string                   `json:"userEmail"`
+	Seller             SellerSummary            `json:"seller"`
 	ProductName        string                   `json:"productName"`
 	ProductDescription string                   `json:"productDescription"`
-	Price              float64                  `json:"price"`
+	Price              Money                    `json:"price"`
+	Currency           string                   `json:"currency"`
+	Condition          *ItemCondition           `json:"condition"`
+	Negotiable         bool                     `json:"negotiable"`
+	Free               bool                     `json:"free"`
 	Category           string                   `json:"category"`
+	CategoryID         *int                     `json:"categoryId"`
+	Attributes         ListingAttributes        `json:"attributes"`
+	Status             ListingStatus            `json:"status"`
 	CreatedAt          time.Time                `json:"createdAt"`
 	UpdatedAt          time.Time                `json:"updatedAt"`
+	ExpiresAt          *time.Time               `json:"expiresAt,omitempty"`
+	ExpiresInDays      *int                     `json:"expiresInDays,omitempty"`
+	PublishAt          *time.Time               `json:"publishAt,omitempty"`
 	Images             []map[string]interface{} `json:"images"`
+	PriceHistory       []PriceChange            `json:"priceHistory,omitempty"`
+	IsFavorited        bool                     `json:"isFavorited"`
+	FavoriteCount      int                      `json:"favoriteCount"`
 }
 
 // saveImage saves an uploaded image to disk.
@@ -60,6 +73,66 @@ func saveImage(fileHeader *multipart.FileHeader) (string, error) {
 	return filePath, nil
 }
 
+// feedFilter builds the WHERE clause of the public feed from its query
+// parameters. ?q= matches text in the product name or description. Only
+// active listings are shown unless another public state is requested, e.g.
+// ?status=sold. ?category= takes a slug or name and includes subcategories;
+// attr.<name>= filters on that category's attributes. The filters on price,
+// condition and flags are described at addTermsFilters.
+func feedFilter(ctx context.Context, currentUserID int, query url.Values) (*whereBuilder, error) {
+	where := &whereBuilder{}
+	where.add("l.user_id <> $%d", currentUserID)
+
+	status := StatusActive
+	if s := query.Get("status"); s != "" {
+		status = ListingStatus(s)
+		if !publicListingStatuses[status] {
+			return nil, badRequest("Invalid status")
+		}
+	}
+	where.add("l.status = $%d", status)
+
+	schema := AttributeSchema{}
+	if c := query.Get("category"); c != "" {
+		category, err := resolveCategory(ctx, db, c)
+		if err != nil {
+			return nil, err
+		}
+		where.add("l.category_id IN ("+categorySubtree+")", category.ID)
+		if schema, err = categoryAttributeSchema(ctx, db, &category.ID); err != nil {
+			return nil, err
+		}
+	}
+	if q := strings.TrimSpace(query.Get("q")); q != "" {
+		where.add("(l.product_name ILIKE $%[1]d OR l.product_description ILIKE $%[1]d)", "%"+likeEscaper.Replace(q)+"%")
+	}
+	if err := addAttributeFilters(where, schema, query); err != nil {
+		return nil, badRequest("%s", err.Error())
+	}
+	if err := addTermsFilters(where, query); err != nil {
+		return nil, badRequest("%s", err.Error())
+	}
+	addViewerFilters(where, currentUserID)
+	return where, nil
+}
+
+// addViewerFilters leaves out listings hidden by moderation, until they are
+// restored, and listings kept from viewerID by a block or mute (see
+// blockedFeedFilter).
+func addViewerFilters(where *whereBuilder, viewerID int) {
+	where.add("l.hidden_at IS NULL")
+	where.add(blockedFeedFilter, viewerID)
+}
+
+// categorySubtree selects the id of a category, given as parameter $%d, and
+// of all its subcategories.
+const categorySubtree = "WITH RECURSIVE sub(id) AS (" +
+	"SELECT id FROM categories WHERE id = $%d " +
+	"UNION ALL SELECT c.id FROM categories c JOIN sub ON c.parent_id = sub.id) SELECT id FROM sub"
+
+// likeEscaper escapes the LIKE wildcards in user search text.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 // listingsHandler handles GET (fetch all listings excluding the current user)
 // and POST (create new listing with multipart form data) requests.
 func listingsHandler(w http.ResponseWriter, r *http.Request) {
@@ -77,50 +150,22 @@ func listingsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Join with users table to get the username
-		rows, err := db.Query(
-			"SELECT l.id, l.user_id, u.name, u.email, l.product_name, l.product_description, l.price, l.category, l.created_at, l.updated_at "+
-				"FROM listings l JOIN users u ON u.id = l.user_id WHERE l.user_id <> $1", currentUserID)
+		where, err := feedFilter(r.Context(), currentUserID, r.URL.Query())
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeRepoError(w, err)
 			return
 		}
-		defer rows.Close()
 
-		var listings []Listing
-		for rows.Next() {
-			var l Listing
-			var userName string
-			var userEmail string
-
-			if err := rows.Scan(&l.ID, &l.UserID, &userName, &userEmail, &l.ProductName, &l.ProductDescription, &l.Price, &l.Category, &l.CreatedAt, &l.UpdatedAt); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			l.UserName = userName
-			l.UserEmail = userEmail
-
-			// Fetch image data for listing.
-			imageRows, err := db.Query("SELECT id, image_data, content_type FROM listing_images WHERE listing_id = $1", l.ID)
-			if err == nil {
-				var images []map[string]interface{}
-				for imageRows.Next() {
-					var imageID int
-					var imageData []byte
-					var contentType string
-					if err := imageRows.Scan(&imageID, &imageData, &contentType); err == nil {
-						encodedData := base64.StdEncoding.EncodeToString(imageData)
-						images = append(images, map[string]interface{}{
-							"id":          imageID,
-							"contentType": contentType,
-							"data":        encodedData,
-						})
-					}
-				}
-				l.Images = images
-				imageRows.Close()
-			}
-			listings = append(listings, l)
+		// Join with users table to get the username; thumbnails for the whole
+		// page are loaded with one extra query.
+		listings, err := queryListings(r.Context(), db, imageSizeThumbnail, where.clause(), where.args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := attachFavorites(r.Context(), db, listings, currentUserID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(listings)
@@ -143,88 +188,122 @@ func listingsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		productName := r.FormValue("productName")
-		productDescription := r.FormValue("productDescription")
-		priceStr := r.FormValue("price")
-		price, err := strconv.ParseFloat(priceStr, 64)
-		if err != nil {
-			http.Error(w, "Invalid price", http.StatusBadRequest)
+		fields := ListingFields{
+			ProductName:        r.FormValue("productName"),
+			ProductDescription: r.FormValue("productDescription"),
+			Category:           r.FormValue("category"),
+		}
+		if err := readListingTerms(r, &fields); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		category := r.FormValue("category")
 
-		var listingID int
-		err = db.QueryRow(
-			"INSERT INTO listings(user_id, product_name, product_description, price, category, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id",
-			userID, productName, productDescription, price, category, time.Now(), time.Now(),
-		).Scan(&listingID)
+		// A listing is created as a draft when asked to, or when it is
+		// scheduled to go live later.
+		publishAt, err := parsePublishAt(r.FormValue("publishAt"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fields.Status = StatusActive
+		if r.FormValue("draft") == "true" || publishAt != nil {
+			fields.Status = StatusDraft
+		}
+		fields.PublishAt = publishAt
+		if fields.Attributes, err = parseAttributes(r.FormValue("attributes")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		files := r.MultipartForm.File["images"]
-		for _, fileHeader := range files {
-			imageData, contentType, err := readImageData(fileHeader)
-			if err != nil {
-				log.Printf("Error reading image: %v", err)
-				continue
-			}
+		if len(files) > maxImagesPerListing {
+			http.Error(w, fmt.Sprintf("Too many images: a listing can have at most %d", maxImagesPerListing), http.StatusBadRequest)
+			return
+		}
 
-			if len(imageData) > 5<<20 {
-				log.Printf("Image too large: %s", fileHeader.Filename)
-				continue
-			}
+		uploads, imageResults := processUploadedImages(files)
 
-			_, err = db.Exec(
-				"INSERT INTO listing_images(listing_id, image_data, content_type) VALUES($1, $2, $3)",
-				listingID, imageData, contentType,
-			)
-			if err != nil {
-				log.Printf("Error saving image record: %v", err)
-			}
+		// Listings breaking the content rules are refused outright or saved
+		// hidden until a moderator reviews them.
+		matches := contentRules.screen(uploads, fields.ProductName, fields.ProductDescription)
+		if matches.action() == contentReject {
+			writeRepoError(w, matches.rejection())
+			return
 		}
+		pendingReview := matches.action() == contentReview
 
-		// Fetch all listings for the user (with full image data)
-		rows, err := db.Query("SELECT id, user_id, product_name, product_description, price, category, created_at, updated_at FROM listings WHERE user_id = $1", userID)
+		// Reposts of the seller's own listings are refused or held for
+		// review, depending on duplicateAction.
+		duplicates, err := findDuplicateListings(r.Context(), userID, fields.ProductName, uploads)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var listings []Listing
-		for rows.Next() {
-			var l Listing
-			if err := rows.Scan(&l.ID, &l.UserID, &l.ProductName, &l.ProductDescription, &l.Price, &l.Category, &l.CreatedAt, &l.UpdatedAt); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		flagDuplicate := false
+		if len(duplicates) > 0 {
+			switch {
+			case duplicateAction == duplicateFlag:
+				flagDuplicate = true
+			case duplicateAction == duplicateMerge && r.FormValue("confirmNotDuplicate") == "true":
+			default:
+				writeDuplicateConflict(w, duplicates)
 				return
 			}
-			// Fetch image data.
-			imageRows, err := db.Query("SELECT id, image_data, content_type FROM listing_images WHERE listing_id = $1", l.ID)
-			if err == nil {
-				var images []map[string]interface{}
-				for imageRows.Next() {
-					var imageID int
-					var imageData []byte
-					var contentType string
-					if err := imageRows.Scan(&imageID, &imageData, &contentType); err == nil {
-						encodedData := base64.StdEncoding.EncodeToString(imageData)
-						images = append(images, map[string]interface{}{
-							"id":          imageID,
-							"contentType": contentType,
-							"data":        encodedData,
-						})
-					}
+		}
+
+		// The listing and its images are written together or not at all.
+		var listingID int
+		err = withTx(r.Context(), func(tx *sql.Tx) error {
+			if err := recordListingPost(r.Context(), tx, userID); err != nil {
+				return err
+			}
+			var err error
+			listingID, err = createListing(r.Context(), tx, userID, fields)
+			if err != nil {
+				return err
+			}
+			if err := storeUploadedImages(r.Context(), tx, listingID, 0, uploads, imageResults); err != nil {
+				return err
+			}
+			if pendingReview {
+				if err := holdForContentReview(r.Context(), tx, listingID, userID, matches); err != nil {
+					return err
 				}
-				l.Images = images
-				imageRows.Close()
 			}
-			listings = append(listings, l)
+			if flagDuplicate {
+				if err := holdForDuplicateReview(r.Context(), tx, listingID, userID, duplicates); err != nil {
+					return err
+				}
+			}
+			return publishListingEvent(r.Context(), tx, listingID, listingCreated)
+		})
+		var limited *postingLimitedError
+		if errors.As(err, &limited) {
+			writePostingLimited(w, limited.wait)
+			return
+		} else if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		pendingReview = pendingReview || flagDuplicate
+		if fields.Status == StatusActive && !pendingReview {
+			listingPublished(listingID)
+		}
+
+		// Fetch all listings for the user (with thumbnails)
+		listings, err := queryListings(r.Context(), db, imageSizeThumbnail, "WHERE l.user_id = $1", userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(listings)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"listingId":     listingID,
+			"images":        imageResults,
+			"listings":      listings,
+			"pendingReview": pendingReview,
+		})
 	}
 }
 
@@ -242,49 +321,84 @@ func userListingsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query("SELECT id, user_id, product_name, product_description, price, category, created_at, updated_at FROM listings WHERE user_id = $1", userID)
+	listings, err := queryListings(r.Context(), db, imageSizeThumbnail, "WHERE l.user_id = $1", userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
+	if err := attachFavorites(r.Context(), db, listings, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	var listings []Listing
-	for rows.Next() {
-		var l Listing
-		if err := rows.Scan(&l.ID, &l.UserID, &l.ProductName, &l.ProductDescription, &l.Price, &l.Category, &l.CreatedAt, &l.UpdatedAt); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// Fetch image data.
-		imageRows, err := db.Query("SELECT id, image_data, content_type FROM listing_images WHERE listing_id = $1", l.ID)
-		if err == nil {
-			var images []map[string]interface{}
-			for imageRows.Next() {
-				var imageID int
-				var imageData []byte
-				var contentType string
-				if err := imageRows.Scan(&imageID, &imageData, &contentType); err == nil {
-					encodedData := base64.StdEncoding.EncodeToString(imageData)
-					images = append(images, map[string]interface{}{
-						"id":          imageID,
-						"contentType": contentType,
-						"data":        encodedData,
-					})
-				}
-			}
-			l.Images = images
-			imageRows.Close()
+	// Let sellers see how long their active listings have left.
+	now := time.Now()
+	for i := range listings {
+		if listings[i].Status == StatusActive && listings[i].ExpiresAt != nil {
+			days := expiresInDays(*listings[i].ExpiresAt, now)
+			listings[i].ExpiresInDays = &days
 		}
-		listings = append(listings, l)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(listings)
 }
 
+// listingDetailHandler handles GET requests for a single listing. Unlike the
+// feed, it embeds medium-size images for the detail view.
+func listingDetailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	listingID, err := strconv.Atoi(r.URL.Query().Get("listingId"))
+	if err != nil {
+		http.Error(w, "Invalid listingId", http.StatusBadRequest)
+		return
+	}
+
+	// Listings hidden by moderation are only shown to their owner, and
+	// listings are not shown to users their seller has blocked.
+	viewerID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	listings, err := queryListings(r.Context(), db, imageSizeMedium,
+		"WHERE l.id = $1 AND (l.hidden_at IS NULL OR l.user_id = $2) AND "+
+			"NOT EXISTS(SELECT 1 FROM user_blocks b WHERE b.blocker_id = l.user_id AND b.blocked_id = $2 AND NOT b.muted)",
+		listingID, viewerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(listings) == 0 {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	l := listings[0]
+	// Drafts are private to their owner until published.
+	if l.Status == StatusDraft && viewerID != l.UserID {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err := attachFavorites(r.Context(), db, listings, viewerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	l = listings[0]
+	if l.PriceHistory, err = listingPriceHistory(r.Context(), db, l.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
 // editListingHandler handles PUT requests to edit a listing (only if owned by the current user).
-// It now supports updating images by deleting all existing images for that listing
-// and inserting the new ones from the request.
+// Images in the request are added after the listing's existing images, which keep
+// their order, within the same transaction as the other changes. Images are removed
+// through DELETE /listing/images.
 func editListingHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -315,104 +429,72 @@ func editListingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var ownerID int
-	err = db.QueryRow("SELECT user_id FROM listings WHERE id = $1", listingID).Scan(&ownerID)
+	files := r.MultipartForm.File["images"]
+	if len(files) > maxImagesPerListing {
+		http.Error(w, fmt.Sprintf("Too many images: a listing can have at most %d", maxImagesPerListing), http.StatusBadRequest)
+		return
+	}
+
+	// Update listing text fields.
+	fields := ListingFields{
+		ProductName:        r.FormValue("productName"),
+		ProductDescription: r.FormValue("productDescription"),
+		Category:           r.FormValue("category"),
+	}
+	attributes, err := parseAttributes(r.FormValue("attributes"))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Listing not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if ownerID != currentUserID {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	fields.Attributes = attributes
+	if err := readListingTerms(r, &fields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Update listing text fields.
-	productName := r.FormValue("productName")
-	productDescription := r.FormValue("productDescription")
-	priceStr := r.FormValue("price")
-	var price float64
-	if priceStr != "" {
-		price, err = strconv.ParseFloat(priceStr, 64)
-		if err != nil {
-			http.Error(w, "Invalid price", http.StatusBadRequest)
-			return
-		}
+	// Ownership check, field update and new images share one transaction.
+	// Uploads are added after the existing images, like those posted to
+	// /listing/images, so their order and cover are kept.
+	uploads, imageResults := processUploadedImages(files)
+	matches := contentRules.screen(uploads, fields.ProductName, fields.ProductDescription)
+	if matches.action() == contentReject {
+		writeRepoError(w, matches.rejection())
+		return
 	}
-	category := r.FormValue("category")
-
-	updateQuery := "UPDATE listings SET "
-	params := []interface{}{}
-	paramIndex := 1
-	updates := []string{}
-	if productName != "" {
-		updates = append(updates, fmt.Sprintf("product_name = $%d", paramIndex))
-		params = append(params, productName)
-		paramIndex++
-	}
-	if productDescription != "" {
-		updates = append(updates, fmt.Sprintf("product_description = $%d", paramIndex))
-		params = append(params, productDescription)
-		paramIndex++
-	}
-	if priceStr != "" {
-		updates = append(updates, fmt.Sprintf("price = $%d", paramIndex))
-		params = append(params, price)
-		paramIndex++
-	}
-	if category != "" {
-		updates = append(updates, fmt.Sprintf("category = $%d", paramIndex))
-		params = append(params, category)
-		paramIndex++
-	}
-	updates = append(updates, fmt.Sprintf("updated_at = $%d", paramIndex))
-	params = append(params, time.Now())
-	paramIndex++
-
-	// Only run the update query if there are fields to update.
-	if len(updates) > 0 {
-		updateQuery += strings.Join(updates, ", ")
-		updateQuery += fmt.Sprintf(" WHERE id = $%d AND user_id = $%d", paramIndex, paramIndex+1)
-		params = append(params, listingID, currentUserID)
-
-		_, err = db.Exec(updateQuery, params...)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	pendingReview := matches.action() == contentReview
+	err = withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, listingID, currentUserID); err != nil {
+			return err
 		}
-	}
-
-	// If new images are provided, delete all existing images and add the new ones.
-	files := r.MultipartForm.File["images"]
-	if len(files) > 0 {
-		_, err := db.Exec("DELETE FROM listing_images WHERE listing_id = $1", listingID)
-		if err != nil {
-			http.Error(w, "Error deleting existing images: "+err.Error(), http.StatusInternalServerError)
-			return
+		if err := updateListing(r.Context(), tx, listingID, currentUserID, fields); err != nil {
+			return err
 		}
-		for _, fileHeader := range files {
-			imageData, contentType, err := readImageData(fileHeader)
-			if err != nil {
-				log.Printf("Error reading image: %v", err)
-				continue
+		if len(uploads) > 0 {
+			if err := appendListingImages(r.Context(), tx, listingID, uploads, imageResults); err != nil {
+				return err
 			}
-			if len(imageData) > 5<<20 {
-				log.Printf("Image too large: %s", fileHeader.Filename)
-				continue
+		}
+		if pendingReview {
+			if err := publishListingEvent(r.Context(), tx, listingID, listingDeleted); err != nil {
+				return err
 			}
-			_, err = db.Exec("INSERT INTO listing_images(listing_id, image_data, content_type) VALUES($1, $2, $3)", listingID, imageData, contentType)
-			if err != nil {
-				log.Printf("Error inserting new image: %v", err)
-				continue
+			if err := holdForContentReview(r.Context(), tx, listingID, currentUserID, matches); err != nil {
+				return err
 			}
 		}
+		return publishListingEvent(r.Context(), tx, listingID, listingUpdated)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Listing updated successfully"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Listing updated successfully",
+		"images":        imageResults,
+		"pendingReview": pendingReview,
+	})
 }
 
 // deleteListingHandler handles DELETE requests to remove a listing (and all its images).
@@ -440,49 +522,48 @@ func deleteListingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var ownerID int
-	err = db.QueryRow("SELECT user_id FROM listings WHERE id = $1", listingID).Scan(&ownerID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Listing not found", http.StatusNotFound)
-			return
+	err = withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, listingID, currentUserID); err != nil {
+			return err
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if ownerID != currentUserID {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	_, err = db.Exec("DELETE FROM listing_images WHERE listing_id = $1", listingID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	_, err = db.Exec("DELETE FROM listings WHERE id = $1 AND user_id = $2", listingID, currentUserID)
+		if err := publishListingEvent(r.Context(), tx, listingID, listingDeleted); err != nil {
+			return err
+		}
+		return deleteListing(r.Context(), tx, listingID, currentUserID)
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRepoError(w, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Listing deleted successfully"})
 }
 
-// readImageData reads the uploaded image into a byte slice.
+// readImageData reads the uploaded image into a byte slice and validates it.
+// At most maxImageBytes+1 bytes are read so oversize uploads are never held
+// in memory in full.
 func readImageData(fileHeader *multipart.FileHeader) ([]byte, string, error) {
+	if fileHeader.Size > maxImageBytes {
+		return nil, "", errImageTooLarge
+	}
+
 	file, err := fileHeader.Open()
 	if err != nil {
 		return nil, "", err
 	}
 	defer file.Close()
 
-	imageData, err := io.ReadAll(file)
+	imageData, err := io.ReadAll(io.LimitReader(file, maxImageBytes+1))
 	if err != nil {
 		return nil, "", err
 	}
+	if len(imageData) > maxImageBytes {
+		return nil, "", errImageTooLarge
+	}
 
-	contentType := http.DetectContentType(imageData)
+	contentType, err := validateImage(imageData)
+	if err != nil {
+		return nil, "", err
+	}
 	return imageData, contentType, nil
 }
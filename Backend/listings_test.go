@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var listingColumns = []string{"id", "user_id", "name", "average_rating", "review_count", "product_name", "product_description", "price_cents", "currency", "condition", "negotiable", "is_free", "category", "category_id", "attributes", "status", "created_at", "updated_at", "expires_at", "publish_at"}
+
+// expectListingFeed queues the queries the feed should issue for n listings
+// with imagesPer images each: the listings, their images and their favorites.
+func expectListingFeed(mock sqlmock.Sqlmock, n, imagesPer int) {
+	now := time.Now()
+	rows := sqlmock.NewRows(listingColumns)
+	images := sqlmock.NewRows([]string{"id", "listing_id", "data", "content_type"})
+	for i := 1; i <= n; i++ {
+		rows.AddRow(i, 2, "User2", nil, 0, "Product", "Desc", 1000, "USD", "good", false, false, "Books", 4, []byte("{}"), "active", now, now, now.Add(listingExpiry), nil)
+		for j := 0; j < imagesPer; j++ {
+			images.AddRow(i*10+j, i, []byte("thumb"), "image/jpeg")
+		}
+	}
+	mock.ExpectQuery("SELECT l.id, l.user_id, u.name, .* FROM listings l JOIN users u ON u.id = l.user_id WHERE l.user_id <> \\$1 AND l.status = \\$2 AND l.hidden_at IS NULL "+
+		"AND NOT EXISTS\\(SELECT 1 FROM user_blocks b WHERE \\(b.blocker_id = \\$3 AND b.blocked_id = l.user_id\\)").
+		WithArgs(1, StatusActive, 1).
+		WillReturnRows(rows)
+	mock.ExpectQuery("SELECT id, listing_id, COALESCE\\(thumbnail_data, image_data\\), content_type FROM listing_images WHERE listing_id = ANY\\(\\$1\\)").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(images)
+	expectFavorites(mock, 1)
+}
+
+func TestListingsHandler_GetBatchesImages(t *testing.T) {
+	mock := withMockDB(t)
+	expectListingFeed(mock, 3, 2)
+
+	req := httptest.NewRequest(http.MethodGet, "/listings", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var listings []Listing
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listings))
+	assert.Len(t, listings, 3)
+	for _, l := range listings {
+		assert.Len(t, l.Images, 2)
+		assert.Equal(t, imageURL(l.ID*10, imageSizeThumbnail), l.Images[0]["thumbnailUrl"])
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListingDetailHandler_NotFound(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("FROM listings l JOIN users u ON u.id = l.user_id WHERE l.id = \\$1").
+		WithArgs(9, 1).
+		WillReturnRows(sqlmock.NewRows(listingColumns))
+
+	req := httptest.NewRequest(http.MethodGet, "/listing?listingId=9", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingDetailHandler(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// BenchmarkListingsFeed measures the feed with 1,000 listings of 3 images
+// each and reports the number of queries issued per request.
+func BenchmarkListingsFeed(b *testing.B) {
+	var queries int64
+	countingMatcher := sqlmock.QueryMatcherFunc(func(expected, actual string) error {
+		atomic.AddInt64(&queries, 1)
+		return sqlmock.QueryMatcherRegexp.Match(expected, actual)
+	})
+	mockDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(countingMatcher))
+	if err != nil {
+		b.Fatalf("Failed to create mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	originalDB := db
+	db = mockDB
+	defer func() { db = originalDB }()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		expectListingFeed(mock, 1000, 3)
+		req := httptest.NewRequest(http.MethodGet, "/listings", nil)
+		req.Header.Set("userId", "1")
+		w := httptest.NewRecorder()
+		b.StartTimer()
+
+		listingsHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&queries))/float64(b.N), "queries/op")
+}
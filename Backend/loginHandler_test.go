@@ -28,6 +28,10 @@ func TestLoginHandler_Success(t *testing.T) {
 	}
 	defer func() { GetUserInfo = originalGetUserInfo }() // Restore the original function
 
+	originalIsUserSuspended := IsUserSuspended // Save the original function
+	IsUserSuspended = func(userId int) (bool, error) { return false, nil }
+	defer func() { IsUserSuspended = originalIsUserSuspended }() // Restore the original function
+
 	originalCreateSession := CreateSession // Save the original function
 	CreateSession = func(userId int) (string, error) { return "session-123", nil }
 	defer func() { CreateSession = originalCreateSession }() // Restore the original function
@@ -66,4 +70,30 @@ func TestLoginHandler_UnverifiedEmail(t *testing.T) {
 
 	assert.Equal(t, http.StatusUnauthorized, w.Code)
 	assert.Contains(t, w.Body.String(), "Email is not verified")
-}
\ No newline at end of file
+}
+
+func TestLoginHandler_SuspendedAccount(t *testing.T) {
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+
+	originalGetUserByEmail, originalGetUserInfo, originalIsUserSuspended := GetUserByEmail, GetUserInfo, IsUserSuspended
+	defer func() {
+		GetUserByEmail, GetUserInfo, IsUserSuspended = originalGetUserByEmail, originalGetUserInfo, originalIsUserSuspended
+	}()
+	GetUserByEmail = func(email string) (int, string, string, error) {
+		return 123, string(hashedPassword), "Gator", nil
+	}
+	GetUserInfo = func(userId int) (int, string, string, string, int, error) {
+		return userId, "", "", "", 1, nil
+	}
+	IsUserSuspended = func(userId int) (bool, error) { return true, nil }
+
+	creds := LogInCredentials{Email: "gator@uf.edu", Password: "password"}
+	body, _ := json.Marshal(creds)
+	req := httptest.NewRequest("POST", "/login", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	loginHandler(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "Account is suspended")
+}
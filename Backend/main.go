@@ -2,11 +2,13 @@ package main
 
 import (
 	"UFMarketPlace/utils"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq" // PostgreSQL driver
 	"github.com/rs/cors"
@@ -23,6 +25,20 @@ type Config struct {
         Password string `json:"password"`
 		Sender  string `json:"sender"`
     } `json:"smtp"`
+	Listings struct {
+		ExpiryDays         int `json:"expiryDays"`
+		ExpiryCheckMinutes int `json:"expiryCheckMinutes"`
+		PriceDropPercent   int `json:"priceDropPercent"`
+		OfferExpiryHours   int `json:"offerExpiryHours"`
+	} `json:"listings"`
+	Moderation struct {
+		ReportAutoHideThreshold  int     `json:"reportAutoHideThreshold"`
+		ContentRulesFile         string  `json:"contentRulesFile"`
+		ListingsPerHour          int     `json:"listingsPerHour"`
+		ListingsPerDay           int     `json:"listingsPerDay"`
+		DuplicateAction          string  `json:"duplicateAction"`
+		DuplicateTitleSimilarity float64 `json:"duplicateTitleSimilarity"`
+	} `json:"moderation"`
 }
 
 var appConfig Config
@@ -83,18 +99,192 @@ func main() {
 		log.Fatalf("Failed to initialize listings database: %v", err)
 	}
 
+	if err := initAdminDB(); err != nil {
+		log.Fatalf("Failed to initialize admin flag: %v", err)
+	}
+
+	if err := initCategoriesDB(); err != nil {
+		log.Fatalf("Failed to initialize categories: %v", err)
+	}
+
+	if err := initListingAttributesDB(); err != nil {
+		log.Fatalf("Failed to initialize listing attributes: %v", err)
+	}
+
+	if err := initListingTermsDB(); err != nil {
+		log.Fatalf("Failed to initialize listing terms: %v", err)
+	}
+
+	if err := initListingStatusDB(); err != nil {
+		log.Fatalf("Failed to initialize listing status tables: %v", err)
+	}
+
+	if appConfig.Listings.ExpiryDays > 0 {
+		listingExpiry = time.Duration(appConfig.Listings.ExpiryDays) * 24 * time.Hour
+	}
+	if err := initListingExpiryDB(); err != nil {
+		log.Fatalf("Failed to initialize listing expiry: %v", err)
+	}
+
+	if err := initFavoritesDB(); err != nil {
+		log.Fatalf("Failed to initialize favorites: %v", err)
+	}
+
+	if err := initNotificationsDB(); err != nil {
+		log.Fatalf("Failed to initialize notifications: %v", err)
+	}
+
+	// Push events to WebSocket clients connected to any instance.
+	if err := initRealtimeDB(); err != nil {
+		log.Fatalf("Failed to initialize realtime events: %v", err)
+	}
+	go listenRealtimeEvents(connStr)
+	go runPeriodicJob(context.Background(), "Realtime event cleanup", realtimeCleanupInterval, deleteOldRealtimeEvents)
+	if err := initListingEventsDB(); err != nil {
+		log.Fatalf("Failed to initialize listing events: %v", err)
+	}
+	go runPeriodicJob(context.Background(), "Listing event cleanup", realtimeCleanupInterval, deleteOldListingEvents)
+
+	// Keep price history and alert favoriters about price drops.
+	if appConfig.Listings.PriceDropPercent > 0 {
+		priceDropPercent = appConfig.Listings.PriceDropPercent
+	}
+	if err := initListingPriceHistoryDB(); err != nil {
+		log.Fatalf("Failed to initialize listing price history: %v", err)
+	}
+
+	// Expire stale listings in the background.
+	expiryInterval := defaultExpiryCheckInterval
+	if appConfig.Listings.ExpiryCheckMinutes > 0 {
+		expiryInterval = time.Duration(appConfig.Listings.ExpiryCheckMinutes) * time.Minute
+	}
+	go runPeriodicJob(context.Background(), "Listing expiry", expiryInterval, expireListings)
+
+	// Publish scheduled drafts once their publish time arrives.
+	if err := initListingDraftsDB(); err != nil {
+		log.Fatalf("Failed to initialize listing drafts: %v", err)
+	}
+	go runPeriodicJob(context.Background(), "Scheduled publishing", publishCheckInterval, publishScheduledListings)
+
+	// Alert users about listings matching their saved searches.
+	if err := initSavedSearchesDB(); err != nil {
+		log.Fatalf("Failed to initialize saved searches: %v", err)
+	}
+	go runPeriodicJob(context.Background(), "Saved search digest", savedSearchDigestInterval, sendSavedSearchDigests)
+
+	// Buyers and sellers talk through in-app conversations.
+	if err := initBlocksDB(); err != nil {
+		log.Fatalf("Failed to initialize blocks: %v", err)
+	}
+	if err := initConversationsDB(); err != nil {
+		log.Fatalf("Failed to initialize conversations: %v", err)
+	}
+
+	// Buyers haggle through offers, which expire if left unanswered.
+	if appConfig.Listings.OfferExpiryHours > 0 {
+		offerExpiry = time.Duration(appConfig.Listings.OfferExpiryHours) * time.Hour
+	}
+	if err := initOffersDB(); err != nil {
+		log.Fatalf("Failed to initialize offers: %v", err)
+	}
+	go runPeriodicJob(context.Background(), "Offer expiry", offerExpiryCheckInterval, expireOffers)
+
+	// Sales are recorded by the seller and confirmed by the buyer.
+	if err := initTransactionsDB(); err != nil {
+		log.Fatalf("Failed to initialize transactions: %v", err)
+	}
+	if err := initReviewsDB(); err != nil {
+		log.Fatalf("Failed to initialize reviews: %v", err)
+	}
+
+	// Users report listings and users to moderators, and enough reports hide
+	// a listing until it is reviewed.
+	if appConfig.Moderation.ReportAutoHideThreshold > 0 {
+		reportAutoHideThreshold = appConfig.Moderation.ReportAutoHideThreshold
+	}
+	if err := initModerationDB(); err != nil {
+		log.Fatalf("Failed to initialize moderation: %v", err)
+	}
+
+	// Screen new and edited listings against the prohibited content rules.
+	if path := appConfig.Moderation.ContentRulesFile; path != "" {
+		if contentRules, err = loadContentRules(path); err != nil {
+			log.Fatalf("Failed to load content rules: %v", err)
+		}
+	}
+
+	// Limit how fast users post and catch reposts of their own listings.
+	if appConfig.Moderation.ListingsPerHour > 0 {
+		postingLimits[0].max = appConfig.Moderation.ListingsPerHour
+	}
+	if appConfig.Moderation.ListingsPerDay > 0 {
+		postingLimits[1].max = appConfig.Moderation.ListingsPerDay
+	}
+	switch a := appConfig.Moderation.DuplicateAction; a {
+	case "":
+	case duplicateBlock, duplicateMerge, duplicateFlag:
+		duplicateAction = a
+	default:
+		log.Fatalf("Invalid duplicateAction %q: must be block, merge or flag", a)
+	}
+	if s := appConfig.Moderation.DuplicateTitleSimilarity; s > 0 {
+		duplicateTitleSimilarity = s
+	}
+	if err := initDuplicatesDB(); err != nil {
+		log.Fatalf("Failed to initialize duplicate detection: %v", err)
+	}
+
+	// Strip EXIF metadata from images uploaded before renditions existed.
+	go func() {
+		if n, err := reprocessLegacyImages(context.Background()); err != nil {
+			log.Printf("Legacy image reprocessing failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Reprocessed %d legacy images", n)
+		}
+	}()
+
 	// Set up HTTP routes.
 	router := http.NewServeMux()
 	router.HandleFunc("/signup", signupHandler)
 	router.HandleFunc("/login", loginHandler)
 	router.HandleFunc("/deleteUser", ValidateSessionMiddleware(deleteUserHandler))
 	router.HandleFunc("/listings", listingsHandler)              // GET (all listings except current user) & POST (create new listing)
+	router.HandleFunc("/listings/stream", listingStreamHandler)  // GET (Server-Sent Events of created, updated, sold and deleted listings)
 	router.HandleFunc("/listings/user", ValidateSessionMiddleware(userListingsHandler))       // GET (listings for current user)
 	router.HandleFunc("/listing/updateListing", editListingHandler)   // PUT (edit listing)
 	router.HandleFunc("/listing/deleteListing", deleteListingHandler) // DELETE (delete listing)
+	router.HandleFunc("/listing/images", ValidateSessionMiddleware(listingImagesHandler))            // POST (add images) & DELETE (remove one image)
+	router.HandleFunc("/listing/images/order", ValidateSessionMiddleware(listingImageOrderHandler))  // PUT (set image display order)
+	router.HandleFunc("/listing/images/cover", ValidateSessionMiddleware(listingCoverImageHandler))  // PUT (set cover image)
+	router.HandleFunc("/listing/status", ValidateSessionMiddleware(listingStatusHandler))                // POST (change listing status)
+	router.HandleFunc("/listing/status/history", ValidateSessionMiddleware(listingStatusHistoryHandler)) // GET (listing status transitions)
+	router.HandleFunc("/listing/renew", ValidateSessionMiddleware(renewListingHandler))                  // POST (renew listing for another expiry period)
+	router.HandleFunc("/listing/schedule", ValidateSessionMiddleware(scheduleListingHandler))            // PUT (schedule or unschedule a draft)
+	router.HandleFunc("/favorites", ValidateSessionMiddleware(favoritesHandler))                // GET (list), POST (add) & DELETE (remove) favorites
+	router.HandleFunc("/savedSearches", ValidateSessionMiddleware(savedSearchesHandler))        // GET (list), POST (save) & DELETE (remove) saved searches
+	router.HandleFunc("/notifications", ValidateSessionMiddleware(notificationsHandler))        // GET (in-app notifications)
+	router.HandleFunc("/notifications/read", ValidateSessionMiddleware(markNotificationsReadHandler)) // POST (mark notifications read)
+	router.HandleFunc("/conversations", ValidateSessionMiddleware(conversationsHandler))        // GET (inbox) & POST (message a listing's seller)
+	router.HandleFunc("/conversations/messages", ValidateSessionMiddleware(conversationMessagesHandler)) // GET (read conversation) & POST (reply)
+	router.HandleFunc("/blocks", ValidateSessionMiddleware(blocksHandler))                      // GET (list), POST (block or mute) & DELETE (unblock or unmute) users
+	router.HandleFunc("/offers", ValidateSessionMiddleware(offersHandler))                      // GET (offers made and received) & POST (make an offer)
+	router.HandleFunc("/offers/respond", ValidateSessionMiddleware(offerResponseHandler))       // POST (accept, decline, counter or withdraw an offer)
+	router.HandleFunc("/transactions", ValidateSessionMiddleware(transactionsHandler))          // GET (purchase and sales history) & POST (mark a listing sold to a buyer)
+	router.HandleFunc("/transactions/respond", ValidateSessionMiddleware(transactionResponseHandler)) // POST (buyer confirms or declines a sale)
+	router.HandleFunc("/reviews", ValidateSessionMiddleware(reviewsHandler))                    // GET (reviews a user received) & POST (review a confirmed transaction)
+	router.HandleFunc("/users/profile", ValidateSessionMiddleware(userProfileHandler))          // GET (public profile with seller and buyer ratings)
+	router.HandleFunc("/ws", realtimeHandler)                                                   // GET (WebSocket of messages, notifications and status changes)
+	router.HandleFunc("/categories", categoriesHandler)                                         // GET (category tree with listing counts)
+	router.HandleFunc("/admin/categories", ValidateSessionMiddleware(adminCategoriesHandler)) // POST (create), PUT (replace) & DELETE (delete) category
+	router.HandleFunc("/reports", ValidateSessionMiddleware(reportsHandler))                    // POST (report a listing or a user)
+	router.HandleFunc("/moderation/reports", ValidateSessionMiddleware(moderationReportsHandler))          // GET (moderation queue)
+	router.HandleFunc("/moderation/reports/claim", ValidateSessionMiddleware(claimReportHandler))          // POST (claim a report)
+	router.HandleFunc("/moderation/reports/resolve", ValidateSessionMiddleware(resolveReportHandler))      // POST (dismiss, hide the listing or suspend the user)
+	router.HandleFunc("/moderation/audit", ValidateSessionMiddleware(moderationAuditHandler))              // GET (moderation audit trail)
 	router.HandleFunc("/sendEmailVerificationCode", sendVerificationCodeHandler)
 	router.HandleFunc("/verifyEmailVerificationCode", verifyCodeHandler)
-	// router.HandleFunc("/image", imageHandler)                  // GET (serve image)
+	router.HandleFunc("/listing", ValidateSessionMiddleware(listingDetailHandler)) // GET (single listing with medium images)
+	router.HandleFunc("/image", imageHandler)                          // GET (serve image rendition)
 
 	handler := c.Handler(router)
 
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ReportReason is why a user reported a listing or another user.
+type ReportReason string
+
+const (
+	ReasonScam           ReportReason = "scam"
+	ReasonProhibitedItem ReportReason = "prohibited_item"
+	ReasonCounterfeit    ReportReason = "counterfeit"
+	ReasonHarassment     ReportReason = "harassment"
+	ReasonSpam           ReportReason = "spam"
+	ReasonOther          ReportReason = "other"
+)
+
+// reportReasons are the reason codes a report may give.
+var reportReasons = map[ReportReason]bool{
+	ReasonScam:           true,
+	ReasonProhibitedItem: true,
+	ReasonCounterfeit:    true,
+	ReasonHarassment:     true,
+	ReasonSpam:           true,
+	ReasonOther:          true,
+}
+
+// ReportStatus is a state of a report in the moderation queue. A moderator
+// claims an open report before resolving it.
+type ReportStatus string
+
+const (
+	ReportOpen     ReportStatus = "open"
+	ReportClaimed  ReportStatus = "claimed"
+	ReportResolved ReportStatus = "resolved"
+)
+
+// Actions a moderator may resolve a report with.
+const (
+	moderationDismiss     = "dismiss"
+	moderationHideListing = "hide_listing"
+	moderationSuspendUser = "suspend_user"
+)
+
+// Further actions recorded in the audit trail. Automatic actions have no
+// moderator.
+const (
+	auditClaim          = "claim"
+	auditAutoHide       = "auto_hide"
+	auditRestoreListing = "restore_listing"
+)
+
+// Defaults for moderation, overridable through "reportAutoHideThreshold" in
+// the "moderation" section of config.json.
+const (
+	defaultReportAutoHideThreshold = 3
+	// maxReportDetails is the longest report explanation accepted, in
+	// characters.
+	maxReportDetails = 1000
+	// moderationAuditPageSize is how many audit entries one request returns.
+	moderationAuditPageSize = 200
+)
+
+// reportAutoHideThreshold is how many different users must have a pending
+// report against a listing before it is hidden until a moderator looks at it.
+var reportAutoHideThreshold = defaultReportAutoHideThreshold
+
+var errReportNotFound = &requestError{status: http.StatusNotFound, message: "Report not found"}
+
+// Report flags a listing, or a user directly, for moderation. ReportedUserID
+// is the seller for listing reports. ReporterID is nil for listings flagged
+// by the content rules.
+type Report struct {
+	ID             int          `json:"id"`
+	ReporterID     *int         `json:"reporterId"`
+	ListingID      *int         `json:"listingId"`
+	ProductName    *string      `json:"productName,omitempty"`
+	ReportedUserID int          `json:"reportedUserId"`
+	Reason         ReportReason `json:"reason"`
+	Details        string       `json:"details"`
+	Status         ReportStatus `json:"status"`
+	ClaimedBy      *int         `json:"claimedBy,omitempty"`
+	ClaimedAt      *time.Time   `json:"claimedAt,omitempty"`
+	Resolution     *string      `json:"resolution,omitempty"`
+	ResolvedBy     *int         `json:"resolvedBy,omitempty"`
+	ResolvedAt     *time.Time   `json:"resolvedAt,omitempty"`
+	CreatedAt      time.Time    `json:"createdAt"`
+}
+
+// ReportRequest reports either a listing or a user.
+type ReportRequest struct {
+	ListingID *int         `json:"listingId"`
+	UserID    *int         `json:"userId"`
+	Reason    ReportReason `json:"reason"`
+	Details   string       `json:"details"`
+}
+
+// ClaimReportRequest identifies the report a moderator takes on.
+type ClaimReportRequest struct {
+	ReportID int `json:"reportId"`
+}
+
+// ResolveReportRequest closes a claimed report with one of the moderation
+// actions.
+type ResolveReportRequest struct {
+	ReportID int    `json:"reportId"`
+	Action   string `json:"action"`
+	Note     string `json:"note"`
+}
+
+// ModerationAuditEntry is one recorded moderation action. ModeratorID is nil
+// for automatic actions.
+type ModerationAuditEntry struct {
+	ID          int       `json:"id"`
+	ReportID    *int      `json:"reportId"`
+	ModeratorID *int      `json:"moderatorId"`
+	Action      string    `json:"action"`
+	ListingID   *int      `json:"listingId"`
+	UserID      *int      `json:"userId"`
+	Note        string    `json:"note"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// initModerationDB creates the reports and audit tables and adds the columns
+// hiding listings and suspending users. hidden_by is null when a listing was
+// hidden automatically by reports.
+func initModerationDB() error {
+	moderationColumns := `
+	ALTER TABLE listings
+		ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS hidden_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMPTZ;`
+	if _, err := db.Exec(moderationColumns); err != nil {
+		return fmt.Errorf("error adding moderation columns: %v", err)
+	}
+
+	// A user has at most one pending report against each listing or user.
+	// reporter_id is null for reports raised by the content rules.
+	reportsTable := `
+	CREATE TABLE IF NOT EXISTS reports (
+		id SERIAL PRIMARY KEY,
+		reporter_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		listing_id INTEGER REFERENCES listings(id) ON DELETE CASCADE,
+		reported_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		reason TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'claimed', 'resolved')),
+		claimed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		claimed_at TIMESTAMPTZ,
+		resolution TEXT,
+		resolved_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		resolved_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS reports_pending_listing_idx ON reports(reporter_id, listing_id)
+		WHERE status <> 'resolved' AND listing_id IS NOT NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS reports_pending_user_idx ON reports(reporter_id, reported_user_id)
+		WHERE status <> 'resolved' AND listing_id IS NULL;
+	CREATE INDEX IF NOT EXISTS reports_status_idx ON reports(status, created_at);`
+	if _, err := db.Exec(reportsTable); err != nil {
+		return fmt.Errorf("error creating reports table: %v", err)
+	}
+
+	auditTable := `
+	CREATE TABLE IF NOT EXISTS moderation_audit (
+		id SERIAL PRIMARY KEY,
+		report_id INTEGER REFERENCES reports(id) ON DELETE SET NULL,
+		moderator_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		action TEXT NOT NULL,
+		listing_id INTEGER,
+		user_id INTEGER,
+		note TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS moderation_audit_created_at_idx ON moderation_audit(created_at DESC);`
+	if _, err := db.Exec(auditTable); err != nil {
+		return fmt.Errorf("error creating moderation_audit table: %v", err)
+	}
+	return nil
+}
+
+// IsUserSuspended reports whether a moderator has suspended the user.
+var IsUserSuspended = func(userID int) (bool, error) {
+	var suspended bool
+	err := db.QueryRow("SELECT suspended_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&suspended)
+	return suspended, err
+}
+
+// recordModeration appends an entry to the audit trail.
+func recordModeration(ctx context.Context, exec sqlExecutor, e ModerationAuditEntry) error {
+	_, err := exec.ExecContext(ctx,
+		"INSERT INTO moderation_audit(report_id, moderator_id, action, listing_id, user_id, note, created_at) VALUES($1, $2, $3, $4, $5, $6, $7)",
+		e.ReportID, e.ModeratorID, e.Action, e.ListingID, e.UserID, e.Note, time.Now(),
+	)
+	return err
+}
+
+// hideListing takes a listing out of the feed and tells stream subscribers
+// it is gone. moderatorID is nil when it is hidden automatically.
+func hideListing(ctx context.Context, tx *sql.Tx, listingID int, moderatorID *int) error {
+	// Hidden listings are not streamed, so the event goes out first.
+	if err := publishListingEvent(ctx, tx, listingID, listingDeleted); err != nil {
+		return err
+	}
+	return markListingHidden(ctx, tx, listingID, moderatorID)
+}
+
+// markListingHidden sets the hidden columns of a listing. A listing hidden by
+// a moderator stays theirs when it is hidden again automatically.
+func markListingHidden(ctx context.Context, tx *sql.Tx, listingID int, moderatorID *int) error {
+	_, err := tx.ExecContext(ctx,
+		"UPDATE listings SET hidden_at = COALESCE(hidden_at, $1), hidden_by = COALESCE($2, hidden_by) WHERE id = $3",
+		time.Now(), moderatorID, listingID,
+	)
+	return err
+}
+
+// restoreAutoHiddenListing returns a listing hidden by reports to the feed
+// once no report against it is pending. Listings hidden by a moderator stay
+// hidden. It reports whether the listing was restored.
+func restoreAutoHiddenListing(ctx context.Context, tx *sql.Tx, listingID int) (bool, error) {
+	result, err := tx.ExecContext(ctx,
+		"UPDATE listings SET hidden_at = NULL WHERE id = $1 AND hidden_at IS NOT NULL AND hidden_by IS NULL "+
+			"AND NOT EXISTS(SELECT 1 FROM reports WHERE listing_id = $1 AND status <> $2)",
+		listingID, ReportResolved,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, publishListingEvent(ctx, tx, listingID, listingUpdated)
+}
+
+// suspendUser stops a user from logging in, ends their sessions and hides all
+// their listings.
+func suspendUser(ctx context.Context, tx *sql.Tx, userID, moderatorID int) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET suspended_at = COALESCE(suspended_at, $1) WHERE id = $2", time.Now(), userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	// Listings already hidden by reports are taken over by the moderator so
+	// that dismissing those reports does not bring them back.
+	rows, err := tx.QueryContext(ctx,
+		"SELECT id FROM listings WHERE user_id = $1 AND (hidden_at IS NULL OR hidden_by IS NULL) FOR UPDATE", userID,
+	)
+	if err != nil {
+		return err
+	}
+	var listingIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		listingIDs = append(listingIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range listingIDs {
+		if err := hideListing(ctx, tx, id, &moderatorID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportsHandler handles POST requests to report a listing or a user.
+// Reporting a listing hides it once reportAutoHideThreshold different users
+// have pending reports against it.
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req ReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if (req.ListingID == nil) == (req.UserID == nil) {
+		http.Error(w, "Report either a listingId or a userId", http.StatusBadRequest)
+		return
+	}
+	if !reportReasons[req.Reason] {
+		http.Error(w, "Invalid reason", http.StatusBadRequest)
+		return
+	}
+	req.Details = strings.TrimSpace(req.Details)
+	if utf8.RuneCountInString(req.Details) > maxReportDetails {
+		http.Error(w, fmt.Sprintf("Details are too long: at most %d characters", maxReportDetails), http.StatusBadRequest)
+		return
+	}
+
+	rep := Report{ReporterID: &currentUserID, ListingID: req.ListingID, Reason: req.Reason, Details: req.Details, Status: ReportOpen}
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		hidden := true
+		if req.ListingID != nil {
+			// Locking the listing serializes reports so that it is hidden
+			// exactly once.
+			err := tx.QueryRowContext(r.Context(),
+				"SELECT user_id, hidden_at IS NOT NULL FROM listings WHERE id = $1 FOR UPDATE", *req.ListingID,
+			).Scan(&rep.ReportedUserID, &hidden)
+			if err == sql.ErrNoRows {
+				return errListingNotFound
+			}
+			if err != nil {
+				return err
+			}
+			if rep.ReportedUserID == currentUserID {
+				return badRequest("You cannot report your own listing")
+			}
+		} else {
+			if *req.UserID == currentUserID {
+				return badRequest("You cannot report yourself")
+			}
+			var exists bool
+			if err := tx.QueryRowContext(r.Context(), "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", *req.UserID).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return &requestError{status: http.StatusNotFound, message: "User not found"}
+			}
+			rep.ReportedUserID = *req.UserID
+		}
+
+		rep.CreatedAt = time.Now()
+		err := tx.QueryRowContext(r.Context(),
+			"INSERT INTO reports(reporter_id, listing_id, reported_user_id, reason, details, created_at) VALUES($1, $2, $3, $4, $5, $6) RETURNING id",
+			currentUserID, rep.ListingID, rep.ReportedUserID, rep.Reason, rep.Details, rep.CreatedAt,
+		).Scan(&rep.ID)
+		if isUniqueViolation(err) {
+			return &requestError{status: http.StatusConflict, message: "You have already reported this and it is awaiting review"}
+		}
+		if err != nil || hidden {
+			return err
+		}
+
+		var reporters int
+		err = tx.QueryRowContext(r.Context(),
+			"SELECT COUNT(DISTINCT reporter_id) FROM reports WHERE listing_id = $1 AND status <> $2",
+			*req.ListingID, ReportResolved,
+		).Scan(&reporters)
+		if err != nil || reporters < reportAutoHideThreshold {
+			return err
+		}
+		if err := hideListing(r.Context(), tx, *req.ListingID, nil); err != nil {
+			return err
+		}
+		return recordModeration(r.Context(), tx, ModerationAuditEntry{
+			ReportID:  &rep.ID,
+			Action:    auditAutoHide,
+			ListingID: req.ListingID,
+			UserID:    &rep.ReportedUserID,
+			Note:      fmt.Sprintf("Hidden after reports from %d users", reporters),
+		})
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rep)
+}
+
+// moderationReportsHandler handles GET requests for the moderation queue,
+// oldest first. Pending (open and claimed) reports are listed unless ?status=
+// asks for another state; ?reason= keeps only one reason code.
+func moderationReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	where := &whereBuilder{}
+	switch status := ReportStatus(r.URL.Query().Get("status")); status {
+	case "":
+		where.add("r.status <> $%d", ReportResolved)
+	case ReportOpen, ReportClaimed, ReportResolved:
+		where.add("r.status = $%d", status)
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	if reason := ReportReason(r.URL.Query().Get("reason")); reason != "" {
+		if !reportReasons[reason] {
+			http.Error(w, "Invalid reason", http.StatusBadRequest)
+			return
+		}
+		where.add("r.reason = $%d", reason)
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT r.id, r.reporter_id, r.listing_id, l.product_name, r.reported_user_id, r.reason, r.details, r.status, "+
+			"r.claimed_by, r.claimed_at, r.resolution, r.resolved_by, r.resolved_at, r.created_at "+
+			"FROM reports r LEFT JOIN listings l ON l.id = r.listing_id "+where.clause()+" ORDER BY r.created_at, r.id",
+		where.args...,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		var rep Report
+		if err := rows.Scan(&rep.ID, &rep.ReporterID, &rep.ListingID, &rep.ProductName, &rep.ReportedUserID, &rep.Reason,
+			&rep.Details, &rep.Status, &rep.ClaimedBy, &rep.ClaimedAt, &rep.Resolution, &rep.ResolvedBy,
+			&rep.ResolvedAt, &rep.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reports = append(reports, rep)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// claimReportHandler handles POST requests by a moderator to take on an open
+// report. Claiming a report one already holds is a no-op.
+func claimReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	moderatorID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req ClaimReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		var status ReportStatus
+		var claimedBy *int
+		err := tx.QueryRowContext(r.Context(),
+			"SELECT status, claimed_by FROM reports WHERE id = $1 FOR UPDATE", req.ReportID,
+		).Scan(&status, &claimedBy)
+		if err == sql.ErrNoRows {
+			return errReportNotFound
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case status == ReportResolved:
+			return &requestError{status: http.StatusConflict, message: "Report is already resolved"}
+		case status == ReportClaimed && claimedBy != nil && *claimedBy == moderatorID:
+			return nil
+		case status == ReportClaimed:
+			return &requestError{status: http.StatusConflict, message: "Report is claimed by another moderator"}
+		}
+
+		if _, err := tx.ExecContext(r.Context(),
+			"UPDATE reports SET status = $1, claimed_by = $2, claimed_at = $3 WHERE id = $4",
+			ReportClaimed, moderatorID, time.Now(), req.ReportID,
+		); err != nil {
+			return err
+		}
+		return recordModeration(r.Context(), tx, ModerationAuditEntry{ReportID: &req.ReportID, ModeratorID: &moderatorID, Action: auditClaim})
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"reportId": req.ReportID, "status": ReportClaimed})
+}
+
+// resolveReportHandler handles POST requests by the moderator holding a
+// report to close it. Dismissing the last pending report against a listing
+// hidden by reports puts it back in the feed.
+func resolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	moderatorID, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req ResolveReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	switch req.Action {
+	case moderationDismiss, moderationHideListing, moderationSuspendUser:
+	default:
+		http.Error(w, "Invalid action: must be dismiss, hide_listing or suspend_user", http.StatusBadRequest)
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		var status ReportStatus
+		var claimedBy, listingID *int
+		var reportedUserID int
+		err := tx.QueryRowContext(r.Context(),
+			"SELECT status, claimed_by, listing_id, reported_user_id FROM reports WHERE id = $1 FOR UPDATE", req.ReportID,
+		).Scan(&status, &claimedBy, &listingID, &reportedUserID)
+		if err == sql.ErrNoRows {
+			return errReportNotFound
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case status == ReportResolved:
+			return &requestError{status: http.StatusConflict, message: "Report is already resolved"}
+		case status == ReportOpen:
+			return &requestError{status: http.StatusConflict, message: "Claim the report before resolving it"}
+		case claimedBy == nil || *claimedBy != moderatorID:
+			return &requestError{status: http.StatusConflict, message: "Report is claimed by another moderator"}
+		}
+
+		switch req.Action {
+		case moderationHideListing:
+			if listingID == nil {
+				return badRequest("Only listing reports can hide a listing")
+			}
+			err = hideListing(r.Context(), tx, *listingID, &moderatorID)
+		case moderationSuspendUser:
+			err = suspendUser(r.Context(), tx, reportedUserID, moderatorID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(r.Context(),
+			"UPDATE reports SET status = $1, resolution = $2, resolved_by = $3, resolved_at = $4 WHERE id = $5",
+			ReportResolved, req.Action, moderatorID, time.Now(), req.ReportID,
+		); err != nil {
+			return err
+		}
+		entry := ModerationAuditEntry{
+			ReportID:    &req.ReportID,
+			ModeratorID: &moderatorID,
+			Action:      req.Action,
+			ListingID:   listingID,
+			UserID:      &reportedUserID,
+			Note:        req.Note,
+		}
+		if err := recordModeration(r.Context(), tx, entry); err != nil {
+			return err
+		}
+
+		if req.Action != moderationDismiss || listingID == nil {
+			return nil
+		}
+		restored, err := restoreAutoHiddenListing(r.Context(), tx, *listingID)
+		if err != nil || !restored {
+			return err
+		}
+		entry.Action, entry.Note = auditRestoreListing, ""
+		return recordModeration(r.Context(), tx, entry)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"reportId": req.ReportID, "status": ReportResolved, "resolution": req.Action})
+}
+
+// moderationAuditHandler handles GET requests for the moderation audit
+// trail, newest first. ?reportId=, ?listingId= and ?userId= narrow it down.
+func moderationAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	where := &whereBuilder{}
+	for _, f := range []struct{ param, column string }{
+		{"reportId", "report_id"}, {"listingId", "listing_id"}, {"userId", "user_id"},
+	} {
+		v := r.URL.Query().Get(f.param)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid "+f.param, http.StatusBadRequest)
+			return
+		}
+		where.add(f.column+" = $%d", id)
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT id, report_id, moderator_id, action, listing_id, user_id, note, created_at FROM moderation_audit "+
+			where.clause()+fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT %d", moderationAuditPageSize),
+		where.args...,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []ModerationAuditEntry{}
+	for rows.Next() {
+		var e ModerationAuditEntry
+		if err := rows.Scan(&e.ID, &e.ReportID, &e.ModeratorID, &e.Action, &e.ListingID, &e.UserID, &e.Note, &e.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
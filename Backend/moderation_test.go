@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectReportedListing queues the lock of listing 7, owned by user 2.
+func expectReportedListing(mock sqlmock.Sqlmock, hidden bool) {
+	mock.ExpectQuery("SELECT user_id, hidden_at IS NOT NULL FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "hidden"}).AddRow(2, hidden))
+}
+
+// expectHideListing queues hiding listing 7.
+func expectHideListing(mock sqlmock.Sqlmock, moderatorID interface{}) {
+	expectListingEvent(mock, 7, StatusActive, listingDeleted)
+	mock.ExpectExec("UPDATE listings SET hidden_at = COALESCE\\(hidden_at, \\$1\\), hidden_by = COALESCE\\(\\$2, hidden_by\\) WHERE id = \\$3").
+		WithArgs(sqlmock.AnyArg(), moderatorID, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectAudit queues one entry of the moderation audit trail.
+func expectAudit(mock sqlmock.Sqlmock, moderatorID interface{}, action string) {
+	mock.ExpectExec("INSERT INTO moderation_audit").
+		WithArgs(sqlmock.AnyArg(), moderatorID, action, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectReportLock queues the lock of report 5, reported against listing 7
+// of user 2.
+func expectReportLock(mock sqlmock.Sqlmock, status ReportStatus, claimedBy interface{}) {
+	mock.ExpectQuery("SELECT status, claimed_by, listing_id, reported_user_id FROM reports WHERE id = \\$1 FOR UPDATE").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "claimed_by", "listing_id", "reported_user_id"}).AddRow(status, claimedBy, 7, 2))
+}
+
+func TestReportsHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Listing Report Below Threshold",
+			body: `{"listingId":7,"reason":"scam","details":" Asks for a deposit "}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectReportedListing(mock, false)
+				mock.ExpectQuery("INSERT INTO reports").
+					WithArgs(1, 7, 2, ReasonScam, "Asks for a deposit", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+				mock.ExpectQuery("SELECT COUNT\\(DISTINCT reporter_id\\) FROM reports WHERE listing_id = \\$1 AND status <> \\$2").
+					WithArgs(7, ReportResolved).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(reportAutoHideThreshold - 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Threshold Reached Hides Listing",
+			body: `{"listingId":7,"reason":"prohibited_item"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectReportedListing(mock, false)
+				mock.ExpectQuery("INSERT INTO reports").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+				mock.ExpectQuery("SELECT COUNT\\(DISTINCT reporter_id\\) FROM reports").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(reportAutoHideThreshold))
+				expectHideListing(mock, nil)
+				expectAudit(mock, nil, auditAutoHide)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Already Hidden",
+			body: `{"listingId":7,"reason":"spam"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectReportedListing(mock, true)
+				mock.ExpectQuery("INSERT INTO reports").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "User Report",
+			body: `{"userId":2,"reason":"harassment"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM users WHERE id = \\$1\\)").
+					WithArgs(2).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectQuery("INSERT INTO reports").
+					WithArgs(1, nil, 2, ReasonHarassment, "", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(6))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Already Reported",
+			body: `{"listingId":7,"reason":"scam"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectReportedListing(mock, false)
+				mock.ExpectQuery("INSERT INTO reports").
+					WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Own Listing",
+			body: `{"listingId":7,"reason":"scam"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, hidden_at IS NOT NULL FROM listings").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "hidden"}).AddRow(1, false))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Listing And User",
+			body:           `{"listingId":7,"userId":2,"reason":"scam"}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown Reason",
+			body:           `{"listingId":7,"reason":"ugly"}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/reports", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			reportsHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestClaimReportHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Claim Open Report",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT status, claimed_by FROM reports WHERE id = \\$1 FOR UPDATE").
+					WithArgs(5).
+					WillReturnRows(sqlmock.NewRows([]string{"status", "claimed_by"}).AddRow(ReportOpen, nil))
+				mock.ExpectExec("UPDATE reports SET status = \\$1, claimed_by = \\$2, claimed_at = \\$3 WHERE id = \\$4").
+					WithArgs(ReportClaimed, 1, sqlmock.AnyArg(), 5).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectAudit(mock, 1, auditClaim)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Claimed By Another Moderator",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT status, claimed_by FROM reports").
+					WillReturnRows(sqlmock.NewRows([]string{"status", "claimed_by"}).AddRow(ReportClaimed, 3))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Not A Moderator",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, false)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/moderation/reports/claim", bytes.NewBufferString(`{"reportId":5}`))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			claimReportHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestResolveReportHandler(t *testing.T) {
+	expectResolved := func(mock sqlmock.Sqlmock, action string) {
+		mock.ExpectExec("UPDATE reports SET status = \\$1, resolution = \\$2, resolved_by = \\$3, resolved_at = \\$4 WHERE id = \\$5").
+			WithArgs(ReportResolved, action, 1, sqlmock.AnyArg(), 5).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectAudit(mock, 1, action)
+	}
+
+	tests := []struct {
+		name           string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Dismiss Restores Auto-Hidden Listing",
+			body: `{"reportId":5,"action":"dismiss","note":"Legitimate seller"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+				mock.ExpectBegin()
+				expectReportLock(mock, ReportClaimed, 1)
+				expectResolved(mock, moderationDismiss)
+				mock.ExpectExec("UPDATE listings SET hidden_at = NULL WHERE id = \\$1 AND hidden_at IS NOT NULL AND hidden_by IS NULL").
+					WithArgs(7, ReportResolved).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectListingEvent(mock, 7, StatusActive, listingUpdated)
+				expectAudit(mock, 1, auditRestoreListing)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Dismiss With Reports Pending",
+			body: `{"reportId":5,"action":"dismiss"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+				mock.ExpectBegin()
+				expectReportLock(mock, ReportClaimed, 1)
+				expectResolved(mock, moderationDismiss)
+				mock.ExpectExec("UPDATE listings SET hidden_at = NULL").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Hide Listing",
+			body: `{"reportId":5,"action":"hide_listing"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+				mock.ExpectBegin()
+				expectReportLock(mock, ReportClaimed, 1)
+				expectHideListing(mock, 1)
+				expectResolved(mock, moderationHideListing)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Suspend User",
+			body: `{"reportId":5,"action":"suspend_user"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+				mock.ExpectBegin()
+				expectReportLock(mock, ReportClaimed, 1)
+				mock.ExpectExec("UPDATE users SET suspended_at = COALESCE\\(suspended_at, \\$1\\) WHERE id = \\$2").
+					WithArgs(sqlmock.AnyArg(), 2).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM sessions WHERE user_id = \\$1").
+					WithArgs(2).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectQuery("SELECT id FROM listings WHERE user_id = \\$1 AND \\(hidden_at IS NULL OR hidden_by IS NULL\\) FOR UPDATE").
+					WithArgs(2).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+				expectHideListing(mock, 1)
+				expectResolved(mock, moderationSuspendUser)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Not Claimed",
+			body: `{"reportId":5,"action":"dismiss"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+				mock.ExpectBegin()
+				expectReportLock(mock, ReportOpen, nil)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Unknown Action",
+			body: `{"reportId":5,"action":"ban"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectAdmin(mock, true)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/moderation/reports/resolve", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			resolveReportHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestModerationReportsHandler_PendingQueue(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	expectAdmin(mock, true)
+	mock.ExpectQuery("FROM reports r LEFT JOIN listings l ON l.id = r.listing_id WHERE r.status <> \\$1 AND r.reason = \\$2 ORDER BY r.created_at, r.id").
+		WithArgs(ReportResolved, ReasonScam).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "reporter_id", "listing_id", "product_name", "reported_user_id", "reason", "details",
+			"status", "claimed_by", "claimed_at", "resolution", "resolved_by", "resolved_at", "created_at"}).
+			AddRow(5, 3, 7, "Desk Lamp", 2, "scam", "", "open", nil, nil, nil, nil, nil, now))
+
+	req := httptest.NewRequest(http.MethodGet, "/moderation/reports?reason=scam", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	moderationReportsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reports []Report
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reports))
+	if assert.Len(t, reports, 1) {
+		assert.Equal(t, "Desk Lamp", *reports[0].ProductName)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestFeedFilter_ExcludesHiddenListings(t *testing.T) {
+	where, err := feedFilter(context.Background(), 1, url.Values{})
+	assert.NoError(t, err)
+	assert.Contains(t, where.clause(), "l.hidden_at IS NULL")
+}
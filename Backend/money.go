@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in integer cents. It is stored as BIGINT and encoded in
+// JSON as a decimal string such as "19.99", so amounts never pass through
+// float64.
+type Money int64
+
+// maxMoney is the largest amount accepted from clients: $100,000.00.
+const maxMoney Money = 10_000_000
+
+var (
+	errMoneyFormat = errors.New("must be a plain decimal amount such as 12.50")
+	errMoneyRange  = fmt.Errorf("must be at most %s", maxMoney)
+)
+
+// moneyPattern accepts whole units with up to two decimal places. Signs,
+// exponents, separators and currency symbols are rejected.
+var moneyPattern = regexp.MustCompile(`^([0-9]{1,12})(\.([0-9]{1,2}))?$`)
+
+// ParseMoney parses a decimal amount such as "12.5" or "12.50" into cents.
+// The amount must be between zero and maxMoney.
+func ParseMoney(value string) (Money, error) {
+	m := moneyPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return 0, errMoneyFormat
+	}
+	units, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, errMoneyFormat
+	}
+	cents := int64(0)
+	if m[3] != "" {
+		frac := m[3]
+		if len(frac) == 1 {
+			frac += "0"
+		}
+		cents, _ = strconv.ParseInt(frac, 10, 64)
+	}
+	if units > int64(maxMoney)/100 {
+		return 0, errMoneyRange
+	}
+	amount := Money(units*100 + cents)
+	if amount > maxMoney {
+		return 0, errMoneyRange
+	}
+	return amount, nil
+}
+
+// String formats the amount with two decimal places.
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, m/100, m%100)
+}
+
+// MarshalJSON encodes the amount as a decimal string.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON accepts a decimal string or a bare JSON number. Numbers are
+// parsed from their literal text, not through float64.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if strings.HasPrefix(text, `"`) {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+	}
+	amount, err := ParseMoney(text)
+	if err != nil {
+		return fmt.Errorf("invalid amount %s: %v", data, err)
+	}
+	*m = amount
+	return nil
+}
+
+// Value stores the amount as cents.
+func (m Money) Value() (driver.Value, error) {
+	return int64(m), nil
+}
+
+// Scan reads an amount stored as cents.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		*m = Money(v)
+	case []byte:
+		cents, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return err
+		}
+		*m = Money(cents)
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	valid := map[string]Money{
+		"19.99":     1999,
+		"12.5":      1250,
+		"0":         0,
+		" 7 ":       700,
+		"100000.00": maxMoney,
+	}
+	for input, expected := range valid {
+		amount, err := ParseMoney(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, amount, input)
+	}
+
+	for _, input := range []string{"", "-1", "1.999", "1e3", "NaN", "Inf", "$5", "1,000", ".50", "100000.01", "99999999999999"} {
+		_, err := ParseMoney(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+	data, err := json.Marshal(struct {
+		Price Money `json:"price"`
+	}{Price: 1905})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"price":"19.05"}`, string(data))
+
+	var decoded struct {
+		A Money `json:"a"`
+		B Money `json:"b"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(`{"a":"0.10","b":19.99}`), &decoded))
+	assert.Equal(t, Money(10), decoded.A)
+	assert.Equal(t, Money(1999), decoded.B)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"a":-5}`), &decoded))
+	assert.Error(t, json.Unmarshal([]byte(`{"a":"abc"}`), &decoded))
+}
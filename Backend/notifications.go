@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Notification types.
+const (
+	notificationSavedSearch = "saved_search_match"
+)
+
+// Notification is an in-app message for a user.
+type Notification struct {
+	ID        int        `json:"id"`
+	Type      string     `json:"type"`
+	Message   string     `json:"message"`
+	ListingID *int       `json:"listingId"`
+	ReadAt    *time.Time `json:"readAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// MarkReadRequest lists the notifications to mark as read. An empty list
+// marks all of them.
+type MarkReadRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+// initNotificationsDB creates the in-app notifications table.
+func initNotificationsDB() error {
+	notificationsTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type TEXT NOT NULL,
+		message TEXT NOT NULL,
+		listing_id INTEGER REFERENCES listings(id) ON DELETE SET NULL,
+		read_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications(user_id, created_at DESC);`
+	if _, err := db.Exec(notificationsTable); err != nil {
+		return fmt.Errorf("error creating notifications table: %v", err)
+	}
+	return nil
+}
+
+// createNotification stores an in-app notification for userID and pushes it
+// to the user's connected devices. listingID is the listing it links to, if
+// any.
+func createNotification(ctx context.Context, exec sqlExecutor, userID int, kind, message string, listingID *int) error {
+	n := Notification{Type: kind, Message: message, ListingID: listingID, CreatedAt: time.Now()}
+	err := exec.QueryRowContext(ctx,
+		"INSERT INTO notifications(user_id, type, message, listing_id, created_at) VALUES($1, $2, $3, $4, $5) RETURNING id",
+		userID, kind, message, listingID, n.CreatedAt,
+	).Scan(&n.ID)
+	if err != nil {
+		return err
+	}
+	return publishEvent(ctx, exec, []int{userID}, eventNotification, n)
+}
+
+// notificationsHandler handles GET requests for the user's notifications,
+// newest first. ?unread=true leaves out those already read.
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	query := "SELECT id, type, message, listing_id, read_at, created_at FROM notifications WHERE user_id = $1"
+	if r.URL.Query().Get("unread") == "true" {
+		query += " AND read_at IS NULL"
+	}
+	rows, err := db.QueryContext(r.Context(), query+" ORDER BY created_at DESC, id DESC LIMIT 100", currentUserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.Message, &n.ListingID, &n.ReadAt, &n.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		notifications = append(notifications, n)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// markNotificationsReadHandler handles POST requests marking some or all of
+// the user's notifications as read.
+func markNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req MarkReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var result sql.Result
+	var err error
+	if len(req.IDs) == 0 {
+		result, err = db.ExecContext(r.Context(),
+			"UPDATE notifications SET read_at = $1 WHERE user_id = $2 AND read_at IS NULL",
+			time.Now(), currentUserID,
+		)
+	} else {
+		result, err = db.ExecContext(r.Context(),
+			"UPDATE notifications SET read_at = $1 WHERE user_id = $2 AND read_at IS NULL AND id = ANY($3)",
+			time.Now(), currentUserID, pq.Array(req.IDs),
+		)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	marked, _ := result.RowsAffected()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"marked": marked})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotificationsHandler_Unread(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT id, type, message, listing_id, read_at, created_at FROM notifications WHERE user_id = \\$1 AND read_at IS NULL ORDER BY").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "message", "listing_id", "read_at", "created_at"}).
+			AddRow(3, notificationSavedSearch, `New match for "fridge": Mini Fridge`, 42, nil, time.Now()))
+
+	req := httptest.NewRequest(http.MethodGet, "/notifications?unread=true", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	notificationsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"listingId":42`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMarkNotificationsReadHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		mockSetup    func(sqlmock.Sqlmock)
+		expectedBody string
+	}{
+		{
+			name: "Selected",
+			body: `{"ids":[3,4]}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("UPDATE notifications SET read_at = \\$1 WHERE user_id = \\$2 AND read_at IS NULL AND id = ANY\\(\\$3\\)").
+					WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+			},
+			expectedBody: `{"marked":2}`,
+		},
+		{
+			name: "All",
+			body: `{}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("UPDATE notifications SET read_at = \\$1 WHERE user_id = \\$2 AND read_at IS NULL$").
+					WithArgs(sqlmock.AnyArg(), 1).
+					WillReturnResult(sqlmock.NewResult(0, 5))
+			},
+			expectedBody: `{"marked":5}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/notifications/read", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			markNotificationsReadHandler(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
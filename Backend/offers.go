@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// OfferStatus is a state of an offer. Only pending offers can be answered.
+type OfferStatus string
+
+const (
+	OfferPending   OfferStatus = "pending"
+	OfferAccepted  OfferStatus = "accepted"
+	OfferDeclined  OfferStatus = "declined"
+	OfferCountered OfferStatus = "countered"
+	OfferWithdrawn OfferStatus = "withdrawn"
+	OfferExpired   OfferStatus = "expired"
+)
+
+// Actions on a pending offer. The party the offer was made to may accept,
+// decline or counter it; the party who made it may withdraw it.
+const (
+	offerAccept   = "accept"
+	offerDecline  = "decline"
+	offerCounter  = "counter"
+	offerWithdraw = "withdraw"
+)
+
+// Defaults for offers, overridable through "offerExpiryHours" in the
+// "listings" section of config.json.
+const (
+	defaultOfferExpiryHours  = 48
+	offerExpiryCheckInterval = 15 * time.Minute
+)
+
+// offerExpiry is how long an offer or counter-offer stays open.
+var offerExpiry = defaultOfferExpiryHours * time.Hour
+
+var (
+	errOfferNotFound = &requestError{status: http.StatusNotFound, message: "Offer not found"}
+	// errOfferBlocked is returned when either party has blocked the other.
+	errOfferBlocked = &requestError{status: http.StatusForbidden, message: "You cannot make offers to this user"}
+)
+
+// Offer is a price proposed for a listing. A counter-offer is a new offer
+// whose ParentID is the offer it answers; buyer and seller go back and forth
+// until one side accepts, declines or lets the latest offer expire.
+type Offer struct {
+	ID          int         `json:"id"`
+	ListingID   int         `json:"listingId"`
+	ProductName string      `json:"productName,omitempty"`
+	BuyerID     int         `json:"buyerId"`
+	SellerID    int         `json:"sellerId"`
+	ProposedBy  int         `json:"proposedBy"`
+	Amount      Money       `json:"amount"`
+	Currency    string      `json:"currency"`
+	Status      OfferStatus `json:"status"`
+	ParentID    *int        `json:"parentId,omitempty"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	ExpiresAt   time.Time   `json:"expiresAt"`
+	RespondedAt *time.Time  `json:"respondedAt,omitempty"`
+}
+
+// OfferRequest is a buyer's offer on a listing.
+type OfferRequest struct {
+	ListingID int   `json:"listingId"`
+	Amount    Money `json:"amount"`
+}
+
+// OfferResponseRequest acts on a pending offer. Amount is the counter-offer
+// when Action is "counter".
+type OfferResponseRequest struct {
+	OfferID int    `json:"offerId"`
+	Action  string `json:"action"`
+	Amount  *Money `json:"amount"`
+}
+
+// initOffersDB creates the offers table. A buyer has at most one pending
+// offer per listing at a time.
+func initOffersDB() error {
+	offersTable := `
+	CREATE TABLE IF NOT EXISTS offers (
+		id SERIAL PRIMARY KEY,
+		listing_id INTEGER NOT NULL REFERENCES listings(id) ON DELETE CASCADE,
+		buyer_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		seller_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		proposed_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		amount_cents BIGINT NOT NULL CHECK (amount_cents > 0),
+		currency TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		parent_id INTEGER REFERENCES offers(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMPTZ NOT NULL,
+		responded_at TIMESTAMPTZ
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS offers_pending_idx ON offers(listing_id, buyer_id) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS offers_buyer_id_idx ON offers(buyer_id, created_at DESC);
+	CREATE INDEX IF NOT EXISTS offers_seller_id_idx ON offers(seller_id, created_at DESC);
+	CREATE INDEX IF NOT EXISTS offers_expires_at_idx ON offers(expires_at) WHERE status = 'pending';`
+	if _, err := db.Exec(offersTable); err != nil {
+		return fmt.Errorf("error creating offers table: %v", err)
+	}
+	return nil
+}
+
+// offerColumns are the offer fields read by scanOffer.
+const offerColumns = "id, listing_id, buyer_id, seller_id, proposed_by, amount_cents, currency, status, parent_id, created_at, expires_at, responded_at"
+
+func scanOffer(row interface{ Scan(...interface{}) error }, o *Offer, extra ...interface{}) error {
+	return row.Scan(append([]interface{}{&o.ID, &o.ListingID, &o.BuyerID, &o.SellerID, &o.ProposedBy, &o.Amount,
+		&o.Currency, &o.Status, &o.ParentID, &o.CreatedAt, &o.ExpiresAt, &o.RespondedAt}, extra...)...)
+}
+
+// publishOffer pushes an offer's new state to both parties.
+func publishOffer(ctx context.Context, exec sqlExecutor, o Offer) error {
+	return publishEvent(ctx, exec, []int{o.BuyerID, o.SellerID}, eventOffer, o)
+}
+
+// insertOffer stores a new pending offer and fills in its id.
+func insertOffer(ctx context.Context, tx *sql.Tx, o *Offer) error {
+	o.Status = OfferPending
+	o.CreatedAt = time.Now()
+	o.ExpiresAt = o.CreatedAt.Add(offerExpiry)
+	err := tx.QueryRowContext(ctx,
+		"INSERT INTO offers(listing_id, buyer_id, seller_id, proposed_by, amount_cents, currency, status, parent_id, created_at, expires_at) "+
+			"VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		o.ListingID, o.BuyerID, o.SellerID, o.ProposedBy, o.Amount, o.Currency, o.Status, o.ParentID, o.CreatedAt, o.ExpiresAt,
+	).Scan(&o.ID)
+	if isUniqueViolation(err) {
+		return &requestError{status: http.StatusConflict, message: "There is already a pending offer on this listing"}
+	}
+	if err != nil {
+		return err
+	}
+	return publishOffer(ctx, tx, *o)
+}
+
+// offersHandler routes GET (list offers) and POST (make an offer) requests.
+func offersHandler(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listOffers(w, r, currentUserID)
+	case http.MethodPost:
+		makeOffer(w, r, currentUserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listOffers writes the offers userID made or received, newest first.
+// ?listingId= and ?status= narrow the list.
+func listOffers(w http.ResponseWriter, r *http.Request, userID int) {
+	where := &whereBuilder{}
+	where.add("(o.buyer_id = $%[1]d OR o.seller_id = $%[1]d)", userID)
+	if v := r.URL.Query().Get("listingId"); v != "" {
+		listingID, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid listingId", http.StatusBadRequest)
+			return
+		}
+		where.add("o.listing_id = $%d", listingID)
+	}
+	if v := r.URL.Query().Get("status"); v != "" {
+		where.add("o.status = $%d", v)
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT o.id, o.listing_id, o.buyer_id, o.seller_id, o.proposed_by, o.amount_cents, o.currency, o.status, o.parent_id, "+
+			"o.created_at, o.expires_at, o.responded_at, l.product_name FROM offers o JOIN listings l ON l.id = o.listing_id "+
+			where.clause()+" ORDER BY o.created_at DESC, o.id DESC",
+		where.args...,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	offers := []Offer{}
+	for rows.Next() {
+		var o Offer
+		if err := scanOffer(rows, &o, &o.ProductName); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		offers = append(offers, o)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offers)
+}
+
+// makeOffer records a buyer's offer on an active listing. The offer is in
+// the listing's currency.
+func makeOffer(w http.ResponseWriter, r *http.Request, userID int) {
+	var req OfferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.Amount <= 0 {
+		http.Error(w, "Offer amount must be greater than zero", http.StatusBadRequest)
+		return
+	}
+
+	o := Offer{ListingID: req.ListingID, BuyerID: userID, ProposedBy: userID, Amount: req.Amount}
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		// Locking the listing serializes offers with their acceptance.
+		var status ListingStatus
+		err := tx.QueryRowContext(r.Context(),
+			"SELECT user_id, status, currency FROM listings WHERE id = $1 FOR UPDATE", req.ListingID,
+		).Scan(&o.SellerID, &status, &o.Currency)
+		if err == sql.ErrNoRows || (err == nil && status == StatusDraft) {
+			return errListingNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if o.SellerID == userID {
+			return badRequest("You cannot make an offer on your own listing")
+		}
+		if status != StatusActive {
+			return &requestError{status: http.StatusConflict, message: "This listing is not accepting offers"}
+		}
+		blocked, err := isBlocked(r.Context(), tx, userID, o.SellerID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return errOfferBlocked
+		}
+		return insertOffer(r.Context(), tx, &o)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o)
+}
+
+// offerResponseHandler handles POST requests to accept, decline, counter or
+// withdraw a pending offer. Accepting reserves the listing and declines every
+// other pending offer on it in the same transaction.
+func offerResponseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	var req OfferResponseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var result Offer
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		result, err = respondToOffer(r.Context(), tx, req, currentUserID)
+		return err
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// respondToOffer applies req on behalf of userID and returns the offer as it
+// now stands; for a counter that is the new offer.
+func respondToOffer(ctx context.Context, tx *sql.Tx, req OfferResponseRequest, userID int) (Offer, error) {
+	switch req.Action {
+	case offerAccept, offerDecline, offerWithdraw:
+	case offerCounter:
+		if req.Amount == nil || *req.Amount <= 0 {
+			return Offer{}, badRequest("Counter-offer amount must be greater than zero")
+		}
+	default:
+		return Offer{}, badRequest("Invalid action: must be accept, decline, counter or withdraw")
+	}
+
+	// The listing is locked before the offer, in the same order as when
+	// offers are made, so concurrent responses cannot deadlock.
+	var listingID int
+	err := tx.QueryRowContext(ctx, "SELECT listing_id FROM offers WHERE id = $1", req.OfferID).Scan(&listingID)
+	if err == sql.ErrNoRows {
+		return Offer{}, errOfferNotFound
+	}
+	if err != nil {
+		return Offer{}, err
+	}
+	var listingStatus ListingStatus
+	err = tx.QueryRowContext(ctx, "SELECT status FROM listings WHERE id = $1 FOR UPDATE", listingID).Scan(&listingStatus)
+	if err != nil {
+		return Offer{}, err
+	}
+	var o Offer
+	err = scanOffer(tx.QueryRowContext(ctx, "SELECT "+offerColumns+" FROM offers WHERE id = $1 FOR UPDATE", req.OfferID), &o)
+	if err != nil {
+		return Offer{}, err
+	}
+
+	if userID != o.BuyerID && userID != o.SellerID {
+		return Offer{}, errOfferNotFound
+	}
+	if o.Status != OfferPending {
+		return Offer{}, &requestError{status: http.StatusConflict, message: fmt.Sprintf("Offer has already been %s", o.Status)}
+	}
+	now := time.Now()
+	if !o.ExpiresAt.After(now) {
+		return Offer{}, &requestError{status: http.StatusConflict, message: "Offer has expired"}
+	}
+	if req.Action == offerWithdraw {
+		if userID != o.ProposedBy {
+			return Offer{}, &requestError{status: http.StatusForbidden, message: "Only the party who made an offer can withdraw it"}
+		}
+	} else if userID == o.ProposedBy {
+		return Offer{}, &requestError{status: http.StatusForbidden, message: "You cannot respond to your own offer"}
+	}
+	if req.Action == offerAccept || req.Action == offerCounter {
+		if listingStatus != StatusActive {
+			return Offer{}, &requestError{status: http.StatusConflict, message: "This listing is not accepting offers"}
+		}
+		// A block ends the negotiation: pending offers can still be
+		// declined or withdrawn, but not taken further.
+		blocked, err := isBlocked(ctx, tx, o.BuyerID, o.SellerID)
+		if err != nil {
+			return Offer{}, err
+		}
+		if blocked {
+			return Offer{}, errOfferBlocked
+		}
+	}
+
+	next := map[string]OfferStatus{
+		offerAccept:   OfferAccepted,
+		offerDecline:  OfferDeclined,
+		offerCounter:  OfferCountered,
+		offerWithdraw: OfferWithdrawn,
+	}[req.Action]
+	if _, err := tx.ExecContext(ctx, "UPDATE offers SET status = $1, responded_at = $2 WHERE id = $3", next, now, o.ID); err != nil {
+		return Offer{}, err
+	}
+	o.Status, o.RespondedAt = next, &now
+	if err := publishOffer(ctx, tx, o); err != nil {
+		return Offer{}, err
+	}
+
+	switch req.Action {
+	case offerAccept:
+		if _, err := setListingStatus(ctx, tx, o.ListingID, StatusReserved, &userID); err != nil {
+			return Offer{}, err
+		}
+		if err := declineOtherOffers(ctx, tx, o.ListingID, o.ID, now); err != nil {
+			return Offer{}, err
+		}
+	case offerCounter:
+		counter := Offer{
+			ListingID:  o.ListingID,
+			BuyerID:    o.BuyerID,
+			SellerID:   o.SellerID,
+			ProposedBy: userID,
+			Amount:     *req.Amount,
+			Currency:   o.Currency,
+			ParentID:   &o.ID,
+		}
+		if err := insertOffer(ctx, tx, &counter); err != nil {
+			return Offer{}, err
+		}
+		return counter, nil
+	}
+	return o, nil
+}
+
+// declineOtherOffers declines every pending offer on a listing except the
+// accepted one.
+func declineOtherOffers(ctx context.Context, tx *sql.Tx, listingID, acceptedID int, now time.Time) error {
+	rows, err := tx.QueryContext(ctx,
+		"UPDATE offers SET status = $1, responded_at = $2 WHERE listing_id = $3 AND status = $4 AND id <> $5 RETURNING "+offerColumns,
+		OfferDeclined, now, listingID, OfferPending, acceptedID,
+	)
+	if err != nil {
+		return err
+	}
+	declined, err := scanOffers(rows)
+	if err != nil {
+		return err
+	}
+	for _, o := range declined {
+		if err := publishOffer(ctx, tx, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanOffers reads and closes rows of offerColumns.
+func scanOffers(rows *sql.Rows) ([]Offer, error) {
+	defer rows.Close()
+	var offers []Offer
+	for rows.Next() {
+		var o Offer
+		if err := scanOffer(rows, &o); err != nil {
+			return nil, err
+		}
+		offers = append(offers, o)
+	}
+	return offers, rows.Err()
+}
+
+// expireOffers marks pending offers past their expiry as expired and tells
+// both parties.
+func expireOffers(ctx context.Context) (int, error) {
+	now := time.Now()
+	rows, err := db.QueryContext(ctx,
+		"UPDATE offers SET status = $1, responded_at = $2 WHERE status = $3 AND expires_at <= $2 RETURNING "+offerColumns,
+		OfferExpired, now, OfferPending,
+	)
+	if err != nil {
+		return 0, err
+	}
+	expired, err := scanOffers(rows)
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range expired {
+		if err := publishOffer(ctx, db, o); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
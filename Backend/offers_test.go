@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+var offerColumnNames = []string{"id", "listing_id", "buyer_id", "seller_id", "proposed_by", "amount_cents", "currency", "status", "parent_id", "created_at", "expires_at", "responded_at"}
+
+// expectOfferLock queues the locking of an offer and its listing. The offer
+// on listing 3 was made by buyer 1 to seller 2 unless proposedBy says
+// otherwise.
+func expectOfferLock(mock sqlmock.Sqlmock, offerID int, listingStatus ListingStatus, proposedBy int, expiresAt time.Time) {
+	mock.ExpectQuery("SELECT listing_id FROM offers WHERE id = \\$1").
+		WithArgs(offerID).
+		WillReturnRows(sqlmock.NewRows([]string{"listing_id"}).AddRow(3))
+	mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(listingStatus))
+	mock.ExpectQuery("SELECT id, listing_id, .* FROM offers WHERE id = \\$1 FOR UPDATE").
+		WithArgs(offerID).
+		WillReturnRows(sqlmock.NewRows(offerColumnNames).
+			AddRow(offerID, 3, 1, 2, proposedBy, 3000, "USD", "pending", nil, time.Now(), expiresAt, nil))
+}
+
+func TestOffersHandler_Make(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Made",
+			body: `{"listingId":3,"amount":"30"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, currency FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "currency"}).AddRow(2, "active", "USD"))
+				expectBlockCheck(mock, 1, 2, false)
+				mock.ExpectQuery("INSERT INTO offers").
+					WithArgs(3, 1, 2, 1, Money(3000), "USD", OfferPending, nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(20))
+				expectRealtimeEvent(mock, eventOffer)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Already Pending",
+			body: `{"listingId":3,"amount":"30"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, currency FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "currency"}).AddRow(2, "active", "USD"))
+				expectBlockCheck(mock, 1, 2, false)
+				mock.ExpectQuery("INSERT INTO offers").
+					WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Reserved Listing",
+			body: `{"listingId":3,"amount":"30"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, currency FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "currency"}).AddRow(2, "reserved", "USD"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Own Listing",
+			body: `{"listingId":3,"amount":"30"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, currency FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "currency"}).AddRow(1, "active", "USD"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Blocked",
+			body: `{"listingId":3,"amount":"30"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, status, currency FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "currency"}).AddRow(2, "active", "USD"))
+				expectBlockCheck(mock, 1, 2, true)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Zero Amount",
+			body:           `{"listingId":3,"amount":"0"}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Float Amount",
+			body:           `{"listingId":3,"amount":"1e3"}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/offers", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			offersHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestOfferResponseHandler(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name           string
+		userID         string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:   "Accept Reserves Listing And Declines Others",
+			userID: "2",
+			body:   `{"offerId":20,"action":"accept"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOfferLock(mock, 20, StatusActive, 1, later)
+				expectBlockCheck(mock, 1, 2, false)
+				mock.ExpectExec("UPDATE offers SET status = \\$1, responded_at = \\$2 WHERE id = \\$3").
+					WithArgs(OfferAccepted, sqlmock.AnyArg(), 20).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectRealtimeEvent(mock, eventOffer)
+				mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+				mock.ExpectExec("UPDATE listings SET status = \\$1, updated_at = \\$2 WHERE id = \\$3").
+					WithArgs(StatusReserved, sqlmock.AnyArg(), 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO listing_status_history").
+					WithArgs(3, StatusActive, StatusReserved, 2, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectRealtimeEvent(mock, eventListingStatus)
+				expectListingEvent(mock, 3, StatusReserved, listingUpdated)
+				mock.ExpectQuery("UPDATE offers SET status = \\$1, responded_at = \\$2 WHERE listing_id = \\$3 AND status = \\$4 AND id <> \\$5 RETURNING").
+					WithArgs(OfferDeclined, sqlmock.AnyArg(), 3, OfferPending, 20).
+					WillReturnRows(sqlmock.NewRows(offerColumnNames).
+						AddRow(21, 3, 4, 2, 4, 2500, "USD", "declined", nil, time.Now(), later, time.Now()))
+				expectRealtimeEvent(mock, eventOffer)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Counter",
+			userID: "2",
+			body:   `{"offerId":20,"action":"counter","amount":"35"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOfferLock(mock, 20, StatusActive, 1, later)
+				expectBlockCheck(mock, 1, 2, false)
+				mock.ExpectExec("UPDATE offers SET status = \\$1, responded_at = \\$2 WHERE id = \\$3").
+					WithArgs(OfferCountered, sqlmock.AnyArg(), 20).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectRealtimeEvent(mock, eventOffer)
+				mock.ExpectQuery("INSERT INTO offers").
+					WithArgs(3, 1, 2, 2, Money(3500), "USD", OfferPending, 20, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+				expectRealtimeEvent(mock, eventOffer)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Counter After Block",
+			userID: "2",
+			body:   `{"offerId":20,"action":"counter","amount":"35"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOfferLock(mock, 20, StatusActive, 1, later)
+				expectBlockCheck(mock, 1, 2, true)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "Withdraw Own Offer",
+			userID: "1",
+			body:   `{"offerId":20,"action":"withdraw"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOfferLock(mock, 20, StatusActive, 1, later)
+				mock.ExpectExec("UPDATE offers SET status = \\$1, responded_at = \\$2 WHERE id = \\$3").
+					WithArgs(OfferWithdrawn, sqlmock.AnyArg(), 20).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectRealtimeEvent(mock, eventOffer)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Accept Own Offer",
+			userID: "1",
+			body:   `{"offerId":20,"action":"accept"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOfferLock(mock, 20, StatusActive, 1, later)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "Expired",
+			userID: "2",
+			body:   `{"offerId":20,"action":"accept"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOfferLock(mock, 20, StatusActive, 1, time.Now().Add(-time.Minute))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "Not A Party",
+			userID: "5",
+			body:   `{"offerId":20,"action":"decline"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOfferLock(mock, 20, StatusActive, 1, later)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Counter Without Amount",
+			userID:         "2",
+			body:           `{"offerId":20,"action":"counter"}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) { mock.ExpectBegin(); mock.ExpectRollback() },
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/offers/respond", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", tt.userID)
+			w := httptest.NewRecorder()
+
+			offerResponseHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestExpireOffers(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	mock.ExpectQuery("UPDATE offers SET status = \\$1, responded_at = \\$2 WHERE status = \\$3 AND expires_at <= \\$2 RETURNING").
+		WithArgs(OfferExpired, sqlmock.AnyArg(), OfferPending).
+		WillReturnRows(sqlmock.NewRows(offerColumnNames).
+			AddRow(20, 3, 1, 2, 1, 3000, "USD", "expired", nil, now.Add(-49*time.Hour), now.Add(-time.Hour), now))
+	expectRealtimeEvent(mock, eventOffer)
+
+	expired, err := expireOffers(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExpireOffers_Error(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("UPDATE offers SET status").WillReturnError(errors.New("connection reset"))
+
+	_, err := expireOffers(context.Background())
+
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
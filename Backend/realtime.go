@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+// Event types pushed to connected clients.
+const (
+	eventReady         = "ready"
+	eventResync        = "resync"
+	eventMessage       = "message"
+	eventNotification  = "notification"
+	eventListingStatus = "listing_status"
+	eventOffer         = "offer"
+	eventTransaction   = "transaction"
+)
+
+const (
+	// realtimeChannel is the Postgres NOTIFY channel new events are announced
+	// on, so every backend instance can deliver to its own clients.
+	realtimeChannel = "realtime_events"
+	// realtimeEventRetention is how long events are kept for clients
+	// resuming after a disconnect.
+	realtimeEventRetention = 24 * time.Hour
+	// realtimeCleanupInterval is how often expired events are deleted.
+	realtimeCleanupInterval = time.Hour
+
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsSendBuffer   = 64
+)
+
+// RealtimeEvent is one event pushed to a user's WebSocket connections. A
+// client that reconnects passes the ResumeToken of the last event it handled
+// to receive what it missed.
+type RealtimeEvent struct {
+	ResumeToken string          `json:"resumeToken"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	id          int64
+	userID      int
+}
+
+// initRealtimeDB creates the table of events delivered over WebSocket.
+func initRealtimeDB() error {
+	eventsTable := `
+	CREATE TABLE IF NOT EXISTS realtime_events (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS realtime_events_user_id_idx ON realtime_events(user_id, id);
+	CREATE INDEX IF NOT EXISTS realtime_events_created_at_idx ON realtime_events(created_at);`
+	if _, err := db.Exec(eventsTable); err != nil {
+		return fmt.Errorf("error creating realtime_events table: %v", err)
+	}
+	return nil
+}
+
+// publishEvent stores an event for each of userIDs and announces it on
+// realtimeChannel. Inside a transaction the announcement is only sent on
+// commit, so clients never see events that were rolled back.
+func publishEvent(ctx context.Context, exec sqlExecutor, userIDs []int, kind string, payload interface{}) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = int64(id)
+	}
+	return publishEventTo(ctx, exec, "SELECT unnest($1::int[])", []interface{}{pq.Array(ids)}, kind, payload)
+}
+
+// publishEventTo is publishEvent for recipients selected by a query with a
+// single user id column, evaluated in the same statement.
+func publishEventTo(ctx context.Context, exec sqlExecutor, recipients string, args []interface{}, kind string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	n := len(args)
+	query := fmt.Sprintf("WITH e AS (INSERT INTO realtime_events(user_id, type, payload, created_at) "+
+		"SELECT r.user_id, $%d, $%d, $%d FROM (%s) r(user_id) RETURNING id, user_id) "+
+		"SELECT pg_notify('%s', id || ':' || user_id) FROM e", n+1, n+2, n+3, recipients, realtimeChannel)
+	_, err = exec.ExecContext(ctx, query, append(args, kind, string(data), time.Now())...)
+	return err
+}
+
+// deleteOldRealtimeEvents removes events too old to be resumed from.
+func deleteOldRealtimeEvents(ctx context.Context) (int, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM realtime_events WHERE created_at < $1", time.Now().Add(-realtimeEventRetention))
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// realtimeClient is one WebSocket connection.
+type realtimeClient struct {
+	userID int
+	send   chan RealtimeEvent
+}
+
+// realtimeHub tracks the WebSocket connections of this instance by user.
+type realtimeHub struct {
+	mu      sync.Mutex
+	clients map[int]map[*realtimeClient]bool
+}
+
+var hub = &realtimeHub{clients: map[int]map[*realtimeClient]bool{}}
+
+func (h *realtimeHub) register(c *realtimeClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[c.userID] == nil {
+		h.clients[c.userID] = map[*realtimeClient]bool{}
+	}
+	h.clients[c.userID][c] = true
+}
+
+// unregister removes a client and closes its send channel, if that has not
+// happened already.
+func (h *realtimeHub) unregister(c *realtimeClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(c)
+}
+
+// remove must be called with mu held.
+func (h *realtimeHub) remove(c *realtimeClient) {
+	if !h.clients[c.userID][c] {
+		return
+	}
+	delete(h.clients[c.userID], c)
+	if len(h.clients[c.userID]) == 0 {
+		delete(h.clients, c.userID)
+	}
+	close(c.send)
+}
+
+func (h *realtimeHub) connected(userID int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients[userID]) > 0
+}
+
+// deliver queues an event for every connection of its user. A connection
+// too slow to keep up is dropped; the client resumes from its last token.
+func (h *realtimeHub) deliver(e RealtimeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients[e.userID] {
+		select {
+		case c.send <- e:
+		default:
+			h.remove(c)
+		}
+	}
+}
+
+// disconnectAll drops every connection, e.g. after notifications may have
+// been missed. Clients reconnect and resume.
+func (h *realtimeHub) disconnectAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, clients := range h.clients {
+		for c := range clients {
+			h.remove(c)
+		}
+	}
+}
+
+// dispatch loads an announced event and delivers it if its user is connected
+// to this instance. payload is "<event id>:<user id>".
+func (h *realtimeHub) dispatch(ctx context.Context, payload string) {
+	idText, userText, ok := strings.Cut(payload, ":")
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		return
+	}
+	userID, err := strconv.Atoi(userText)
+	if err != nil || !h.connected(userID) {
+		return
+	}
+	e := RealtimeEvent{id: id, userID: userID}
+	var data []byte
+	err = db.QueryRowContext(ctx, "SELECT type, payload, created_at FROM realtime_events WHERE id = $1", id).Scan(&e.Type, &data, &e.CreatedAt)
+	if err != nil {
+		log.Printf("Error loading realtime event %d: %v", id, err)
+		return
+	}
+	e.Payload = data
+	h.deliver(e)
+}
+
+// listenRealtimeEvents delivers WebSocket and listing stream events
+// announced by any instance to the clients connected here. It runs for the
+// life of the process.
+func listenRealtimeEvents(connStr string) {
+	listener := pq.NewListener(connStr, 10*time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Realtime listener: %v", err)
+		}
+	})
+	for _, channel := range []string{realtimeChannel, listingEventsChannel} {
+		if err := listener.Listen(channel); err != nil {
+			log.Printf("Error listening for %s: %v", channel, err)
+			return
+		}
+	}
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil {
+				// The connection was re-established and notifications may
+				// have been lost in between.
+				hub.disconnectAll()
+				listingStream.disconnectAll()
+				continue
+			}
+			if n.Channel == listingEventsChannel {
+				listingStream.dispatch(context.Background(), n.Extra)
+			} else {
+				hub.dispatch(context.Background(), n.Extra)
+			}
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		}
+	}
+}
+
+// wsUpgrader accepts connections from any origin: they are authenticated by
+// session id, not by cookies, so another site cannot ride on a user's
+// session.
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// resumeEvents returns the events for userID that c does not cover. When
+// checkRetention is set it returns false if events after c may already have
+// been deleted, in which case the client must refetch its state.
+func resumeEvents(ctx context.Context, userID int, c *eventCursor, checkRetention bool) ([]RealtimeEvent, bool, error) {
+	if checkRetention {
+		oldest, err := oldestEventID(ctx, "realtime_events")
+		if err != nil {
+			return nil, false, err
+		}
+		if oldest == nil || c.after < *oldest-1 {
+			return nil, false, nil
+		}
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT id, type, payload, created_at FROM realtime_events WHERE user_id = $1 "+
+			"AND (id > $2 OR (id < $2 AND created_at >= $3 AND id <> ALL($4))) ORDER BY id",
+		userID, c.after, c.windowStart(), pq.Array(c.seenIDs()),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var events []RealtimeEvent
+	for rows.Next() {
+		e := RealtimeEvent{userID: userID}
+		var data []byte
+		if err := rows.Scan(&e.id, &e.Type, &data, &e.CreatedAt); err != nil {
+			return nil, false, err
+		}
+		e.Payload = data
+		events = append(events, e)
+	}
+	return events, true, rows.Err()
+}
+
+// realtimeHandler upgrades GET /ws to a WebSocket that pushes the user's new
+// messages, notifications, offer updates and listing status changes. The
+// session is validated like ValidateSessionMiddleware; browsers, which
+// cannot set headers on WebSocket requests, may pass sessionId and userId as
+// query parameters instead. ?resume=<token> replays the events missed since
+// that token. The first frame is a "ready" event whose token resumes from
+// the moment of connecting, or a "resync" event if the requested token is
+// too old to resume from.
+func realtimeHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.Header.Get("X-Session-ID")
+	if sessionID == "" {
+		sessionID = r.URL.Query().Get("sessionId")
+	}
+	userIDStr := r.Header.Get("userId")
+	if userIDStr == "" {
+		userIDStr = r.URL.Query().Get("userId")
+	}
+	valid, err := ValidateSession(sessionID, userIDStr)
+	if !valid || err != nil {
+		http.Error(w, "Session validation error", http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		http.Error(w, "Invalid userId", http.StatusBadRequest)
+		return
+	}
+	var cursor *eventCursor
+	token := r.URL.Query().Get("resume")
+	if token != "" {
+		if cursor, err = parseEventCursor(token); err != nil {
+			http.Error(w, "Invalid resume token", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Events are replayed from the resume token, or from the newest event
+	// when starting afresh. That point is fixed before the client is
+	// registered so nothing published in between is lost. Events are
+	// tracked by id rather than by a high-water mark, since they may commit
+	// out of id order; the cursor skips those the client already has.
+	ctx := r.Context()
+	if cursor != nil {
+		err = cursor.anchor(ctx, "realtime_events")
+	} else {
+		cursor, err = latestEventCursor(ctx, "realtime_events")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fresh := token == ""
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written the error response.
+		return
+	}
+	defer conn.Close()
+
+	client := &realtimeClient{userID: userID, send: make(chan RealtimeEvent, wsSendBuffer)}
+	hub.register(client)
+	defer hub.unregister(client)
+
+	done := make(chan struct{})
+	go readRealtime(conn, done)
+
+	first := RealtimeEvent{Type: eventReady, CreatedAt: time.Now()}
+	backlog, ok, err := resumeEvents(ctx, userID, cursor, !fresh)
+	if err != nil {
+		log.Printf("Error replaying realtime events for user %d: %v", userID, err)
+		return
+	}
+	if !ok {
+		// Start over from the newest event the replay would have read.
+		first.Type = eventResync
+		fresh = true
+		if cursor, err = latestEventCursor(ctx, "realtime_events"); err != nil {
+			log.Printf("Error replaying realtime events for user %d: %v", userID, err)
+			return
+		}
+		if backlog, _, err = resumeEvents(ctx, userID, cursor, false); err != nil {
+			log.Printf("Error replaying realtime events for user %d: %v", userID, err)
+			return
+		}
+	}
+	if fresh {
+		backlog = skipCommittedEvents(cursor, backlog)
+	}
+	first.ResumeToken = cursor.String()
+	if err := writeRealtime(conn, first); err != nil {
+		return
+	}
+	for _, e := range backlog {
+		cursor.add(e.id, e.CreatedAt)
+		e.ResumeToken = cursor.String()
+		if err := writeRealtime(conn, e); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-client.send:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "reconnect and resume"), time.Now().Add(wsWriteWait))
+				return
+			}
+			if cursor.covers(e.id, e.CreatedAt) {
+				continue
+			}
+			cursor.add(e.id, e.CreatedAt)
+			e.ResumeToken = cursor.String()
+			if err := writeRealtime(conn, e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// skipCommittedEvents adds the events of a fresh connection's backlog that
+// had committed at the cursor's position to the cursor without sending them:
+// they are part of the state the client loads when it connects. The rest of
+// the backlog is returned.
+func skipCommittedEvents(c *eventCursor, backlog []RealtimeEvent) []RealtimeEvent {
+	rest := backlog[:0]
+	for _, e := range backlog {
+		if e.id < c.after {
+			c.add(e.id, e.CreatedAt)
+		} else {
+			rest = append(rest, e)
+		}
+	}
+	return rest
+}
+
+// writeRealtime sends one event frame.
+func writeRealtime(conn *websocket.Conn, e RealtimeEvent) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteJSON(e)
+}
+
+// readRealtime reads until the connection fails or the client stops
+// answering pings, then closes done. Clients do not send anything but
+// control frames.
+func readRealtime(conn *websocket.Conn, done chan<- struct{}) {
+	defer close(done)
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectRealtimeEvent queues the statement publishing one event.
+func expectRealtimeEvent(mock sqlmock.Sqlmock, kind string) {
+	mock.ExpectExec("WITH e AS \\(INSERT INTO realtime_events\\(user_id, type, payload, created_at\\) .* SELECT pg_notify\\('realtime_events'").
+		WithArgs(sqlmock.AnyArg(), kind, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectSession queues a successful session check for userID.
+func expectSession(mock sqlmock.Sqlmock, sessionID, userID string) {
+	mock.ExpectQuery("SELECT session_id, user_id FROM sessions").
+		WithArgs(sessionID, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"session_id", "user_id"}).AddRow(sessionID, userID))
+}
+
+func TestRealtimeHandler_RejectsInvalidSession(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT session_id, user_id FROM sessions").
+		WithArgs("stale", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"session_id", "user_id"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/ws?sessionId=stale&userId=2", nil)
+	w := httptest.NewRecorder()
+
+	realtimeHandler(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRealtimeHandler_ResumesAndDeliversLiveEvents(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	expectSession(mock, "s1", "2")
+	mock.ExpectQuery("SELECT created_at FROM realtime_events WHERE id = \\$1").
+		WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(now.Add(-5 * time.Second)))
+	mock.ExpectQuery("SELECT MIN\\(id\\) FROM realtime_events").
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(3))
+	// Event 4 committed after event 5 and is replayed along with event 6.
+	mock.ExpectQuery("SELECT id, type, payload, created_at FROM realtime_events WHERE user_id = \\$1 "+
+		"AND \\(id > \\$2 OR \\(id < \\$2 AND created_at >= \\$3 AND id <> ALL\\(\\$4\\)\\)\\) ORDER BY id").
+		WithArgs(2, int64(5), now.Add(-5*time.Second-eventCommitLag), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "payload", "created_at"}).
+			AddRow(4, eventOffer, []byte(`{"id":2}`), now.Add(-6*time.Second)).
+			AddRow(6, eventMessage, []byte(`{"id":30}`), now))
+
+	server := httptest.NewServer(http.HandlerFunc(realtimeHandler))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?sessionId=s1&userId=2&resume=5"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	read := func() RealtimeEvent {
+		var e RealtimeEvent
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		assert.NoError(t, conn.ReadJSON(&e))
+		return e
+	}
+	ready := read()
+	assert.Equal(t, eventReady, ready.Type)
+	assert.Equal(t, "5", ready.ResumeToken)
+	late := read()
+	assert.Equal(t, eventOffer, late.Type)
+	assert.Equal(t, "5:4", late.ResumeToken)
+	missed := read()
+	assert.Equal(t, eventMessage, missed.Type)
+	assert.Equal(t, "6:4,5", missed.ResumeToken)
+	assert.JSONEq(t, `{"id":30}`, string(missed.Payload))
+
+	// An event announced by any instance reaches the connection, and one
+	// already replayed is not sent twice.
+	mock.ExpectQuery("SELECT type, payload, created_at FROM realtime_events WHERE id = \\$1").
+		WithArgs(int64(6)).
+		WillReturnRows(sqlmock.NewRows([]string{"type", "payload", "created_at"}).AddRow(eventMessage, []byte(`{"id":30}`), now))
+	mock.ExpectQuery("SELECT type, payload, created_at FROM realtime_events WHERE id = \\$1").
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"type", "payload", "created_at"}).AddRow(eventNotification, []byte(`{"id":11}`), now))
+	// An event committed after a later one is still delivered.
+	mock.ExpectQuery("SELECT type, payload, created_at FROM realtime_events WHERE id = \\$1").
+		WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"type", "payload", "created_at"}).AddRow(eventTransaction, []byte(`{"id":8}`), now.Add(-7*time.Second)))
+	hub.dispatch(context.Background(), "6:2")
+	hub.dispatch(context.Background(), "7:2")
+	hub.dispatch(context.Background(), "8:99")
+	hub.dispatch(context.Background(), "3:2")
+
+	live := read()
+	assert.Equal(t, eventNotification, live.Type)
+	assert.Equal(t, "7:4,5,6", live.ResumeToken)
+	late = read()
+	assert.Equal(t, eventTransaction, late.Type)
+	assert.Equal(t, "7:3,4,5,6", late.ResumeToken)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRealtimeHandler_ResyncsWhenTokenExpired(t *testing.T) {
+	mock := withMockDB(t)
+	expectSession(mock, "s1", "2")
+	mock.ExpectQuery("SELECT created_at FROM realtime_events WHERE id = \\$1").
+		WithArgs(int64(10)).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}))
+	mock.ExpectQuery("SELECT MIN\\(id\\) FROM realtime_events").
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(40))
+	mock.ExpectQuery("SELECT id, created_at FROM realtime_events ORDER BY id DESC LIMIT 1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(52, time.Now()))
+	mock.ExpectQuery("SELECT id, type, payload, created_at FROM realtime_events WHERE user_id = \\$1 AND \\(id > \\$2").
+		WithArgs(2, int64(52), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "payload", "created_at"}))
+
+	server := httptest.NewServer(http.HandlerFunc(realtimeHandler))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?sessionId=s1&userId=2&resume=10"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	var e RealtimeEvent
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.NoError(t, conn.ReadJSON(&e))
+	assert.Equal(t, eventResync, e.Type)
+	assert.Equal(t, "52", e.ResumeToken)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRealtimeHub_DropsSlowClients(t *testing.T) {
+	h := &realtimeHub{clients: map[int]map[*realtimeClient]bool{}}
+	c := &realtimeClient{userID: 2, send: make(chan RealtimeEvent, 1)}
+	h.register(c)
+
+	h.deliver(RealtimeEvent{id: 1, userID: 2})
+	h.deliver(RealtimeEvent{id: 2, userID: 2})
+
+	assert.False(t, h.connected(2))
+	e, ok := <-c.send
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), e.id)
+	_, ok = <-c.send
+	assert.False(t, ok, "send channel is closed once the client is dropped")
+	h.unregister(c)
+}
+
+func TestPublishEvent_Payload(t *testing.T) {
+	mock := withMockDB(t)
+	payload, _ := json.Marshal(Message{ID: 30, ConversationID: 9, SenderID: 1, Body: "Hi"})
+	mock.ExpectExec("WITH e AS \\(INSERT INTO realtime_events").
+		WithArgs(sqlmock.AnyArg(), eventMessage, string(payload), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	err := publishEvent(context.Background(), db, []int{2, 1}, eventMessage, Message{ID: 30, ConversationID: 9, SenderID: 1, Body: "Hi"})
+
+	assert.NoError(t, err)
+	assert.NoError(t, publishEvent(context.Background(), db, nil, eventMessage, nil), "no recipients is a no-op")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
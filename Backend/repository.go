@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Errors returned by the listing repository. Handlers turn them into HTTP
+// responses with writeRepoError.
+var (
+	errListingNotFound = errors.New("Listing not found")
+	errNotListingOwner = errors.New("Unauthorized")
+)
+
+// requestError is returned from inside a transaction when the request itself
+// is invalid, so the client sees message with the given status.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string { return e.message }
+
+// badRequest returns a requestError with status 400.
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// writeRepoError writes the HTTP response for an error returned by the
+// repository or by a withTx callback.
+func writeRepoError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &reqErr):
+		http.Error(w, reqErr.message, reqErr.status)
+	case errors.Is(err, errListingNotFound):
+		http.Error(w, "Listing not found", http.StatusNotFound)
+	case errors.Is(err, errNotListingOwner):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx, so helpers can run
+// inside or outside a transaction.
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// withTx runs fn inside a transaction bound to ctx. The transaction is
+// committed when fn returns nil and rolled back when it returns an error or
+// panics.
+func withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// whereBuilder assembles a WHERE clause with numbered placeholders.
+type whereBuilder struct {
+	conditions []string
+	args       []interface{}
+}
+
+// add appends a condition. Each %d in condition is replaced by the
+// placeholder number of the matching argument, e.g.
+// add("l.user_id <> $%d", userID).
+func (b *whereBuilder) add(condition string, args ...interface{}) {
+	numbers := make([]interface{}, len(args))
+	for i, arg := range args {
+		b.args = append(b.args, arg)
+		numbers[i] = len(b.args)
+	}
+	b.conditions = append(b.conditions, fmt.Sprintf(condition, numbers...))
+}
+
+// clause returns the WHERE clause, or an empty string without conditions.
+func (b *whereBuilder) clause() string {
+	if len(b.conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(b.conditions, " AND ")
+}
+
+// ListingFields holds the editable columns of a listing. On update, empty
+// strings and nil pointers leave the column unchanged. Category is a category
+// slug or name and is resolved against the categories table; Attributes are
+// validated against its schema, and a nil map leaves them unchanged. Status and
+// PublishAt are only read on create; an empty Status creates an active
+// listing.
+type ListingFields struct {
+	ProductName        string
+	ProductDescription string
+	Price              *Money
+	Currency           string
+	Condition          *ItemCondition
+	Negotiable         *bool
+	Free               *bool
+	Category           string
+	Attributes         ListingAttributes
+	Status             ListingStatus
+	PublishAt          *time.Time
+}
+
+// listingSelect is the column list shared by listing reads. scanListing must
+// stay in step with it.
+const listingSelect = "SELECT l.id, l.user_id, u.name, " +
+	"(SELECT ROUND(AVG(rating), 2)::float8 FROM reviews WHERE reviewee_id = l.user_id AND reviewee_role = 'seller'), " +
+	"(SELECT COUNT(*) FROM reviews WHERE reviewee_id = l.user_id AND reviewee_role = 'seller'), " +
+	"l.product_name, l.product_description, l.price_cents, l.currency, l.condition, l.negotiable, l.is_free, l.category, l.category_id, l.attributes, l.status, l.created_at, l.updated_at, l.expires_at, l.publish_at " +
+	"FROM listings l JOIN users u ON u.id = l.user_id"
+
+// scanListing reads one row selected with listingSelect.
+func scanListing(row interface{ Scan(...interface{}) error }, l *Listing) error {
+	return row.Scan(&l.ID, &l.UserID, &l.Seller.Name, &l.Seller.AverageRating, &l.Seller.ReviewCount, &l.ProductName, &l.ProductDescription, &l.Price, &l.Currency, &l.Condition, &l.Negotiable, &l.Free, &l.Category, &l.CategoryID, &l.Attributes, &l.Status, &l.CreatedAt, &l.UpdatedAt, &l.ExpiresAt, &l.PublishAt)
+}
+
+// queryListings runs listingSelect with the given WHERE/ORDER clause, then
+// loads the images of every returned listing at the given size with a single
+// extra query. The listing rows are fully read and closed before the image
+// query runs.
+func queryListings(ctx context.Context, exec sqlExecutor, size, clause string, args ...interface{}) ([]Listing, error) {
+	rows, err := exec.QueryContext(ctx, listingSelect+" "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	var listings []Listing
+	for rows.Next() {
+		var l Listing
+		if err := scanListing(rows, &l); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		listings = append(listings, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := attachListingImages(ctx, exec, listings, size); err != nil {
+		return nil, err
+	}
+	return listings, nil
+}
+
+// attachListingImages fills in Images for a page of listings using one query
+// over all of their ids.
+func attachListingImages(ctx context.Context, exec sqlExecutor, listings []Listing, size string) error {
+	if len(listings) == 0 {
+		return nil
+	}
+	column, ok := imageColumn(size)
+	if !ok {
+		return fmt.Errorf("invalid image size %q", size)
+	}
+
+	ids := make([]int64, len(listings))
+	index := make(map[int]int, len(listings))
+	for i, l := range listings {
+		ids[i] = int64(l.ID)
+		index[l.ID] = i
+	}
+
+	rows, err := exec.QueryContext(ctx,
+		"SELECT id, listing_id, "+column+", content_type FROM listing_images WHERE listing_id = ANY($1) ORDER BY listing_id, position, id",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var imageID, listingID int
+		var imageData []byte
+		var contentType string
+		if err := rows.Scan(&imageID, &listingID, &imageData, &contentType); err != nil {
+			return err
+		}
+		if i, ok := index[listingID]; ok {
+			listings[i].Images = append(listings[i].Images, imageResponse(imageID, imageData, contentType))
+		}
+	}
+	return rows.Err()
+}
+
+// lockOwnedListing locks a listing row for the rest of the transaction, so
+// concurrent edits of the same listing run one after another, and checks that
+// it belongs to userID.
+func lockOwnedListing(ctx context.Context, tx *sql.Tx, listingID, userID int) error {
+	var ownerID int
+	err := tx.QueryRowContext(ctx, "SELECT user_id FROM listings WHERE id = $1 FOR UPDATE", listingID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return errListingNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if ownerID != userID {
+		return errNotListingOwner
+	}
+	return nil
+}
+
+// createListing inserts a new listing owned by userID and returns its id.
+// Drafts get no expiry until they are published.
+func createListing(ctx context.Context, tx *sql.Tx, userID int, f ListingFields) (int, error) {
+	if f.Price == nil && (f.Free == nil || !*f.Free) {
+		return 0, badRequest("Price is required unless the item is free")
+	}
+	if err := f.reconcileTerms(); err != nil {
+		return 0, err
+	}
+	currency := f.Currency
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	if f.Category == "" {
+		return 0, badRequest("Category is required")
+	}
+	category, err := resolveCategory(ctx, tx, f.Category)
+	if err != nil {
+		return 0, err
+	}
+	schema, err := categoryAttributeSchema(ctx, tx, &category.ID)
+	if err != nil {
+		return 0, err
+	}
+	attrs, err := schema.normalize(f.Attributes)
+	if err != nil {
+		return 0, badRequest("%s", err.Error())
+	}
+	status := f.Status
+	if status == "" {
+		status = StatusActive
+	}
+	now := time.Now()
+	var expiresAt *time.Time
+	if status != StatusDraft {
+		t := now.Add(listingExpiry)
+		expiresAt = &t
+	}
+
+	var listingID int
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO listings(user_id, product_name, product_description, price_cents, currency, condition, negotiable, is_free, category, category_id, attributes, status, created_at, updated_at, expires_at, publish_at) "+
+			"VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) RETURNING id",
+		userID, f.ProductName, f.ProductDescription, *f.Price, currency, f.Condition, f.Negotiable != nil && *f.Negotiable, *f.Free, category.Name, category.ID, attrs, status, now, now, expiresAt, f.PublishAt,
+	).Scan(&listingID)
+	return listingID, err
+}
+
+// updateListing writes the non-empty fields of f and bumps updated_at.
+func updateListing(ctx context.Context, tx *sql.Tx, listingID, userID int, f ListingFields) error {
+	params := []interface{}{}
+	updates := []string{}
+	add := func(column string, value interface{}) {
+		params = append(params, value)
+		updates = append(updates, fmt.Sprintf("%s = $%d", column, len(params)))
+	}
+	if f.ProductName != "" {
+		add("product_name", f.ProductName)
+	}
+	if f.ProductDescription != "" {
+		add("product_description", f.ProductDescription)
+	}
+	if err := f.reconcileTerms(); err != nil {
+		return err
+	}
+	if f.Price != nil {
+		if err := trackPriceChange(ctx, tx, listingID, *f.Price, f.Currency, f.ProductName); err != nil {
+			return err
+		}
+		add("price_cents", *f.Price)
+	}
+	if f.Currency != "" {
+		add("currency", f.Currency)
+	}
+	if f.Condition != nil {
+		add("condition", *f.Condition)
+	}
+	if f.Negotiable != nil {
+		add("negotiable", *f.Negotiable)
+	}
+	if f.Free != nil {
+		add("is_free", *f.Free)
+	}
+	if f.Category != "" || f.Attributes != nil {
+		// Attributes are checked against the schema of the listing's new or
+		// current category. Moving to another category without sending
+		// attributes drops the ones the new category does not define.
+		var categoryID *int
+		var attrs ListingAttributes
+		err := tx.QueryRowContext(ctx, "SELECT category_id, attributes FROM listings WHERE id = $1", listingID).Scan(&categoryID, &attrs)
+		if err != nil {
+			return err
+		}
+		if f.Category != "" {
+			category, err := resolveCategory(ctx, tx, f.Category)
+			if err != nil {
+				return err
+			}
+			add("category", category.Name)
+			add("category_id", category.ID)
+			categoryID = &category.ID
+		}
+		schema, err := categoryAttributeSchema(ctx, tx, categoryID)
+		if err != nil {
+			return err
+		}
+		if f.Attributes != nil {
+			attrs = f.Attributes
+		} else {
+			attrs = schema.only(attrs)
+		}
+		attrs, err = schema.normalize(attrs)
+		if err != nil {
+			return badRequest("%s", err.Error())
+		}
+		add("attributes", attrs)
+	}
+	add("updated_at", time.Now())
+
+	query := "UPDATE listings SET " + strings.Join(updates, ", ") +
+		fmt.Sprintf(" WHERE id = $%d AND user_id = $%d", len(params)+1, len(params)+2)
+	params = append(params, listingID, userID)
+
+	_, err := tx.ExecContext(ctx, query, params...)
+	return err
+}
+
+// appendListingImages adds uploads after a listing's existing images, which
+// keep their order and cover, as long as the listing stays within
+// maxImagesPerListing. The listing must be locked by the caller.
+func appendListingImages(ctx context.Context, tx *sql.Tx, listingID int, uploads []uploadedImage, results []ImageUploadResult) error {
+	var count, nextPosition int
+	err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*), COALESCE(MAX(position) + 1, 0) FROM listing_images WHERE listing_id = $1", listingID,
+	).Scan(&count, &nextPosition)
+	if err != nil {
+		return err
+	}
+	if count+len(uploads) > maxImagesPerListing {
+		return badRequest("Too many images: a listing can have at most %d", maxImagesPerListing)
+	}
+	return storeUploadedImages(ctx, tx, listingID, nextPosition, uploads, results)
+}
+
+// deleteListing removes a listing and all of its images.
+func deleteListing(ctx context.Context, tx *sql.Tx, listingID, userID int) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM listing_images WHERE listing_id = $1", listingID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM listings WHERE id = $1 AND user_id = $2", listingID, userID)
+	return err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// multipartListingRequest builds a multipart listing request with the given
+// form fields and one JPEG per entry in images.
+func multipartListingRequest(t *testing.T, method, target string, fields map[string]string, images int) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, value := range fields {
+		writer.WriteField(key, value)
+	}
+	for i := 0; i < images; i++ {
+		part, err := writer.CreateFormFile("images", "photo.jpg")
+		if err != nil {
+			t.Fatalf("Failed to create form file: %v", err)
+		}
+		part.Write(testJPEG(t, 40, 30, 0))
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("userId", "1")
+	return req
+}
+
+func TestWithTx_RollsBackOnError(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM listing_images").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	failure := errors.New("boom")
+	err := withTx(context.Background(), func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM listing_images WHERE listing_id = $1", 1); err != nil {
+			return err
+		}
+		return failure
+	})
+
+	assert.Equal(t, failure, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWithTx_RollsBackOnPanic(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	assert.Panics(t, func() {
+		withTx(context.Background(), func(tx *sql.Tx) error {
+			panic("boom")
+		})
+	})
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateListing_ImageInsertFailureRollsBack(t *testing.T) {
+	mock := withMockDB(t)
+	expectNewListingChecks(mock)
+	expectCategoryLookup(mock, "furniture", 6, "Furniture")
+	mock.ExpectQuery("INSERT INTO listings").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+	mock.ExpectQuery("INSERT INTO listing_images").
+		WillReturnError(errors.New("disk full"))
+	mock.ExpectRollback()
+
+	req := multipartListingRequest(t, http.MethodPost, "/listings", map[string]string{
+		"productName": "Desk Lamp",
+		"price":       "12.50",
+		"category":    "Furniture",
+	}, 1)
+	w := httptest.NewRecorder()
+
+	listingsHandler(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "error saving image record")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEditListing_ImageAppendFailureRollsBack(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	mock.ExpectExec("UPDATE listings SET product_name = \\$1, updated_at = \\$2 WHERE id = \\$3 AND user_id = \\$4").
+		WithArgs("Renamed", sqlmock.AnyArg(), 1, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// The upload goes after the two existing images instead of replacing
+	// them.
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\), COALESCE\\(MAX\\(position\\) \\+ 1, 0\\) FROM listing_images WHERE listing_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "next"}).AddRow(2, 2))
+	mock.ExpectQuery("INSERT INTO listing_images").
+		WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "image/jpeg", 2, sqlmock.AnyArg()).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	req := multipartListingRequest(t, http.MethodPut, "/listing/updateListing", map[string]string{
+		"listingId":   "1",
+		"productName": "Renamed",
+	}, 1)
+	w := httptest.NewRecorder()
+
+	editListingHandler(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "error saving image record")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteListingHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name: "Successful Deletion",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				expectListingEvent(mock, 1, StatusActive, listingDeleted)
+				mock.ExpectExec("DELETE FROM listing_images WHERE listing_id = \\$1").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec("DELETE FROM listings WHERE id = \\$1 AND user_id = \\$2").
+					WithArgs(1, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"message":"Listing deleted successfully"}`,
+		},
+		{
+			name: "Listing Delete Fails After Images Deleted",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				expectListingEvent(mock, 1, StatusActive, listingDeleted)
+				mock.ExpectExec("DELETE FROM listing_images WHERE listing_id = \\$1").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec("DELETE FROM listings WHERE id = \\$1 AND user_id = \\$2").
+					WithArgs(1, 1).
+					WillReturnError(errors.New("lock timeout"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   "lock timeout",
+		},
+		{
+			name: "Listing Not Found",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "Listing not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodDelete, "/listing/deleteListing?listingId=1", nil)
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			deleteListingHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedBody, strings.TrimSpace(w.Body.String()))
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Roles a reviewed user played in the transaction.
+const (
+	reviewedAsSeller = "seller"
+	reviewedAsBuyer  = "buyer"
+)
+
+const (
+	// maxReviewLength is the longest review text accepted, in characters.
+	maxReviewLength = 2000
+	// profileRecentReviews is how many reviews a profile shows.
+	profileRecentReviews = 10
+)
+
+// notificationReview tells a user they received a review.
+const notificationReview = "review"
+
+// Review is a rating left by one party of a confirmed transaction for the
+// other.
+type Review struct {
+	ID            int       `json:"id"`
+	TransactionID int       `json:"transactionId"`
+	ReviewerID    int       `json:"reviewerId"`
+	ReviewerName  string    `json:"reviewerName,omitempty"`
+	RevieweeID    int       `json:"revieweeId"`
+	RevieweeRole  string    `json:"revieweeRole"`
+	Rating        int       `json:"rating"`
+	Body          string    `json:"body"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// ReviewRequest is a review of the other party of a transaction.
+type ReviewRequest struct {
+	TransactionID int    `json:"transactionId"`
+	Rating        int    `json:"rating"`
+	Body          string `json:"body"`
+}
+
+// SellerSummary describes the seller on a listing. AverageRating is null
+// until the seller has been reviewed.
+type SellerSummary struct {
+	Name          string   `json:"name"`
+	AverageRating *float64 `json:"averageRating"`
+	ReviewCount   int      `json:"reviewCount"`
+}
+
+// RatingSummary aggregates the reviews a user received in one role.
+// Distribution counts the reviews for each star rating.
+type RatingSummary struct {
+	Average      *float64    `json:"average"`
+	Count        int         `json:"count"`
+	Distribution map[int]int `json:"distribution"`
+}
+
+// UserProfile is the public view of a user.
+type UserProfile struct {
+	ID            int           `json:"id"`
+	Name          string        `json:"name"`
+	MemberSince   time.Time     `json:"memberSince"`
+	SellerRating  RatingSummary `json:"sellerRating"`
+	BuyerRating   RatingSummary `json:"buyerRating"`
+	RecentReviews []Review      `json:"recentReviews"`
+}
+
+// initReviewsDB creates the reviews table. Each party reviews a transaction
+// at most once.
+func initReviewsDB() error {
+	reviewsTable := `
+	CREATE TABLE IF NOT EXISTS reviews (
+		id SERIAL PRIMARY KEY,
+		transaction_id INTEGER NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+		reviewer_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		reviewee_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		reviewee_role TEXT NOT NULL,
+		rating SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+		body TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (transaction_id, reviewer_id)
+	);
+	CREATE INDEX IF NOT EXISTS reviews_reviewee_idx ON reviews(reviewee_id, reviewee_role, created_at DESC);`
+	if _, err := db.Exec(reviewsTable); err != nil {
+		return fmt.Errorf("error creating reviews table: %v", err)
+	}
+	return nil
+}
+
+// reviewsHandler routes GET (reviews a user received) and POST (review a
+// transaction) requests.
+func reviewsHandler(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listReviews(w, r, currentUserID)
+	case http.MethodPost:
+		addReview(w, r, currentUserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listReviews writes the reviews received by ?userId=, newest first.
+// ?role=seller or ?role=buyer keeps only those received in that role. Like
+// the profile, they are not shown to users the reviewee has blocked.
+func listReviews(w http.ResponseWriter, r *http.Request, viewerID int) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid userId", http.StatusBadRequest)
+		return
+	}
+	role := r.URL.Query().Get("role")
+	if role != "" && role != reviewedAsSeller && role != reviewedAsBuyer {
+		http.Error(w, "Invalid role: must be seller or buyer", http.StatusBadRequest)
+		return
+	}
+	var visible bool
+	if err := db.QueryRowContext(r.Context(),
+		"SELECT EXISTS(SELECT 1 FROM users u WHERE u.id = $1 AND NOT "+userBlocksViewer+")", userID, viewerID,
+	).Scan(&visible); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !visible {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	reviews, err := receivedReviews(r.Context(), userID, role, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// receivedReviews returns the reviews userID received, newest first, in the
+// given role or in any role if it is empty. A limit of 0 returns them all.
+func receivedReviews(ctx context.Context, userID int, role string, limit int) ([]Review, error) {
+	where := &whereBuilder{}
+	where.add("r.reviewee_id = $%d", userID)
+	if role != "" {
+		where.add("r.reviewee_role = $%d", role)
+	}
+	query := "SELECT r.id, r.transaction_id, r.reviewer_id, u.name, r.reviewee_id, r.reviewee_role, r.rating, r.body, r.created_at " +
+		"FROM reviews r JOIN users u ON u.id = r.reviewer_id " + where.clause() + " ORDER BY r.created_at DESC, r.id DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := []Review{}
+	for rows.Next() {
+		var rv Review
+		if err := rows.Scan(&rv.ID, &rv.TransactionID, &rv.ReviewerID, &rv.ReviewerName, &rv.RevieweeID,
+			&rv.RevieweeRole, &rv.Rating, &rv.Body, &rv.CreatedAt); err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, rv)
+	}
+	return reviews, rows.Err()
+}
+
+// addReview records userID's review of the other party of a confirmed
+// transaction.
+func addReview(w http.ResponseWriter, r *http.Request, userID int) {
+	var req ReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.Rating < 1 || req.Rating > 5 {
+		http.Error(w, "Rating must be between 1 and 5", http.StatusBadRequest)
+		return
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	if utf8.RuneCountInString(req.Body) > maxReviewLength {
+		http.Error(w, fmt.Sprintf("Review is too long: at most %d characters", maxReviewLength), http.StatusBadRequest)
+		return
+	}
+
+	rv := Review{TransactionID: req.TransactionID, ReviewerID: userID, Rating: req.Rating, Body: req.Body}
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		var sellerID, buyerID int
+		var status TransactionStatus
+		var productName string
+		err := tx.QueryRowContext(r.Context(),
+			"SELECT seller_id, buyer_id, status, product_name FROM transactions WHERE id = $1", req.TransactionID,
+		).Scan(&sellerID, &buyerID, &status, &productName)
+		if err == sql.ErrNoRows || (err == nil && userID != sellerID && userID != buyerID) {
+			return errTransactionNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if status != TransactionConfirmed {
+			return &requestError{status: http.StatusConflict, message: "Reviews can only be left once the buyer has confirmed the sale"}
+		}
+		rv.RevieweeID, rv.RevieweeRole = sellerID, reviewedAsSeller
+		if userID == sellerID {
+			rv.RevieweeID, rv.RevieweeRole = buyerID, reviewedAsBuyer
+		}
+
+		rv.CreatedAt = time.Now()
+		err = tx.QueryRowContext(r.Context(),
+			"INSERT INTO reviews(transaction_id, reviewer_id, reviewee_id, reviewee_role, rating, body, created_at) "+
+				"VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+			rv.TransactionID, userID, rv.RevieweeID, rv.RevieweeRole, rv.Rating, rv.Body, rv.CreatedAt,
+		).Scan(&rv.ID)
+		if isUniqueViolation(err) {
+			return &requestError{status: http.StatusConflict, message: "You have already reviewed this transaction"}
+		}
+		if err != nil {
+			return err
+		}
+		message := fmt.Sprintf("You received a %d-star review for \"%s\"", rv.Rating, productName)
+		return createNotification(r.Context(), tx, rv.RevieweeID, notificationReview, message, nil)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rv)
+}
+
+// ratingSummaries aggregates the reviews userID received, by role.
+func ratingSummaries(ctx context.Context, userID int) (map[string]*RatingSummary, error) {
+	summaries := map[string]*RatingSummary{
+		reviewedAsSeller: {Distribution: map[int]int{}},
+		reviewedAsBuyer:  {Distribution: map[int]int{}},
+	}
+	rows, err := db.QueryContext(ctx,
+		"SELECT reviewee_role, rating, COUNT(*) FROM reviews WHERE reviewee_id = $1 GROUP BY reviewee_role, rating",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role string
+		var rating, count int
+		if err := rows.Scan(&role, &rating, &count); err != nil {
+			return nil, err
+		}
+		if s := summaries[role]; s != nil {
+			s.Distribution[rating] = count
+			s.Count += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, s := range summaries {
+		if s.Count == 0 {
+			continue
+		}
+		total := 0
+		for rating, count := range s.Distribution {
+			total += rating * count
+		}
+		average := math.Round(float64(total)/float64(s.Count)*100) / 100
+		s.Average = &average
+	}
+	return summaries, nil
+}
+
+// userProfileHandler handles GET requests for a user's public profile with
+// their ratings as a seller and as a buyer. Users the profile's owner has
+// blocked get a 404.
+func userProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	viewerID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid userId", http.StatusBadRequest)
+		return
+	}
+
+	p := UserProfile{ID: userID}
+	err = db.QueryRowContext(r.Context(),
+		"SELECT u.name, u.created_at FROM users u WHERE u.id = $1 AND NOT "+userBlocksViewer, userID, viewerID,
+	).Scan(&p.Name, &p.MemberSince)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	summaries, err := ratingSummaries(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.SellerRating, p.BuyerRating = *summaries[reviewedAsSeller], *summaries[reviewedAsBuyer]
+	if p.RecentReviews, err = receivedReviews(r.Context(), userID, "", profileRecentReviews); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectTransactionLookup queues the lookup of transaction 8, sold by user 2
+// to user 1.
+func expectTransactionLookup(mock sqlmock.Sqlmock, status TransactionStatus) {
+	mock.ExpectQuery("SELECT seller_id, buyer_id, status, product_name FROM transactions WHERE id = \\$1").
+		WithArgs(8).
+		WillReturnRows(sqlmock.NewRows([]string{"seller_id", "buyer_id", "status", "product_name"}).AddRow(2, 1, status, "Desk Lamp"))
+}
+
+func TestReviewsHandler_Add(t *testing.T) {
+	tests := []struct {
+		name           string
+		userID         string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:   "Buyer Reviews Seller",
+			userID: "1",
+			body:   `{"transactionId":8,"rating":5,"body":" Smooth pickup "}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectTransactionLookup(mock, TransactionConfirmed)
+				mock.ExpectQuery("INSERT INTO reviews").
+					WithArgs(8, 1, 2, reviewedAsSeller, 5, "Smooth pickup", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+				mock.ExpectQuery("INSERT INTO notifications").
+					WithArgs(2, notificationReview, `You received a 5-star review for "Desk Lamp"`, nil, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(13))
+				expectRealtimeEvent(mock, eventNotification)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "Seller Reviews Buyer",
+			userID: "2",
+			body:   `{"transactionId":8,"rating":4}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectTransactionLookup(mock, TransactionConfirmed)
+				mock.ExpectQuery("INSERT INTO reviews").
+					WithArgs(8, 2, 1, reviewedAsBuyer, 4, "", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+				mock.ExpectQuery("INSERT INTO notifications").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(14))
+				expectRealtimeEvent(mock, eventNotification)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "Already Reviewed",
+			userID: "1",
+			body:   `{"transactionId":8,"rating":5}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectTransactionLookup(mock, TransactionConfirmed)
+				mock.ExpectQuery("INSERT INTO reviews").
+					WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "Not Confirmed",
+			userID: "1",
+			body:   `{"transactionId":8,"rating":5}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectTransactionLookup(mock, TransactionPending)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "Not A Party",
+			userID: "3",
+			body:   `{"transactionId":8,"rating":1}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectTransactionLookup(mock, TransactionConfirmed)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Rating Out Of Range",
+			userID:         "1",
+			body:           `{"transactionId":8,"rating":6}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/reviews", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", tt.userID)
+			w := httptest.NewRecorder()
+
+			reviewsHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUserProfileHandler(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	mock.ExpectQuery("SELECT u.name, u.created_at FROM users u WHERE u.id = \\$1 AND NOT EXISTS\\(SELECT 1 FROM user_blocks b WHERE b.blocker_id = u.id AND b.blocked_id = \\$2 AND NOT b.muted\\)").
+		WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "created_at"}).AddRow("User2", now))
+	mock.ExpectQuery("SELECT reviewee_role, rating, COUNT\\(\\*\\) FROM reviews WHERE reviewee_id = \\$1 GROUP BY reviewee_role, rating").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"reviewee_role", "rating", "count"}).
+			AddRow("seller", 5, 2).
+			AddRow("seller", 4, 1).
+			AddRow("buyer", 3, 1))
+	mock.ExpectQuery("FROM reviews r JOIN users u ON u.id = r.reviewer_id WHERE r.reviewee_id = \\$1 ORDER BY r.created_at DESC, r.id DESC LIMIT 10").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "transaction_id", "reviewer_id", "name", "reviewee_id", "reviewee_role", "rating", "body", "created_at"}).
+			AddRow(4, 8, 1, "User1", 2, "seller", 5, "Smooth pickup", now))
+
+	req := httptest.NewRequest(http.MethodGet, "/users/profile?userId=2", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	userProfileHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var p UserProfile
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	if assert.NotNil(t, p.SellerRating.Average) {
+		assert.Equal(t, 4.67, *p.SellerRating.Average)
+	}
+	assert.Equal(t, 3, p.SellerRating.Count)
+	assert.Equal(t, 2, p.SellerRating.Distribution[5])
+	assert.Equal(t, 1, p.BuyerRating.Count)
+	assert.Len(t, p.RecentReviews, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUserProfileHandler_BlockedViewer(t *testing.T) {
+	mock := withMockDB(t)
+	// User 2 has blocked user 1, so the profile is not found for them.
+	mock.ExpectQuery("SELECT u.name, u.created_at FROM users u WHERE u.id = \\$1 AND NOT EXISTS").
+		WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "created_at"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/users/profile?userId=2", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	userProfileHandler(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReviewsHandler_ListBlockedViewer(t *testing.T) {
+	mock := withMockDB(t)
+	// User 2 has blocked user 1, so their reviews are not shown to them.
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM users u WHERE u.id = \\$1 AND NOT EXISTS\\(SELECT 1 FROM user_blocks b WHERE b.blocker_id = u.id AND b.blocked_id = \\$2 AND NOT b.muted\\)\\)").
+		WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	req := httptest.NewRequest(http.MethodGet, "/reviews?userId=2", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	reviewsHandler(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUserProfileHandler_RequiresViewer(t *testing.T) {
+	withMockDB(t)
+	req := httptest.NewRequest(http.MethodGet, "/users/profile?userId=2", nil)
+	w := httptest.NewRecorder()
+
+	userProfileHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestListingDetail_IncludesSellerRating(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	mock.ExpectQuery("SELECT l.id, l.user_id, u.name, \\(SELECT ROUND\\(AVG\\(rating\\), 2\\)::float8 FROM reviews WHERE reviewee_id = l.user_id AND reviewee_role = 'seller'\\)").
+		WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows(listingColumns).
+			AddRow(7, 2, "User2", 4.5, 6, "Lamp", "Desc", 3000, "USD", nil, false, false, "Furniture", 6, []byte("{}"), "active", now, now, now.Add(listingExpiry), nil))
+	mock.ExpectQuery("FROM listing_images WHERE listing_id = ANY\\(\\$1\\)").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "listing_id", "data", "content_type"}))
+	expectFavorites(mock, 1)
+	expectPriceHistory(mock, 7)
+
+	req := httptest.NewRequest(http.MethodGet, "/listing?listingId=7", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingDetailHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"seller":{"name":"User2","averageRating":4.5,"reviewCount":6}`)
+	assert.NotContains(t, w.Body.String(), "userName")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"UFMarketPlace/utils"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SearchChannel is how a user hears about new matches for a saved search.
+type SearchChannel string
+
+const (
+	ChannelEmail SearchChannel = "email"
+	ChannelInApp SearchChannel = "in-app"
+)
+
+// DigestFrequency is how often matches for a saved search are delivered.
+// Instant searches are delivered as soon as a listing matches; the others are
+// batched into a digest.
+type DigestFrequency string
+
+const (
+	FrequencyInstant DigestFrequency = "instant"
+	FrequencyDaily   DigestFrequency = "daily"
+	FrequencyWeekly  DigestFrequency = "weekly"
+)
+
+// digestIntervals is the minimum time between two digests of a search.
+var digestIntervals = map[DigestFrequency]time.Duration{
+	FrequencyDaily:  24 * time.Hour,
+	FrequencyWeekly: 7 * 24 * time.Hour,
+}
+
+const (
+	// maxSavedSearches is how many searches one user may save.
+	maxSavedSearches = 20
+	// savedSearchDigestInterval is how often due digests are sent.
+	savedSearchDigestInterval = time.Hour
+)
+
+// savedSearchFilters are the feed query parameters a saved search may use,
+// besides attr.<name> attribute filters. See feedFilter.
+var savedSearchFilters = map[string]bool{
+	"category":   true,
+	"condition":  true,
+	"negotiable": true,
+	"free":       true,
+	"minPrice":   true,
+	"maxPrice":   true,
+}
+
+// SavedSearch is a feed search a user wants to be alerted about. Query is
+// free text and Filters are feed query parameters, e.g.
+// {"category": "textbooks", "attr.courseCode": "COP3530"}.
+type SavedSearch struct {
+	ID             int               `json:"id"`
+	Name           string            `json:"name"`
+	Query          string            `json:"query"`
+	Filters        map[string]string `json:"filters"`
+	Channel        SearchChannel     `json:"channel"`
+	Frequency      DigestFrequency   `json:"frequency"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	LastNotifiedAt *time.Time        `json:"lastNotifiedAt"`
+}
+
+// values returns the search as feed query parameters.
+func (s SavedSearch) values() url.Values {
+	values := url.Values{}
+	for key, value := range s.Filters {
+		values.Set(key, value)
+	}
+	if s.Query != "" {
+		values.Set("q", s.Query)
+	}
+	return values
+}
+
+// savedSearchOwner is a saved search with the details needed to alert its
+// owner.
+type savedSearchOwner struct {
+	SavedSearch
+	userID int
+	email  string
+}
+
+// savedSearchOwnerSelect is the column list read by scanSavedSearchOwner.
+const savedSearchOwnerSelect = "SELECT s.id, s.name, s.query_text, s.filters, s.channel, s.frequency, s.created_at, s.last_notified_at, s.user_id, u.email " +
+	"FROM saved_searches s JOIN users u ON u.id = s.user_id"
+
+// scanSavedSearchOwner reads one row selected with savedSearchOwnerSelect.
+func scanSavedSearchOwner(row interface{ Scan(...interface{}) error }, s *savedSearchOwner) error {
+	var filters []byte
+	err := row.Scan(&s.ID, &s.Name, &s.Query, &filters, &s.Channel, &s.Frequency, &s.CreatedAt, &s.LastNotifiedAt, &s.userID, &s.email)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(filters, &s.Filters)
+}
+
+// initSavedSearchesDB creates the saved searches table and the table of
+// listings matched against them.
+func initSavedSearchesDB() error {
+	savedSearchesTable := `
+	CREATE TABLE IF NOT EXISTS saved_searches (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		query_text TEXT NOT NULL DEFAULT '',
+		filters JSONB NOT NULL DEFAULT '{}',
+		channel TEXT NOT NULL CHECK (channel IN ('email', 'in-app')),
+		frequency TEXT NOT NULL CHECK (frequency IN ('instant', 'daily', 'weekly')),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_notified_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS saved_searches_user_id_idx ON saved_searches(user_id);`
+	if _, err := db.Exec(savedSearchesTable); err != nil {
+		return fmt.Errorf("error creating saved_searches table: %v", err)
+	}
+
+	matchesTable := `
+	CREATE TABLE IF NOT EXISTS saved_search_matches (
+		search_id INTEGER NOT NULL REFERENCES saved_searches(id) ON DELETE CASCADE,
+		listing_id INTEGER NOT NULL REFERENCES listings(id) ON DELETE CASCADE,
+		matched_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		notified_at TIMESTAMPTZ,
+		PRIMARY KEY (search_id, listing_id)
+	);
+	CREATE INDEX IF NOT EXISTS saved_search_matches_pending_idx ON saved_search_matches(search_id) WHERE notified_at IS NULL;`
+	if _, err := db.Exec(matchesTable); err != nil {
+		return fmt.Errorf("error creating saved_search_matches table: %v", err)
+	}
+	return nil
+}
+
+// savedSearchesHandler routes GET (list the user's saved searches), POST
+// (save a search) and DELETE (remove a saved search) requests.
+func savedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listSavedSearches(w, r, currentUserID)
+	case http.MethodPost:
+		createSavedSearch(w, r, currentUserID)
+	case http.MethodDelete:
+		deleteSavedSearch(w, r, currentUserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listSavedSearches writes the saved searches of userID, newest first.
+func listSavedSearches(w http.ResponseWriter, r *http.Request, userID int) {
+	rows, err := db.QueryContext(r.Context(), savedSearchOwnerSelect+" WHERE s.user_id = $1 ORDER BY s.created_at DESC, s.id DESC", userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		var s savedSearchOwner
+		if err := scanSavedSearchOwner(rows, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		searches = append(searches, s.SavedSearch)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(searches)
+}
+
+// validateSavedSearch fills in defaults and checks a search before it is
+// saved. The filters are validated the same way the feed validates them.
+func validateSavedSearch(ctx context.Context, userID int, s *SavedSearch) error {
+	s.Query = strings.TrimSpace(s.Query)
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		s.Name = s.Query
+	}
+	if s.Name == "" {
+		return badRequest("Name is required")
+	}
+	if s.Query == "" && len(s.Filters) == 0 {
+		return badRequest("A saved search needs query text or at least one filter")
+	}
+	for key := range s.Filters {
+		if !savedSearchFilters[key] && !strings.HasPrefix(key, attributeFilterPrefix) {
+			return badRequest("Unknown filter %q", key)
+		}
+	}
+	if s.Filters == nil {
+		s.Filters = map[string]string{}
+	}
+
+	if s.Channel == "" {
+		s.Channel = ChannelInApp
+	}
+	if s.Channel != ChannelEmail && s.Channel != ChannelInApp {
+		return badRequest("Invalid channel: must be email or in-app")
+	}
+	if s.Frequency == "" {
+		s.Frequency = FrequencyInstant
+	}
+	if _, ok := digestIntervals[s.Frequency]; !ok && s.Frequency != FrequencyInstant {
+		return badRequest("Invalid frequency: must be instant, daily or weekly")
+	}
+
+	_, err := feedFilter(ctx, userID, s.values())
+	return err
+}
+
+// createSavedSearch saves a search for userID.
+func createSavedSearch(w http.ResponseWriter, r *http.Request, userID int) {
+	var s SavedSearch
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateSavedSearch(r.Context(), userID, &s); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	filters, err := json.Marshal(s.Filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = withTx(r.Context(), func(tx *sql.Tx) error {
+		// Lock the user's row so concurrent requests cannot both pass the
+		// limit check.
+		if _, err := tx.ExecContext(r.Context(), "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+			return err
+		}
+		var count int
+		if err := tx.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM saved_searches WHERE user_id = $1", userID).Scan(&count); err != nil {
+			return err
+		}
+		if count >= maxSavedSearches {
+			return badRequest("You can save at most %d searches", maxSavedSearches)
+		}
+		return tx.QueryRowContext(r.Context(),
+			"INSERT INTO saved_searches(user_id, name, query_text, filters, channel, frequency) VALUES($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+			userID, s.Name, s.Query, string(filters), s.Channel, s.Frequency,
+		).Scan(&s.ID, &s.CreatedAt)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// deleteSavedSearch removes one of userID's saved searches.
+func deleteSavedSearch(w http.ResponseWriter, r *http.Request, userID int) {
+	searchID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	result, err := db.ExecContext(r.Context(), "DELETE FROM saved_searches WHERE id = $1 AND user_id = $2", searchID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Saved search deleted successfully"})
+}
+
+// listingPublished is called once a listing first becomes visible in the
+// feed. It runs the saved-search matcher in the background so the request
+// that published the listing does not wait for it. Tests replace it.
+var listingPublished = func(listingID int) {
+	go func() {
+		if n, err := matchSavedSearches(context.Background(), listingID); err != nil {
+			log.Printf("Saved search matching failed for listing %d: %v", listingID, err)
+		} else if n > 0 {
+			log.Printf("Listing %d matched %d saved searches", listingID, n)
+		}
+	}()
+}
+
+// searchMatch is a listing matched by a saved search.
+type searchMatch struct {
+	listingID   int
+	productName string
+}
+
+// matchSavedSearches checks a newly published listing against every other
+// user's saved searches, records the matches and alerts the owners of
+// instant searches. Each search runs through feedFilter, so a saved search
+// matches exactly what the same search would show in the feed. It returns
+// the number of searches matched.
+func matchSavedSearches(ctx context.Context, listingID int) (int, error) {
+	var sellerID int
+	var productName string
+	err := db.QueryRowContext(ctx, "SELECT user_id, product_name FROM listings WHERE id = $1", listingID).Scan(&sellerID, &productName)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, savedSearchOwnerSelect+" WHERE s.user_id <> $1", sellerID)
+	if err != nil {
+		return 0, err
+	}
+	var searches []savedSearchOwner
+	for rows.Next() {
+		var s savedSearchOwner
+		if err := scanSavedSearchOwner(rows, &s); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		searches = append(searches, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	matched := 0
+	for _, s := range searches {
+		where, err := feedFilter(ctx, s.userID, s.values())
+		if err != nil {
+			// A category or attribute the search uses may have been removed
+			// since it was saved.
+			log.Printf("Skipping saved search %d: %v", s.ID, err)
+			continue
+		}
+		where.add("l.id = $%d", listingID)
+
+		var matches bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM listings l "+where.clause()+")", where.args...).Scan(&matches); err != nil {
+			return matched, err
+		}
+		if !matches {
+			continue
+		}
+
+		result, err := db.ExecContext(ctx,
+			"INSERT INTO saved_search_matches(search_id, listing_id, matched_at) VALUES($1, $2, $3) ON CONFLICT DO NOTHING",
+			s.ID, listingID, time.Now(),
+		)
+		if err != nil {
+			return matched, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		matched++
+
+		if s.Frequency == FrequencyInstant {
+			if err := deliverSavedSearchMatches(ctx, s, []searchMatch{{listingID, productName}}); err != nil {
+				log.Printf("Error alerting user %d about saved search %d: %v", s.userID, s.ID, err)
+			}
+		}
+	}
+	return matched, nil
+}
+
+// deliverSavedSearchMatches alerts the owner of a saved search about matches
+// over the search's channel and marks every pending match of the search as
+// notified.
+func deliverSavedSearchMatches(ctx context.Context, s savedSearchOwner, matches []searchMatch) error {
+	if len(matches) > 0 {
+		switch s.Channel {
+		case ChannelEmail:
+			names := make([]string, len(matches))
+			for i, m := range matches {
+				names[i] = m.productName
+			}
+			if err := utils.SendSavedSearchEmail(s.email, s.Name, names); err != nil {
+				return err
+			}
+		default:
+			var err error
+			if len(matches) == 1 {
+				err = createNotification(ctx, db, s.userID, notificationSavedSearch,
+					fmt.Sprintf("New match for \"%s\": %s", s.Name, matches[0].productName), &matches[0].listingID)
+			} else {
+				err = createNotification(ctx, db, s.userID, notificationSavedSearch,
+					fmt.Sprintf("%d new matches for \"%s\"", len(matches), s.Name), nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	now := time.Now()
+	if _, err := db.ExecContext(ctx, "UPDATE saved_search_matches SET notified_at = $1 WHERE search_id = $2 AND notified_at IS NULL", now, s.ID); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "UPDATE saved_searches SET last_notified_at = $1 WHERE id = $2", now, s.ID)
+	return err
+}
+
+// sendSavedSearchDigests delivers the pending matches of every daily and
+// weekly search whose digest is due. Matches whose listing is no longer
+// active are dropped. It returns the number of digests sent.
+func sendSavedSearchDigests(ctx context.Context) (int, error) {
+	rows, err := db.QueryContext(ctx,
+		savedSearchOwnerSelect+" WHERE s.frequency <> $1 AND EXISTS "+
+			"(SELECT 1 FROM saved_search_matches m WHERE m.search_id = s.id AND m.notified_at IS NULL)",
+		FrequencyInstant,
+	)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var due []savedSearchOwner
+	for rows.Next() {
+		var s savedSearchOwner
+		if err := scanSavedSearchOwner(rows, &s); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if s.LastNotifiedAt == nil || now.Sub(*s.LastNotifiedAt) >= digestIntervals[s.Frequency] {
+			due = append(due, s)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, s := range due {
+		matches, err := pendingSearchMatches(ctx, s.ID)
+		if err != nil {
+			return sent, err
+		}
+		if err := deliverSavedSearchMatches(ctx, s, matches); err != nil {
+			log.Printf("Error sending digest for saved search %d: %v", s.ID, err)
+			continue
+		}
+		if len(matches) > 0 {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// pendingSearchMatches returns the matches of a search not yet delivered
+// whose listing is still active and not hidden by moderation, oldest first.
+func pendingSearchMatches(ctx context.Context, searchID int) ([]searchMatch, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT m.listing_id, l.product_name FROM saved_search_matches m JOIN listings l ON l.id = m.listing_id "+
+			"WHERE m.search_id = $1 AND m.notified_at IS NULL AND l.status = $2 AND l.hidden_at IS NULL ORDER BY m.matched_at",
+		searchID, StatusActive,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []searchMatch
+	for rows.Next() {
+		var m searchMatch
+		if err := rows.Scan(&m.listingID, &m.productName); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"UFMarketPlace/utils"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var savedSearchColumns = []string{"id", "name", "query_text", "filters", "channel", "frequency", "created_at", "last_notified_at", "user_id", "email"}
+
+func TestFeedFilter_TextQuery(t *testing.T) {
+	where, err := feedFilter(context.Background(), 1, url.Values{"q": {" 50%_off "}})
+	assert.NoError(t, err)
+	assert.Contains(t, where.clause(), "(l.product_name ILIKE $3 OR l.product_description ILIKE $3)")
+	assert.Equal(t, `%50\%\_off%`, where.args[2])
+}
+
+func TestSavedSearchesHandler_Create(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Saved",
+			body: `{"query":"mini fridge","filters":{"maxPrice":"80"},"channel":"email","frequency":"daily"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT id FROM users WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM saved_searches WHERE user_id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectQuery("INSERT INTO saved_searches").
+					WithArgs(1, "mini fridge", "mini fridge", `{"maxPrice":"80"}`, ChannelEmail, FrequencyDaily).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Limit Reached",
+			body: `{"query":"desk"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT id FROM users WHERE id = \\$1 FOR UPDATE").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM saved_searches WHERE user_id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(maxSavedSearches))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Empty Search",
+			body:           `{"name":"Anything"}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown Filter",
+			body:           `{"query":"desk","filters":{"status":"sold"}}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Invalid Frequency",
+			body:           `{"query":"desk","frequency":"hourly"}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Invalid Price Filter",
+			body:           `{"query":"desk","filters":{"maxPrice":"cheap"}}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/savedSearches", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "1")
+			w := httptest.NewRecorder()
+
+			savedSearchesHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestMatchSavedSearches(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("SELECT user_id, product_name FROM listings WHERE id = \\$1").
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "product_name"}).AddRow(1, "Mini Fridge"))
+	mock.ExpectQuery("FROM saved_searches s JOIN users u ON u.id = s.user_id WHERE s.user_id <> \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(savedSearchColumns).
+			AddRow(7, "fridge", "fridge", []byte("{}"), "in-app", "instant", time.Now(), nil, 2, "user2@ufl.edu").
+			AddRow(8, "desk", "desk", []byte("{}"), "in-app", "instant", time.Now(), nil, 3, "user3@ufl.edu"))
+
+	// The first search matches and is delivered right away.
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM listings l WHERE l.user_id <> \\$1 AND l.status = \\$2 AND .* AND l.id = \\$5\\)").
+		WithArgs(2, StatusActive, "%fridge%", 2, 42).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("INSERT INTO saved_search_matches").
+		WithArgs(7, 42, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO notifications").
+		WithArgs(2, notificationSavedSearch, `New match for "fridge": Mini Fridge`, 42, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11))
+	expectRealtimeEvent(mock, eventNotification)
+	mock.ExpectExec("UPDATE saved_search_matches SET notified_at = \\$1 WHERE search_id = \\$2 AND notified_at IS NULL").
+		WithArgs(sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE saved_searches SET last_notified_at = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// The second does not.
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(3, StatusActive, "%desk%", 3, 42).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	matched, err := matchSavedSearches(context.Background(), 42)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, matched)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSendSavedSearchDigests(t *testing.T) {
+	mock := withMockDB(t)
+	now := time.Now()
+	mock.ExpectQuery("FROM saved_searches s JOIN users u ON u.id = s.user_id WHERE s.frequency <> \\$1 AND EXISTS").
+		WithArgs(FrequencyInstant).
+		WillReturnRows(sqlmock.NewRows(savedSearchColumns).
+			AddRow(7, "fridge", "fridge", []byte("{}"), "email", "daily", now, now.Add(-25*time.Hour), 2, "user2@ufl.edu").
+			AddRow(8, "desk", "desk", []byte("{}"), "email", "weekly", now, now.Add(-48*time.Hour), 3, "user3@ufl.edu"))
+
+	// Only the daily search is due.
+	mock.ExpectQuery("SELECT m.listing_id, l.product_name FROM saved_search_matches m .* AND l.status = \\$2 AND l.hidden_at IS NULL").
+		WithArgs(7, StatusActive).
+		WillReturnRows(sqlmock.NewRows([]string{"listing_id", "product_name"}).AddRow(42, "Mini Fridge").AddRow(43, "Dorm Fridge"))
+	mock.ExpectExec("UPDATE saved_search_matches SET notified_at").
+		WithArgs(sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("UPDATE saved_searches SET last_notified_at").
+		WithArgs(sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var sentTo string
+	var sentNames []string
+	originalSend := utils.SendSavedSearchEmail
+	utils.SendSavedSearchEmail = func(to, searchName string, productNames []string) error {
+		sentTo, sentNames = to, productNames
+		return nil
+	}
+	defer func() { utils.SendSavedSearchEmail = originalSend }()
+
+	sent, err := sendSavedSearchDigests(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, "user2@ufl.edu", sentTo)
+	assert.Equal(t, []string{"Mini Fridge", "Dorm Fridge"}, sentNames)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListingStatusHandler_PublishingDraftRunsMatcher(t *testing.T) {
+	mock := withMockDB(t)
+	var published []int
+	listingPublished = func(listingID int) { published = append(published, listingID) }
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	expectPendingSaleCheck(mock, 5, false)
+	mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("draft"))
+	mock.ExpectExec("UPDATE listings SET status = \\$1, updated_at = \\$2 WHERE id = \\$3").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE listings SET expires_at = \\$1 WHERE id = \\$2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO listing_status_history").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectRealtimeEvent(mock, eventListingStatus)
+	expectListingEvent(mock, 5, StatusActive, listingCreated)
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest(http.MethodPost, "/listing/status", bytes.NewBufferString(`{"listingId":5,"status":"active"}`))
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	listingStatusHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []int{5}, published)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
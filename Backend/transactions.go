@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TransactionStatus is a state of a sale. A seller records a sale as pending
+// and the buyer confirms or declines it.
+type TransactionStatus string
+
+const (
+	TransactionPending   TransactionStatus = "pending"
+	TransactionConfirmed TransactionStatus = "confirmed"
+	TransactionDeclined  TransactionStatus = "declined"
+)
+
+// notificationConfirmPurchase asks a buyer to confirm a sale recorded by the
+// seller.
+const notificationConfirmPurchase = "confirm_purchase"
+
+var (
+	errTransactionNotFound = &requestError{status: http.StatusNotFound, message: "Transaction not found"}
+	errSalePending         = &requestError{status: http.StatusConflict, message: "This listing has a sale awaiting the buyer's confirmation"}
+	// errSaleBlocked is returned when the seller and buyer have blocked one
+	// another.
+	errSaleBlocked = &requestError{status: http.StatusForbidden, message: "You cannot sell to this user"}
+)
+
+// Transaction records the sale of a listing to a buyer. ProductName is kept
+// so the record outlives the listing.
+type Transaction struct {
+	ID          int               `json:"id"`
+	ListingID   *int              `json:"listingId"`
+	ProductName string            `json:"productName"`
+	SellerID    int               `json:"sellerId"`
+	SellerName  string            `json:"sellerName,omitempty"`
+	BuyerID     int               `json:"buyerId"`
+	BuyerName   string            `json:"buyerName,omitempty"`
+	Price       Money             `json:"price"`
+	Currency    string            `json:"currency"`
+	Status      TransactionStatus `json:"status"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	ConfirmedAt *time.Time        `json:"confirmedAt,omitempty"`
+}
+
+// MarkSoldRequest is a seller recording the sale of a listing to a buyer.
+// Price defaults to the buyer's accepted offer, or else the listing price.
+type MarkSoldRequest struct {
+	ListingID int    `json:"listingId"`
+	BuyerID   int    `json:"buyerId"`
+	Price     *Money `json:"price"`
+}
+
+// TransactionResponseRequest is a buyer confirming or declining a sale.
+type TransactionResponseRequest struct {
+	TransactionID int    `json:"transactionId"`
+	Action        string `json:"action"`
+}
+
+// initTransactionsDB creates the table of sales. A listing has at most one
+// sale that is pending or confirmed.
+func initTransactionsDB() error {
+	transactionsTable := `
+	CREATE TABLE IF NOT EXISTS transactions (
+		id SERIAL PRIMARY KEY,
+		listing_id INTEGER REFERENCES listings(id) ON DELETE SET NULL,
+		product_name TEXT NOT NULL,
+		seller_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		buyer_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		price_cents BIGINT NOT NULL CHECK (price_cents >= 0),
+		currency TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		confirmed_at TIMESTAMPTZ,
+		CHECK (seller_id <> buyer_id)
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS transactions_listing_id_idx ON transactions(listing_id) WHERE status <> 'declined';
+	CREATE INDEX IF NOT EXISTS transactions_seller_id_idx ON transactions(seller_id, created_at DESC);
+	CREATE INDEX IF NOT EXISTS transactions_buyer_id_idx ON transactions(buyer_id, created_at DESC);`
+	if _, err := db.Exec(transactionsTable); err != nil {
+		return fmt.Errorf("error creating transactions table: %v", err)
+	}
+	return nil
+}
+
+// publishTransaction pushes a sale's new state to both parties.
+func publishTransaction(ctx context.Context, exec sqlExecutor, t Transaction) error {
+	return publishEvent(ctx, exec, []int{t.SellerID, t.BuyerID}, eventTransaction, t)
+}
+
+// transactionsHandler routes GET (purchase and sales history) and POST (mark
+// a listing sold to a buyer) requests.
+func transactionsHandler(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listTransactions(w, r, currentUserID)
+	case http.MethodPost:
+		markSold(w, r, currentUserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listTransactions writes userID's sales history, newest first.
+// ?role=buyer lists only purchases and ?role=seller only sales; ?status=
+// narrows by state.
+func listTransactions(w http.ResponseWriter, r *http.Request, userID int) {
+	where := &whereBuilder{}
+	switch r.URL.Query().Get("role") {
+	case "":
+		where.add("(t.buyer_id = $%[1]d OR t.seller_id = $%[1]d)", userID)
+	case "buyer":
+		where.add("t.buyer_id = $%d", userID)
+	case "seller":
+		where.add("t.seller_id = $%d", userID)
+	default:
+		http.Error(w, "Invalid role: must be buyer or seller", http.StatusBadRequest)
+		return
+	}
+	if v := r.URL.Query().Get("status"); v != "" {
+		where.add("t.status = $%d", v)
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT t.id, t.listing_id, t.product_name, t.seller_id, s.name, t.buyer_id, b.name, t.price_cents, t.currency, t.status, t.created_at, t.confirmed_at "+
+			"FROM transactions t JOIN users s ON s.id = t.seller_id JOIN users b ON b.id = t.buyer_id "+
+			where.clause()+" ORDER BY t.created_at DESC, t.id DESC",
+		where.args...,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		var t Transaction
+		if err := rows.Scan(&t.ID, &t.ListingID, &t.ProductName, &t.SellerID, &t.SellerName, &t.BuyerID, &t.BuyerName,
+			&t.Price, &t.Currency, &t.Status, &t.CreatedAt, &t.ConfirmedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transactions)
+}
+
+// markSold records the sale of one of userID's listings to a buyer. The
+// listing is reserved until the buyer confirms, and then marked sold.
+func markSold(w http.ResponseWriter, r *http.Request, userID int) {
+	var req MarkSoldRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.BuyerID == userID {
+		http.Error(w, "You cannot sell a listing to yourself", http.StatusBadRequest)
+		return
+	}
+
+	t := Transaction{ListingID: &req.ListingID, SellerID: userID, BuyerID: req.BuyerID, Status: TransactionPending}
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		if err := lockOwnedListing(r.Context(), tx, req.ListingID, userID); err != nil {
+			return err
+		}
+		var status ListingStatus
+		err := tx.QueryRowContext(r.Context(),
+			"SELECT status, price_cents, currency, product_name FROM listings WHERE id = $1", req.ListingID,
+		).Scan(&status, &t.Price, &t.Currency, &t.ProductName)
+		if err != nil {
+			return err
+		}
+		if status != StatusActive && status != StatusReserved {
+			return &requestError{status: http.StatusConflict, message: fmt.Sprintf("Cannot sell a listing that is %s", status)}
+		}
+
+		err = tx.QueryRowContext(r.Context(), "SELECT name FROM users WHERE id = $1", req.BuyerID).Scan(&t.BuyerName)
+		if err == sql.ErrNoRows {
+			return &requestError{status: http.StatusNotFound, message: "User not found"}
+		}
+		if err != nil {
+			return err
+		}
+		blocked, err := isBlocked(r.Context(), tx, userID, req.BuyerID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return errSaleBlocked
+		}
+		if req.Price != nil {
+			t.Price = *req.Price
+		} else {
+			// The price agreed through an accepted offer wins over the asking
+			// price.
+			err := tx.QueryRowContext(r.Context(),
+				"SELECT amount_cents FROM offers WHERE listing_id = $1 AND buyer_id = $2 AND status = $3 ORDER BY responded_at DESC LIMIT 1",
+				req.ListingID, req.BuyerID, OfferAccepted,
+			).Scan(&t.Price)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+
+		t.CreatedAt = time.Now()
+		err = tx.QueryRowContext(r.Context(),
+			"INSERT INTO transactions(listing_id, product_name, seller_id, buyer_id, price_cents, currency, status, created_at) "+
+				"VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+			req.ListingID, t.ProductName, userID, req.BuyerID, t.Price, t.Currency, t.Status, t.CreatedAt,
+		).Scan(&t.ID)
+		if isUniqueViolation(err) {
+			return &requestError{status: http.StatusConflict, message: "This listing already has a sale awaiting confirmation"}
+		}
+		if err != nil {
+			return err
+		}
+		if status == StatusActive {
+			if _, err := setListingStatus(r.Context(), tx, req.ListingID, StatusReserved, &userID); err != nil {
+				return err
+			}
+		}
+		message := fmt.Sprintf("Please confirm your purchase of \"%s\" for %s %s", t.ProductName, t.Price, t.Currency)
+		if err := createNotification(r.Context(), tx, req.BuyerID, notificationConfirmPurchase, message, &req.ListingID); err != nil {
+			return err
+		}
+		return publishTransaction(r.Context(), tx, t)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// transactionResponseHandler handles POST requests from a buyer to confirm
+// or decline a sale. Confirming marks the listing sold; declining puts it
+// back on the market.
+func transactionResponseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	currentUserID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+	var req TransactionResponseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	next := map[string]TransactionStatus{"confirm": TransactionConfirmed, "decline": TransactionDeclined}[req.Action]
+	if next == "" {
+		http.Error(w, "Invalid action: must be confirm or decline", http.StatusBadRequest)
+		return
+	}
+
+	var t Transaction
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(r.Context(),
+			"SELECT id, listing_id, product_name, seller_id, buyer_id, price_cents, currency, status, created_at FROM transactions WHERE id = $1 FOR UPDATE",
+			req.TransactionID,
+		).Scan(&t.ID, &t.ListingID, &t.ProductName, &t.SellerID, &t.BuyerID, &t.Price, &t.Currency, &t.Status, &t.CreatedAt)
+		if err == sql.ErrNoRows || (err == nil && t.BuyerID != currentUserID) {
+			return errTransactionNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if t.Status != TransactionPending {
+			return &requestError{status: http.StatusConflict, message: fmt.Sprintf("Transaction has already been %s", t.Status)}
+		}
+
+		now := time.Now()
+		t.Status = next
+		if next == TransactionConfirmed {
+			t.ConfirmedAt = &now
+		}
+		_, err = tx.ExecContext(r.Context(),
+			"UPDATE transactions SET status = $1, confirmed_at = $2 WHERE id = $3", t.Status, t.ConfirmedAt, t.ID,
+		)
+		if err != nil {
+			return err
+		}
+		// The listing may have been deleted or taken down since; the record
+		// stays, and the listing only follows the sale while it is still
+		// reserved for it.
+		if t.ListingID != nil {
+			var status ListingStatus
+			err := tx.QueryRowContext(r.Context(), "SELECT status FROM listings WHERE id = $1 FOR UPDATE", *t.ListingID).Scan(&status)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if status == StatusReserved {
+				to := StatusSold
+				if next == TransactionDeclined {
+					to = StatusActive
+				}
+				if _, err := setListingStatus(r.Context(), tx, *t.ListingID, to, &currentUserID); err != nil {
+					return err
+				}
+			}
+		}
+		return publishTransaction(r.Context(), tx, t)
+	})
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
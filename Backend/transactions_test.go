@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionsHandler_MarkSold(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedPrice  Money
+	}{
+		{
+			name: "At Accepted Offer Price",
+			body: `{"listingId":3,"buyerId":1}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
+				mock.ExpectQuery("SELECT status, price_cents, currency, product_name FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status", "price_cents", "currency", "product_name"}).AddRow("reserved", 4000, "USD", "Desk Lamp"))
+				mock.ExpectQuery("SELECT name FROM users WHERE id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("User1"))
+				expectBlockCheck(mock, 2, 1, false)
+				mock.ExpectQuery("SELECT amount_cents FROM offers WHERE listing_id = \\$1 AND buyer_id = \\$2 AND status = \\$3").
+					WithArgs(3, 1, OfferAccepted).
+					WillReturnRows(sqlmock.NewRows([]string{"amount_cents"}).AddRow(3500))
+				mock.ExpectQuery("INSERT INTO transactions").
+					WithArgs(3, "Desk Lamp", 2, 1, Money(3500), "USD", TransactionPending, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+				mock.ExpectQuery("INSERT INTO notifications").
+					WithArgs(1, notificationConfirmPurchase, `Please confirm your purchase of "Desk Lamp" for 35.00 USD`, 3, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+				expectRealtimeEvent(mock, eventNotification)
+				expectRealtimeEvent(mock, eventTransaction)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedPrice:  3500,
+		},
+		{
+			name: "Active Listing Is Reserved",
+			body: `{"listingId":3,"buyerId":1,"price":"38"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
+				mock.ExpectQuery("SELECT status, price_cents, currency, product_name FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status", "price_cents", "currency", "product_name"}).AddRow("active", 4000, "USD", "Desk Lamp"))
+				mock.ExpectQuery("SELECT name FROM users WHERE id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("User1"))
+				expectBlockCheck(mock, 2, 1, false)
+				mock.ExpectQuery("INSERT INTO transactions").
+					WithArgs(3, "Desk Lamp", 2, 1, Money(3800), "USD", TransactionPending, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+				mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+				mock.ExpectExec("UPDATE listings SET status = \\$1, updated_at = \\$2 WHERE id = \\$3").
+					WithArgs(StatusReserved, sqlmock.AnyArg(), 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO listing_status_history").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectRealtimeEvent(mock, eventListingStatus)
+				expectListingEvent(mock, 3, StatusReserved, listingUpdated)
+				mock.ExpectQuery("INSERT INTO notifications").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+				expectRealtimeEvent(mock, eventNotification)
+				expectRealtimeEvent(mock, eventTransaction)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusCreated,
+			expectedPrice:  3800,
+		},
+		{
+			name: "Already Sold",
+			body: `{"listingId":3,"buyerId":1}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
+				mock.ExpectQuery("SELECT status, price_cents, currency, product_name FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status", "price_cents", "currency", "product_name"}).AddRow("sold", 4000, "USD", "Desk Lamp"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Unknown Buyer",
+			body: `{"listingId":3,"buyerId":9}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
+				mock.ExpectQuery("SELECT status, price_cents, currency, product_name FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status", "price_cents", "currency", "product_name"}).AddRow("active", 4000, "USD", "Desk Lamp"))
+				mock.ExpectQuery("SELECT name FROM users WHERE id = \\$1").
+					WithArgs(9).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Blocked Buyer",
+			body: `{"listingId":3,"buyerId":1}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
+				mock.ExpectQuery("SELECT status, price_cents, currency, product_name FROM listings WHERE id = \\$1").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status", "price_cents", "currency", "product_name"}).AddRow("active", 4000, "USD", "Desk Lamp"))
+				mock.ExpectQuery("SELECT name FROM users WHERE id = \\$1").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("User1"))
+				expectBlockCheck(mock, 2, 1, true)
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Not The Seller",
+			body: `{"listingId":3,"buyerId":1}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(5))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Sell To Self",
+			body:           `{"listingId":3,"buyerId":2}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", "2")
+			w := httptest.NewRecorder()
+
+			transactionsHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.expectedStatus == http.StatusCreated {
+				var tr Transaction
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tr))
+				assert.Equal(t, tt.expectedPrice, tr.Price)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTransactionResponseHandler(t *testing.T) {
+	transactionRow := func(status string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "listing_id", "product_name", "seller_id", "buyer_id", "price_cents", "currency", "status", "created_at"}).
+			AddRow(8, 3, "Desk Lamp", 2, 1, 3500, "USD", status, time.Now())
+	}
+	tests := []struct {
+		name           string
+		userID         string
+		body           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:   "Confirmed Marks Listing Sold",
+			userID: "1",
+			body:   `{"transactionId":8,"action":"confirm"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("FROM transactions WHERE id = \\$1 FOR UPDATE").
+					WithArgs(8).
+					WillReturnRows(transactionRow("pending"))
+				mock.ExpectExec("UPDATE transactions SET status = \\$1, confirmed_at = \\$2 WHERE id = \\$3").
+					WithArgs(TransactionConfirmed, sqlmock.AnyArg(), 8).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("reserved"))
+				mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("reserved"))
+				mock.ExpectExec("UPDATE listings SET status = \\$1, updated_at = \\$2 WHERE id = \\$3").
+					WithArgs(StatusSold, sqlmock.AnyArg(), 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO listing_status_history").
+					WithArgs(3, StatusReserved, StatusSold, 1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectRealtimeEvent(mock, eventListingStatus)
+				expectListingEvent(mock, 3, StatusSold, listingSold)
+				expectRealtimeEvent(mock, eventTransaction)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Declined Relists",
+			userID: "1",
+			body:   `{"transactionId":8,"action":"decline"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("FROM transactions WHERE id = \\$1 FOR UPDATE").
+					WithArgs(8).
+					WillReturnRows(transactionRow("pending"))
+				mock.ExpectExec("UPDATE transactions SET status = \\$1, confirmed_at = \\$2 WHERE id = \\$3").
+					WithArgs(TransactionDeclined, nil, 8).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("reserved"))
+				mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("reserved"))
+				mock.ExpectExec("UPDATE listings SET status = \\$1, updated_at = \\$2 WHERE id = \\$3").
+					WithArgs(StatusActive, sqlmock.AnyArg(), 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE listings SET expires_at = \\$1 WHERE id = \\$2").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO listing_status_history").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectRealtimeEvent(mock, eventListingStatus)
+				expectListingEvent(mock, 3, StatusActive, listingUpdated)
+				expectRealtimeEvent(mock, eventTransaction)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Confirmed After Listing Archived",
+			userID: "1",
+			body:   `{"transactionId":8,"action":"confirm"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("FROM transactions WHERE id = \\$1 FOR UPDATE").
+					WithArgs(8).
+					WillReturnRows(transactionRow("pending"))
+				mock.ExpectExec("UPDATE transactions SET status = \\$1, confirmed_at = \\$2 WHERE id = \\$3").
+					WithArgs(TransactionConfirmed, sqlmock.AnyArg(), 8).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT status FROM listings WHERE id = \\$1 FOR UPDATE").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("archived"))
+				expectRealtimeEvent(mock, eventTransaction)
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Seller Cannot Confirm",
+			userID: "2",
+			body:   `{"transactionId":8,"action":"confirm"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("FROM transactions WHERE id = \\$1 FOR UPDATE").
+					WithArgs(8).
+					WillReturnRows(transactionRow("pending"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "Already Confirmed",
+			userID: "1",
+			body:   `{"transactionId":8,"action":"confirm"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("FROM transactions WHERE id = \\$1 FOR UPDATE").
+					WithArgs(8).
+					WillReturnRows(transactionRow("confirmed"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Invalid Action",
+			userID:         "1",
+			body:           `{"transactionId":8,"action":"refund"}`,
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			tt.mockSetup(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/transactions/respond", bytes.NewBufferString(tt.body))
+			req.Header.Set("userId", tt.userID)
+			w := httptest.NewRecorder()
+
+			transactionResponseHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTransactionsHandler_History(t *testing.T) {
+	mock := withMockDB(t)
+	mock.ExpectQuery("FROM transactions t JOIN users s ON s.id = t.seller_id JOIN users b ON b.id = t.buyer_id WHERE t.buyer_id = \\$1 AND t.status = \\$2").
+		WithArgs(1, "confirmed").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "listing_id", "product_name", "seller_id", "name", "buyer_id", "name", "price_cents", "currency", "status", "created_at", "confirmed_at"}).
+			AddRow(8, nil, "Desk Lamp", 2, "User2", 1, "User1", 3500, "USD", "confirmed", time.Now(), time.Now()))
+
+	req := httptest.NewRequest(http.MethodGet, "/transactions?role=buyer&status=confirmed", nil)
+	req.Header.Set("userId", "1")
+	w := httptest.NewRecorder()
+
+	transactionsHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var history []Transaction
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	if assert.Len(t, history, 1) {
+		assert.Nil(t, history[0].ListingID, "the record outlives the listing")
+		assert.Equal(t, "User2", history[0].SellerName)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -50,3 +50,33 @@ var SendVerificationCode = func(to, code string) error {
 	}
 	return nil
 }
+
+// SendListingExpiredEmail tells a seller that one of their listings has
+// expired and can be renewed.
+var SendListingExpiredEmail = func(to, productName string, renewDays int) error {
+	body := fmt.Sprintf(
+		"Your listing \"%s\" has expired and is no longer shown to buyers.\n\n"+
+			"Renew it from your listings page to keep it active for another %d days.",
+		productName, renewDays,
+	)
+	err := sendEmail(to, "UFMarketPlace: Your listing has expired", body)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// SendSavedSearchEmail tells a user about new listings matching one of their
+// saved searches.
+var SendSavedSearchEmail = func(to, searchName string, productNames []string) error {
+	body := fmt.Sprintf("New listings match your saved search \"%s\":\n\n", searchName)
+	for _, name := range productNames {
+		body += fmt.Sprintf("- %s\n", name)
+	}
+	body += "\nSign in to UFMarketPlace to see them."
+	err := sendEmail(to, "UFMarketPlace: New matches for your saved search", body)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
@@ -27,17 +27,45 @@ export interface ProductRequest {
   images: File[];    
 }
 
+export interface SellerSummary {
+  name: string;
+  averageRating: number | null;
+  reviewCount: number;
+}
+
 export interface ProductResponse {
   id: string;   
-  userEmail: string,    
+  userId: number;
+  seller: SellerSummary;
   productName: string;
   productDescription: string;
   price: string;     
   category: string;
-  userName: string;
   images: string[]; 
 }
 
+export interface Message {
+  id: number;
+  conversationId: number;
+  senderId: number;
+  body: string;
+  createdAt: string;
+  readAt: string | null;
+}
+
+export interface ImageUploadResult {
+  fileName: string;
+  status: 'stored' | 'rejected';
+  imageId?: number;
+  error?: string;
+}
+
+export interface CreateListingResponse {
+  listingId: number;
+  images: ImageUploadResult[];
+  listings: ProductResponse[];
+}
+
 
 const api = axios.create({
   baseURL: API_BASE_URL,
@@ -130,8 +158,8 @@ export const authService = {
       };
       console.log("Formadat " + formData.get("userId"))
 
-      const response = await api.post<ProductResponse[]>('/listings', formData, config);
-      return response.data;
+      const response = await api.post<CreateListingResponse>('/listings', formData, config);
+      return response.data.listings;
     } catch (error) {
       throw this.handleError(error);
     }
@@ -184,6 +212,25 @@ export const authService = {
       throw this.handleError(error);
     }
   },
+  async startConversation(listingId: string, body: string): Promise<Message> {
+    try {
+      const response = await api.post<Message>('/conversations', {
+        listingId: Number(listingId),
+        body: body
+      });
+      return response.data;
+    } catch (error) {
+      throw this.handleError(error);
+    }
+  },
+  async deleteListingImage(productId: string, imageId: number): Promise<any> {
+    try {
+      const response = await api.delete<any>('/listing/images?listingId=' + productId + '&imageId=' + imageId);
+      return response.data;
+    } catch (error) {
+      throw this.handleError(error);
+    }
+  },
   async deleteListing(productId: string): Promise<any> {
     try {
       const response = await api.delete<any>('/listing/deleteListing?listingId='+productId+'&userEmail='+getEmail());
@@ -1,6 +1,7 @@
 import { fireEvent, render, screen, waitFor } from "@testing-library/react";
 import { MemoryRouter } from "react-router-dom";
 import Dashboard from "./Dashboard";
+import { authService } from "./AuthService";
 
 jest.mock("react-router-dom", () => ({
     ...jest.requireActual("react-router-dom"),
@@ -17,8 +18,8 @@ jest.mock("react-router-dom", () => ({
               price: '10',
               category: 'Category A',
               images: [{ contentType: 'image/jpeg', data: 'base64encodedstring' }],
-              userName: 'User A',
-              userEmail: 'usera@example.com'
+              userId: 2,
+              seller: { name: 'User A', averageRating: null, reviewCount: 0 }
             },
             {
               id: '2',
@@ -27,10 +28,11 @@ jest.mock("react-router-dom", () => ({
               price: '20',
               category: 'Category B',
               images: [{ contentType: 'image/jpeg', data: 'base64encodedstring' }],
-              userName: 'User B',
-              userEmail: 'userb@example.com'
+              userId: 3,
+              seller: { name: 'User B', averageRating: null, reviewCount: 0 }
             }
           ]),
+        startConversation: jest.fn().mockResolvedValue({ id: 1, conversationId: 1, senderId: 1, body: 'Is this available?', createdAt: '', readAt: null }),
     },
   }));
 
@@ -85,7 +87,14 @@ jest.mock("react-router-dom", () => ({
           //expect(screen.getByText("10$", { selector: '.price' })).toBeInTheDocument();
           //expect(screen.getByText("Category A")).toBeInTheDocument();
           expect(screen.getByText("User A")).toBeInTheDocument();
-          expect(screen.getByText("usera@example.com")).toBeInTheDocument();
+        });
+
+        // Message the seller instead of emailing them
+        fireEvent.change(screen.getByPlaceholderText("Ask the seller about this item"), { target: { value: "Is this available?" } });
+        fireEvent.click(screen.getByRole("button", { name: "Message Seller" }));
+        await waitFor(() => {
+          expect(authService.startConversation).toHaveBeenCalledWith("1", "Is this available?");
+          expect(screen.getByText("Message sent")).toBeInTheDocument();
         });
     
         // Close the modal
@@ -15,14 +15,15 @@ interface Product {
   price: string;
   category: string;
   images: string[];
-  userName: string;
-  userEmail: string;
+  sellerName: string;
 }
 
 const Dashboard: React.FC = () => {
   const [products, setProducts] = useState<Product[]>([]);
   const [selectedProduct, setSelectedProduct] = useState<Product | null>(null);
   const [isModalOpen, setIsModalOpen] = useState(false);
+  const [message, setMessage] = useState('');
+  const [messageStatus, setMessageStatus] = useState('');
 
   useEffect(() => {
     const fetchListings = async () => {
@@ -38,8 +39,7 @@ const Dashboard: React.FC = () => {
             images: prod.images.map((imgObj: any) =>
               `data:${imgObj.contentType};base64,${imgObj.data}`
             ),
-            userName: prod.userName,
-            userEmail: prod.userEmail
+            sellerName: prod.seller.name
           }));
           setProducts(updatedProducts);
         }
@@ -52,9 +52,22 @@ const Dashboard: React.FC = () => {
 
   const handleProductClick = (product: Product) => {
     setSelectedProduct(product);
+    setMessage('');
+    setMessageStatus('');
     setIsModalOpen(true);
   };
 
+  const handleSendMessage = async () => {
+    if (!selectedProduct || !message.trim()) return;
+    try {
+      await authService.startConversation(selectedProduct.id, message.trim());
+      setMessage('');
+      setMessageStatus('Message sent');
+    } catch (error) {
+      setMessageStatus(error instanceof Error ? error.message : 'Could not send message');
+    }
+  };
+
   const carouselSettings = {
     dots: true,
     infinite: true,
@@ -155,14 +168,19 @@ const Dashboard: React.FC = () => {
                     <div className="user-details">
                       <p className="seller-name">
                         <span className="icon">👤</span>
-                        {selectedProduct.userName}
-                      </p>
-                      <p className="seller-email">
-                        <span className="icon">✉️</span>
-                        <a href={`mailto:${selectedProduct.userEmail}`}>
-                          {selectedProduct.userEmail}
-                        </a>
+                        {selectedProduct.sellerName}
                       </p>
+                      <div className="seller-message">
+                        <textarea
+                          placeholder="Ask the seller about this item"
+                          value={message}
+                          onChange={(e) => setMessage(e.target.value)}
+                        />
+                        <button onClick={handleSendMessage} disabled={!message.trim()}>
+                          Message Seller
+                        </button>
+                        {messageStatus && <p className="message-status">{messageStatus}</p>}
+                      </div>
                     </div>
                   </div>
                 </div>
@@ -13,6 +13,7 @@ jest.mock("../AuthService", () => ({
     createProduct: jest.fn(),
     updateProduct: jest.fn(),
     deleteListing: jest.fn(),
+    deleteListingImage: jest.fn(),
   },
 }));
 
@@ -16,6 +16,7 @@ interface Product {
   price: string;      
   category: string;
   images: string[];
+  imageIds: number[];
 }
 
 const Sell: React.FC = () => {
@@ -28,6 +29,8 @@ const Sell: React.FC = () => {
     price: string;
     category: string;
     images: (File | string)[]; 
+    imageIds: number[];
+    removedImageIds: number[];
   }>({
     id: '',
     name: '',
@@ -35,6 +38,8 @@ const Sell: React.FC = () => {
     price: '',
     category: '',
     images: [],
+    imageIds: [],
+    removedImageIds: [],
   });
 
   const carouselSettings = {
@@ -70,6 +75,7 @@ const Sell: React.FC = () => {
             images: prod.images.map((imgObj: any) =>
               `data:${imgObj.contentType};base64,${imgObj.data}`
             ),
+            imageIds: prod.images.map((imgObj: any) => imgObj.id),
           }));
 
           setProducts(updatedProducts);
@@ -94,13 +100,11 @@ const Sell: React.FC = () => {
 
     if (productData.id) {
     
-      const fileImages = productData.images.map((img, index) => {
-        if (typeof img === 'string') {
-          return base64ToFile(img, `existing-image-${index}.png`);
-        } else {
-          return img; 
-        }
-      });
+      // Existing images stay as they are; only new uploads are sent, and
+      // removed images are deleted one by one.
+      const fileImages = productData.images.filter(
+        (img): img is File => img instanceof File
+      );
 
       const updateProductData: ProductRequest = {
         id: productData.id,
@@ -113,7 +117,13 @@ const Sell: React.FC = () => {
 
       try {
         
-        const responseProducts: ProductResponse[] = await authService.updateProduct(updateProductData);
+        let responseProducts: ProductResponse[] = await authService.updateProduct(updateProductData);
+        if (productData.removedImageIds.length > 0) {
+          for (const imageId of productData.removedImageIds) {
+            await authService.deleteListingImage(productData.id, imageId);
+          }
+          responseProducts = await authService.getListing();
+        }
         const updatedProducts: Product[] = responseProducts.map((prod) => ({
           id: String(prod.id),
           name: prod.productName,
@@ -123,6 +133,7 @@ const Sell: React.FC = () => {
           images: prod.images.map((imgObj: any) =>
             `data:${imgObj.contentType};base64,${imgObj.data}`
           ),
+          imageIds: prod.images.map((imgObj: any) => imgObj.id),
         }));
 
         setProducts(updatedProducts);
@@ -157,6 +168,7 @@ const Sell: React.FC = () => {
           images: prod.images.map((imgObj: any) =>
             `data:${imgObj.contentType};base64,${imgObj.data}`
           ),
+          imageIds: prod.images.map((imgObj: any) => imgObj.id),
         }));
 
         setProducts(newProducts);
@@ -174,6 +186,8 @@ const Sell: React.FC = () => {
       price: '',
       category: '',
       images: [],
+      imageIds: [],
+      removedImageIds: [],
     });
   };
 
@@ -190,6 +204,7 @@ const Sell: React.FC = () => {
         images: prod.images.map((imgObj: any) =>
           `data:${imgObj.contentType};base64,${imgObj.data}`
         ),
+        imageIds: prod.images.map((imgObj: any) => imgObj.id),
       }));
 
       setProducts(newProducts);
@@ -208,6 +223,8 @@ const Sell: React.FC = () => {
       price: numericPrice,
       category: product.category,
       images: product.images,
+      imageIds: product.imageIds,
+      removedImageIds: [],
     });
     setIsModalOpen(true);
   };
@@ -224,29 +241,18 @@ const Sell: React.FC = () => {
   };
 
   const removeImage = (index: number) => {
-    const newImages = productData.images.filter((_, i) => i !== index);
-    setProductData((prev) => ({ ...prev, images: newImages }));
+    // Existing images come before new uploads, so they share their index
+    // with imageIds.
+    const isExisting = typeof productData.images[index] === 'string';
+    setProductData((prev) => ({
+      ...prev,
+      images: prev.images.filter((_, i) => i !== index),
+      imageIds: isExisting ? prev.imageIds.filter((_, i) => i !== index) : prev.imageIds,
+      removedImageIds: isExisting ? [...prev.removedImageIds, prev.imageIds[index]] : prev.removedImageIds,
+    }));
   };
 
 
-  function base64ToFile(base64Data: string, filename: string): File {
-    if (!base64Data.startsWith('data:')) {
-      console.warn('String does not look like base64 Data URL:', base64Data);
-      return new File([], filename);
-    }
-
-    const [header, base64String] = base64Data.split(',');
-    // parse out the mime, e.g. "image/png"
-    const mimeMatch = header.match(/data:(.*?);base64/);
-    const mime = mimeMatch ? mimeMatch[1] : 'application/octet-stream';
-
-    const binary = atob(base64String);
-    const array = new Uint8Array(binary.length);
-    for (let i = 0; i < binary.length; i++) {
-      array[i] = binary.charCodeAt(i);
-    }
-    return new File([array], filename, { type: mime });
-  }
 
 
   const ProductCard: FC<{ product: Product }> = ({ product }) => {
@@ -451,6 +457,8 @@ const Sell: React.FC = () => {
                     price: '',
                     category: '',
                     images: [],
+                    imageIds: [],
+                    removedImageIds: [],
                   });
                 }}
               >